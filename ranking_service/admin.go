@@ -0,0 +1,615 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/redis/go-redis/v9"
+	"shared/auth"
+	"shared/matches"
+	"shared/ratings"
+	"shared/recent"
+)
+
+const (
+	// auditLogKey is a redis list of audit entries, newest first.
+	auditLogKey = "audit:log"
+	// bannedUsersKey is maintained by worker_service's moderation events.
+	bannedUsersKey = "banned_users"
+)
+
+// AuditEntry records one admin action on a leaderboard.
+type AuditEntry struct {
+	Time     time.Time              `json:"time"`
+	Actor    string                 `json:"actor"`
+	Action   string                 `json:"action"`
+	GameMode string                 `json:"game_mode,omitempty"`
+	UserID   string                 `json:"user_id,omitempty"`
+	Reason   string                 `json:"reason"`
+	Details  map[string]interface{} `json:"details,omitempty"`
+}
+
+// Snapshot describes a saved copy of a leaderboard.
+type Snapshot struct {
+	ID        string    `json:"id"`
+	GameMode  string    `json:"game_mode"`
+	Board     string    `json:"board"`
+	CreatedAt time.Time `json:"created_at"`
+	Players   int64     `json:"players"`
+}
+
+type adminRequest struct {
+	Score  *float64 `json:"score"`
+	Delta  *float64 `json:"delta"`
+	Reason string   `json:"reason"`
+}
+
+// getSnapshotKey returns the key of a snapshot of board, a game mode or one
+// of its season boards.
+func getSnapshotKey(board, snapshotID string) string {
+	return "snapshot:leaderboard:" + board + ":" + snapshotID
+}
+
+func getSnapshotIndexKey(board string) string {
+	return "snapshots:leaderboard:" + board
+}
+
+// registerAdminRoutes registers the admin API. Moderators may read the
+// snapshots and the audit log, only admins may change anything. The
+// leaderboard endpoints act on the board the season query parameter names,
+// like the leaderboard reads: the current season of the mode by default,
+// "all" for the all-time board.
+func registerAdminRoutes(r *mux.Router) {
+	adminOnly := auth.RequireRole(auth.RoleAdmin)
+	staff := auth.RequireRole(auth.RoleModerator, auth.RoleAdmin)
+
+	admin := r.PathPrefix("/v1/admin").Subrouter()
+	admin.Use(verifier.Middleware)
+	admin.Handle("/leaderboards/{mode}/reset", adminOnly(http.HandlerFunc(resetLeaderboardHandler))).Methods("POST")
+	admin.Handle("/leaderboards/{mode}/players/{userId}", adminOnly(http.HandlerFunc(setScoreHandler))).Methods("PUT")
+	admin.Handle("/leaderboards/{mode}/players/{userId}/adjust", adminOnly(http.HandlerFunc(adjustScoreHandler))).Methods("POST")
+	admin.Handle("/leaderboards/{mode}/players/{userId}", adminOnly(http.HandlerFunc(removePlayerHandler))).Methods("DELETE")
+	admin.Handle("/leaderboards/{mode}/snapshots", adminOnly(http.HandlerFunc(createSnapshotHandler))).Methods("POST")
+	admin.Handle("/leaderboards/{mode}/snapshots", staff(http.HandlerFunc(listSnapshotsHandler))).Methods("GET")
+	admin.Handle("/leaderboards/{mode}/snapshots/{snapshotId}/restore", adminOnly(http.HandlerFunc(restoreSnapshotHandler))).Methods("POST")
+	admin.Handle("/seasons/{seasonId}", adminOnly(http.HandlerFunc(putSeasonHandler))).Methods("PUT")
+	admin.Handle("/audit", staff(http.HandlerFunc(getAuditLogHandler))).Methods("GET")
+}
+
+// adminBoard returns the game mode in the path and the board of it the
+// season query parameter selects, writing the error response if it fails.
+func adminBoard(w http.ResponseWriter, r *http.Request) (string, string, bool) {
+	gameMode := mux.Vars(r)["mode"]
+	board, err := seasonBoard(r.Context(), gameMode, r.URL.Query().Get("season"))
+	if err != nil {
+		writeBoardError(w, err)
+		return "", "", false
+	}
+	return gameMode, board, true
+}
+
+// decodeAdminRequest reads the request body, which must at least give a
+// reason for the audit log.
+func decodeAdminRequest(w http.ResponseWriter, r *http.Request) (adminRequest, bool) {
+	var req adminRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid request format", http.StatusBadRequest)
+		return req, false
+	}
+
+	if req.Reason == "" {
+		http.Error(w, "reason is required", http.StatusBadRequest)
+		return req, false
+	}
+
+	return req, true
+}
+
+// audited queues the changes of an admin action and appends entry to the
+// audit log in a single transaction, so that no change is made without its
+// audit entry.
+func audited(r *http.Request, entry AuditEntry, queue func(pipe redis.Pipeliner) error) error {
+	return auditedWatch(r, entry, nil, nil, queue)
+}
+
+// maxAuditAttempts bounds the retries of an audited action whose watched
+// keys keep changing.
+const maxAuditAttempts = 5
+
+// auditedWatch is audited for actions whose entry records the values they
+// replace: read reads them from keys and completes the entry, and the
+// action is retried if keys change before it commits, so that the entry
+// records exactly what was replaced.
+func auditedWatch(r *http.Request, entry AuditEntry, keys []string, read func(tx *redis.Tx, entry *AuditEntry) error, queue func(pipe redis.Pipeliner) error) error {
+	entry.Time = time.Now().UTC()
+	if claims, ok := auth.FromContext(r.Context()); ok {
+		entry.Actor = claims.Username
+	}
+
+	var data []byte
+	action := func(tx *redis.Tx) error {
+		if read != nil {
+			if err := read(tx, &entry); err != nil {
+				return err
+			}
+		}
+
+		var err error
+		data, err = json.Marshal(entry)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.TxPipelined(r.Context(), func(pipe redis.Pipeliner) error {
+			if err := queue(pipe); err != nil {
+				return err
+			}
+			pipe.LPush(r.Context(), auditLogKey, data)
+			return nil
+		})
+		return err
+	}
+
+	var err error
+	for attempt := 0; attempt < maxAuditAttempts; attempt++ {
+		if err = rdb.Watch(r.Context(), action, keys...); err != redis.TxFailedErr {
+			break
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	log.Printf("audit: %s", data)
+	return nil
+}
+
+// rejectBannedPlayer writes a conflict for banned players, whose scores are
+// held by worker_service until they are unbanned.
+func rejectBannedPlayer(w http.ResponseWriter, r *http.Request, userID string) bool {
+	banned, err := rdb.SIsMember(r.Context(), bannedUsersKey, getUserKey(userID)).Result()
+	if err != nil {
+		log.Printf("failed to check ban: %v", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return true
+	}
+
+	if banned {
+		http.Error(w, "player is banned", http.StatusConflict)
+		return true
+	}
+
+	return false
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// resetLeaderboardHandler empties a leaderboard after taking a snapshot of
+// it, so a reset can always be undone.
+func resetLeaderboardHandler(w http.ResponseWriter, r *http.Request) {
+	gameMode, board, ok := adminBoard(w, r)
+	if !ok {
+		return
+	}
+
+	req, ok := decodeAdminRequest(w, r)
+	if !ok {
+		return
+	}
+
+	snapshot, err := newSnapshot(gameMode, board)
+	if err != nil {
+		log.Printf("failed to create snapshot ID: %v", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	var players *redis.IntCmd
+	err = audited(r, AuditEntry{
+		Action:   "reset",
+		GameMode: gameMode,
+		Reason:   req.Reason,
+		Details:  map[string]interface{}{"board": board, "snapshot_id": snapshot.ID},
+	}, func(pipe redis.Pipeliner) error {
+		players = queueSnapshot(r.Context(), pipe, snapshot)
+		pipe.Del(r.Context(), getLeaderboardKey(board))
+		return nil
+	})
+	if err != nil {
+		log.Printf("failed to reset leaderboard: %v", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	snapshot.Players = players.Val()
+	writeJSON(w, http.StatusOK, snapshot)
+}
+
+func setScoreHandler(w http.ResponseWriter, r *http.Request) {
+	gameMode, board, ok := adminBoard(w, r)
+	if !ok {
+		return
+	}
+	userID := mux.Vars(r)["userId"]
+
+	req, ok := decodeAdminRequest(w, r)
+	if !ok {
+		return
+	}
+
+	if req.Score == nil {
+		http.Error(w, "score is required", http.StatusBadRequest)
+		return
+	}
+
+	if rejectBannedPlayer(w, r, userID) {
+		return
+	}
+
+	leaderboardKey := getLeaderboardKey(board)
+	playerKey := getUserKey(userID)
+
+	err := auditedWatch(r, AuditEntry{
+		Action:   "set_score",
+		GameMode: gameMode,
+		UserID:   userID,
+		Reason:   req.Reason,
+		Details:  map[string]interface{}{"board": board, "previous_score": nil, "score": *req.Score},
+	}, []string{leaderboardKey}, func(tx *redis.Tx, entry *AuditEntry) error {
+		previous, err := tx.ZScore(r.Context(), leaderboardKey, playerKey).Result()
+		if err == redis.Nil {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		entry.Details["previous_score"] = previous
+		return nil
+	}, func(pipe redis.Pipeliner) error {
+		pipe.ZAdd(r.Context(), leaderboardKey, redis.Z{Score: *req.Score, Member: playerKey})
+		return nil
+	})
+	if err != nil {
+		log.Printf("failed to set user score: %v", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, LeaderboardEntry{UserID: userID, Score: *req.Score})
+}
+
+func adjustScoreHandler(w http.ResponseWriter, r *http.Request) {
+	gameMode, board, ok := adminBoard(w, r)
+	if !ok {
+		return
+	}
+	userID := mux.Vars(r)["userId"]
+
+	req, ok := decodeAdminRequest(w, r)
+	if !ok {
+		return
+	}
+
+	if req.Delta == nil {
+		http.Error(w, "delta is required", http.StatusBadRequest)
+		return
+	}
+
+	if rejectBannedPlayer(w, r, userID) {
+		return
+	}
+
+	var score *redis.FloatCmd
+	err := audited(r, AuditEntry{
+		Action:   "adjust_score",
+		GameMode: gameMode,
+		UserID:   userID,
+		Reason:   req.Reason,
+		Details:  map[string]interface{}{"board": board, "delta": *req.Delta},
+	}, func(pipe redis.Pipeliner) error {
+		score = pipe.ZIncrBy(r.Context(), getLeaderboardKey(board), *req.Delta, getUserKey(userID))
+		return nil
+	})
+	if err != nil {
+		log.Printf("failed to adjust user score: %v", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, LeaderboardEntry{UserID: userID, Score: score.Val()})
+}
+
+// removePlayerHandler removes a player from the board the season selects
+// and from every board of the mode that is not seasonal: the recent, wins,
+// win rate and rating boards. Their match stats and rating in the mode are
+// deleted too, so that their next match does not put them back on the
+// wins, win rate and rating boards with their former record.
+func removePlayerHandler(w http.ResponseWriter, r *http.Request) {
+	gameMode, board, ok := adminBoard(w, r)
+	if !ok {
+		return
+	}
+	userID := mux.Vars(r)["userId"]
+
+	req, ok := decodeAdminRequest(w, r)
+	if !ok {
+		return
+	}
+
+	boards := []string{
+		board,
+		recent.Board(gameMode),
+		matches.WinsBoard(gameMode),
+		matches.WinRateBoard(gameMode),
+		ratings.Board(gameMode),
+	}
+	playerKey := getUserKey(userID)
+	statsKey := matches.StatsKey(gameMode, userID)
+	ratingKey := ratings.Key(gameMode, userID)
+
+	keys := []string{statsKey, ratingKey}
+	for _, b := range boards {
+		keys = append(keys, getLeaderboardKey(b))
+	}
+
+	err := auditedWatch(r, AuditEntry{
+		Action:   "remove_player",
+		GameMode: gameMode,
+		UserID:   userID,
+		Reason:   req.Reason,
+	}, keys, func(tx *redis.Tx, entry *AuditEntry) error {
+		scores := make([]*redis.FloatCmd, len(boards))
+		var stats, rating *redis.MapStringStringCmd
+		_, err := tx.Pipelined(r.Context(), func(pipe redis.Pipeliner) error {
+			for i, b := range boards {
+				scores[i] = pipe.ZScore(r.Context(), getLeaderboardKey(b), playerKey)
+			}
+			stats = pipe.HGetAll(r.Context(), statsKey)
+			rating = pipe.HGetAll(r.Context(), ratingKey)
+			return nil
+		})
+		if err != nil && err != redis.Nil {
+			return err
+		}
+
+		previous := make(map[string]float64)
+		for i, cmd := range scores {
+			switch err := cmd.Err(); err {
+			case nil:
+				previous[boards[i]] = cmd.Val()
+			case redis.Nil:
+			default:
+				return err
+			}
+		}
+		if len(previous) == 0 && len(stats.Val()) == 0 && len(rating.Val()) == 0 {
+			return errPlayerNotFound
+		}
+
+		entry.Details = map[string]interface{}{"previous_scores": previous}
+		if len(stats.Val()) > 0 {
+			entry.Details["previous_stats"] = stats.Val()
+		}
+		if len(rating.Val()) > 0 {
+			entry.Details["previous_rating"] = rating.Val()
+		}
+		return nil
+	}, func(pipe redis.Pipeliner) error {
+		for _, b := range boards {
+			pipe.ZRem(r.Context(), getLeaderboardKey(b), playerKey)
+		}
+		pipe.Del(r.Context(), statsKey, ratingKey)
+		return nil
+	})
+	if err == errPlayerNotFound {
+		http.Error(w, "user not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Printf("failed to remove user: %v", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// newSnapshot describes a new snapshot of board. Its ID starts with the
+// creation time for readability and ends with random bytes, so that
+// snapshots taken in the same millisecond do not overwrite each other.
+func newSnapshot(gameMode, board string) (Snapshot, error) {
+	suffix := make([]byte, 8)
+	if _, err := rand.Read(suffix); err != nil {
+		return Snapshot{}, err
+	}
+
+	now := time.Now().UTC()
+	return Snapshot{
+		ID:        strconv.FormatInt(now.UnixMilli(), 10) + "-" + hex.EncodeToString(suffix),
+		GameMode:  gameMode,
+		Board:     board,
+		CreatedAt: now,
+	}, nil
+}
+
+// queueSnapshot queues the copy of the snapshot's board into its key in a
+// transaction, returning the command counting its players.
+func queueSnapshot(ctx context.Context, pipe redis.Pipeliner, snapshot Snapshot) *redis.IntCmd {
+	snapshotKey := getSnapshotKey(snapshot.Board, snapshot.ID)
+
+	// A single key union is an atomic copy of the sorted set.
+	pipe.ZUnionStore(ctx, snapshotKey, &redis.ZStore{Keys: []string{getLeaderboardKey(snapshot.Board)}})
+	players := pipe.ZCard(ctx, snapshotKey)
+	pipe.ZAdd(ctx, getSnapshotIndexKey(snapshot.Board), redis.Z{Score: float64(snapshot.CreatedAt.UnixMilli()), Member: snapshot.ID})
+	return players
+}
+
+func createSnapshotHandler(w http.ResponseWriter, r *http.Request) {
+	gameMode, board, ok := adminBoard(w, r)
+	if !ok {
+		return
+	}
+
+	req, ok := decodeAdminRequest(w, r)
+	if !ok {
+		return
+	}
+
+	snapshot, err := newSnapshot(gameMode, board)
+	if err != nil {
+		log.Printf("failed to create snapshot ID: %v", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	var players *redis.IntCmd
+	err = audited(r, AuditEntry{
+		Action:   "snapshot",
+		GameMode: gameMode,
+		Reason:   req.Reason,
+		Details:  map[string]interface{}{"board": board, "snapshot_id": snapshot.ID},
+	}, func(pipe redis.Pipeliner) error {
+		players = queueSnapshot(r.Context(), pipe, snapshot)
+		return nil
+	})
+	if err != nil {
+		log.Printf("failed to snapshot leaderboard: %v", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	snapshot.Players = players.Val()
+	writeJSON(w, http.StatusCreated, snapshot)
+}
+
+func listSnapshotsHandler(w http.ResponseWriter, r *http.Request) {
+	gameMode, board, ok := adminBoard(w, r)
+	if !ok {
+		return
+	}
+
+	ids, err := rdb.ZRevRangeWithScores(r.Context(), getSnapshotIndexKey(board), 0, -1).Result()
+	if err != nil {
+		log.Printf("failed to list snapshots: %v", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	snapshots := make([]Snapshot, 0, len(ids))
+	for _, z := range ids {
+		id := z.Member.(string)
+		players, err := rdb.ZCard(r.Context(), getSnapshotKey(board, id)).Result()
+		if err != nil {
+			log.Printf("failed to count snapshot players: %v", err)
+			http.Error(w, "internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		snapshots = append(snapshots, Snapshot{
+			ID:        id,
+			GameMode:  gameMode,
+			Board:     board,
+			CreatedAt: time.UnixMilli(int64(z.Score)).UTC(),
+			Players:   players,
+		})
+	}
+
+	writeJSON(w, http.StatusOK, snapshots)
+}
+
+// restoreSnapshotHandler replaces a leaderboard with a snapshot. The current
+// board is snapshotted first so the restore can be undone too.
+func restoreSnapshotHandler(w http.ResponseWriter, r *http.Request) {
+	gameMode, board, ok := adminBoard(w, r)
+	if !ok {
+		return
+	}
+	snapshotID := mux.Vars(r)["snapshotId"]
+
+	req, ok := decodeAdminRequest(w, r)
+	if !ok {
+		return
+	}
+
+	_, err := rdb.ZScore(r.Context(), getSnapshotIndexKey(board), snapshotID).Result()
+	if err == redis.Nil {
+		http.Error(w, "snapshot not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Printf("failed to look up snapshot: %v", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	backup, err := newSnapshot(gameMode, board)
+	if err != nil {
+		log.Printf("failed to create snapshot ID: %v", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	var players *redis.IntCmd
+	err = audited(r, AuditEntry{
+		Action:   "restore",
+		GameMode: gameMode,
+		Reason:   req.Reason,
+		Details: map[string]interface{}{
+			"board":              board,
+			"snapshot_id":        snapshotID,
+			"backup_snapshot_id": backup.ID,
+		},
+	}, func(pipe redis.Pipeliner) error {
+		queueSnapshot(r.Context(), pipe, backup)
+		players = pipe.ZUnionStore(r.Context(), getLeaderboardKey(board), &redis.ZStore{
+			Keys: []string{getSnapshotKey(board, snapshotID)},
+		})
+		return nil
+	})
+	if err != nil {
+		log.Printf("failed to restore snapshot: %v", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"restored_snapshot_id": snapshotID,
+		"backup_snapshot_id":   backup.ID,
+		"players":              players.Val(),
+	})
+}
+
+func getAuditLogHandler(w http.ResponseWriter, r *http.Request) {
+	limit := int64(100)
+	if value := r.URL.Query().Get("limit"); value != "" {
+		parsed, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || parsed < 1 {
+			http.Error(w, fmt.Sprintf("invalid limit %q", value), http.StatusBadRequest)
+			return
+		}
+		limit = parsed
+	}
+
+	raw, err := rdb.LRange(r.Context(), auditLogKey, 0, limit-1).Result()
+	if err != nil {
+		log.Printf("failed to read audit log: %v", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	entries := make([]json.RawMessage, len(raw))
+	for i, entry := range raw {
+		entries[i] = json.RawMessage(entry)
+	}
+
+	writeJSON(w, http.StatusOK, entries)
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/redis/go-redis/v9"
+	"shared/rankhistory"
+)
+
+// RankHistory is a player's rank over time on a board.
+type RankHistory struct {
+	UserID string              `json:"user_id"`
+	Board  string              `json:"board"`
+	Points []rankhistory.Point `json:"points"`
+}
+
+// getRankHistoryHandler returns the points recorded by worker_service's
+// snapshotter for a player, oldest first. The board is chosen like for the
+// rank endpoint and from and to (RFC3339) bound the series.
+func getRankHistoryHandler(w http.ResponseWriter, r *http.Request) {
+	userID := mux.Vars(r)["userId"]
+
+	if rdb == nil {
+		http.Error(w, "rank history requires the redis store", http.StatusBadRequest)
+		return
+	}
+
+	board, err := resolveBoard(r)
+	if err != nil {
+		writeBoardError(w, err)
+		return
+	}
+
+	from, to := "-inf", "+inf"
+	for param, bound := range map[string]*string{"from": &from, "to": &to} {
+		value := r.URL.Query().Get(param)
+		if value == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			http.Error(w, "invalid "+param+", must be an RFC3339 timestamp", http.StatusBadRequest)
+			return
+		}
+		*bound = strconv.FormatInt(t.Unix(), 10)
+	}
+
+	members, err := rdb.ZRangeByScore(r.Context(), rankhistory.Key(board, userID), &redis.ZRangeBy{
+		Min: from,
+		Max: to,
+	}).Result()
+	if err != nil {
+		log.Printf("failed to get rank history: %v", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	history := RankHistory{
+		UserID: userID,
+		Board:  board,
+		Points: make([]rankhistory.Point, 0, len(members)),
+	}
+	for _, member := range members {
+		point, err := rankhistory.Decode(member)
+		if err != nil {
+			log.Printf("skipping malformed rank history point: %v", err)
+			continue
+		}
+		history.Points = append(history.Points, point)
+	}
+
+	writeJSON(w, http.StatusOK, history)
+}
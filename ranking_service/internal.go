@@ -0,0 +1,41 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"shared/mtls"
+)
+
+// defaultUsersInternalURL is the local internal API of users_service.
+const defaultUsersInternalURL = "https://localhost:8443"
+
+var (
+	// usersClient calls the internal API of users_service, presenting a
+	// certificate named after the service client ID.
+	usersClient      *http.Client
+	usersInternalURL string
+)
+
+func setUpInternalClient(clientID string) {
+	certsDir := os.Getenv("INTERNAL_CERTS_DIR")
+	if certsDir == "" {
+		certsDir = mtls.DefaultDir
+	}
+	ca, err := mtls.LoadOrCreateCA(certsDir)
+	if err != nil {
+		log.Fatalf("failed to load internal CA: %v", err)
+	}
+	identity, err := mtls.NewIdentity(ca, clientID)
+	if err != nil {
+		log.Fatalf("failed to issue internal certificate: %v", err)
+	}
+	usersClient = identity.HTTPClient(5 * time.Second)
+
+	usersInternalURL = os.Getenv("USERS_INTERNAL_URL")
+	if usersInternalURL == "" {
+		usersInternalURL = defaultUsersInternalURL
+	}
+}
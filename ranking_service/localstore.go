@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"shared/events"
+)
+
+// defaultLocalSessionsFile is shared with worker_service's local sink. Both
+// services are started from their own directory, hence the parent path.
+const defaultLocalSessionsFile = "../local-data/sessions.jsonl"
+
+// LocalStore builds the leaderboards in memory by tailing the sessions file
+// written by worker_service's local sink.
+type LocalStore struct {
+	path string
+
+	mu     sync.RWMutex
+	boards map[string]*sortedSet
+}
+
+func NewLocalStore(path string) *LocalStore {
+	return &LocalStore{
+		path:   path,
+		boards: make(map[string]*sortedSet),
+	}
+}
+
+// localSessionsFile returns the sessions file, which can be moved with the
+// LOCAL_SESSIONS_FILE environment variable.
+func localSessionsFile() string {
+	if path := os.Getenv("LOCAL_SESSIONS_FILE"); path != "" {
+		return path
+	}
+	return defaultLocalSessionsFile
+}
+
+// Follow reads the sessions file from the start and keeps applying lines
+// appended to it until ctx is cancelled.
+func (s *LocalStore) Follow(ctx context.Context, pollInterval time.Duration) {
+	var offset int64
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+
+	for {
+		var err error
+		offset, err = s.readFrom(offset)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			log.Printf("failed to read local sessions file: %v", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// readFrom applies every complete line after offset and returns the offset
+// following the last applied line.
+func (s *LocalStore) readFrom(offset int64) (int64, error) {
+	file, err := os.Open(s.path)
+	if err != nil {
+		return offset, err
+	}
+	defer file.Close()
+
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		return offset, err
+	}
+
+	reader := bufio.NewReader(file)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			// A partial line is still being written, pick it up next time.
+			return offset, nil
+		} else if err != nil {
+			return offset, err
+		}
+		offset += int64(len(line))
+
+		var session events.GameSession
+		if err := json.Unmarshal(line, &session); err != nil {
+			log.Printf("skipping malformed local session: %v", err)
+			continue
+		}
+		s.apply(session)
+	}
+}
+
+func (s *LocalStore) apply(session events.GameSession) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	board, ok := s.boards[session.GameMode]
+	if !ok {
+		board = newSortedSet()
+		s.boards[session.GameMode] = board
+	}
+	board.incrBy(session.UserID, float64(session.Score))
+}
+
+func (s *LocalStore) Top(ctx context.Context, gameMode string, n int64) ([]LeaderboardEntry, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	board, ok := s.boards[gameMode]
+	if !ok {
+		return nil, nil
+	}
+
+	var entries []LeaderboardEntry
+	for i, member := range board.revRange(int(n)) {
+		entries = append(entries, LeaderboardEntry{
+			UserID: member,
+			Score:  board.scores[member],
+			Rank:   int64(i + 1),
+		})
+	}
+
+	return entries, nil
+}
+
+func (s *LocalStore) Rank(ctx context.Context, gameMode, userID string) (LeaderboardEntry, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	board, ok := s.boards[gameMode]
+	if !ok {
+		return LeaderboardEntry{}, errPlayerNotFound
+	}
+
+	rank, ok := board.revRank(userID)
+	if !ok {
+		return LeaderboardEntry{}, errPlayerNotFound
+	}
+
+	return LeaderboardEntry{
+		UserID: userID,
+		Score:  board.scores[userID],
+		Rank:   int64(rank + 1),
+	}, nil
+}
+
+// sortedSet is a minimal in-memory counterpart of a redis sorted set. Members
+// are kept in the order of ZREVRANGE: highest score first, ties broken by
+// the lexicographically greater member.
+type sortedSet struct {
+	scores  map[string]float64
+	members []string
+}
+
+func newSortedSet() *sortedSet {
+	return &sortedSet{scores: make(map[string]float64)}
+}
+
+// before reports whether member a with score sa ranks ahead of b with sb.
+func before(a string, sa float64, b string, sb float64) bool {
+	if sa != sb {
+		return sa > sb
+	}
+	return a > b
+}
+
+// search returns the index at which member with score would be placed.
+func (z *sortedSet) search(member string, score float64) int {
+	return sort.Search(len(z.members), func(i int) bool {
+		other := z.members[i]
+		return !before(other, z.scores[other], member, score)
+	})
+}
+
+func (z *sortedSet) incrBy(member string, delta float64) {
+	score, exists := z.scores[member]
+	if exists {
+		i := z.search(member, score)
+		z.members = append(z.members[:i], z.members[i+1:]...)
+	}
+
+	score += delta
+	i := z.search(member, score)
+	z.members = append(z.members, "")
+	copy(z.members[i+1:], z.members[i:])
+	z.members[i] = member
+	z.scores[member] = score
+}
+
+func (z *sortedSet) revRank(member string) (int, bool) {
+	score, ok := z.scores[member]
+	if !ok {
+		return 0, false
+	}
+	return z.search(member, score), true
+}
+
+func (z *sortedSet) revRange(n int) []string {
+	if n > len(z.members) {
+		n = len(z.members)
+	}
+	return z.members[:n]
+}
@@ -4,59 +4,90 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"flag"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
 	"os/signal"
-	"strings"
 	"syscall"
 	"time"
 
-	"github.com/golang-jwt/jwt/v5"
 	"github.com/gorilla/mux"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/redis/go-redis/v9"
+	"shared/auth"
+	"shared/jwks"
+	"shared/matches"
+	"shared/ratings"
+	"shared/revocation"
 )
 
 const (
-	kafkaTopic          = "game-sessions"
-	kafkaGroupID        = "ranking-service"
 	redisLeaderboardKey = "leaderboard:%s"
 	topN                = 10
 )
 
-type GameSession struct {
-	ID        int       `json:"id"`
-	UserID    int       `json:"user_id"`
-	Score     int       `json:"score"`
-	GameMode  string    `json:"game_mode"`
-	Timestamp time.Time `json:"timestamp"`
-}
-
-type KafkaMessage struct {
-	EventType string      `json:"event_type"`
-	Session   GameSession `json:"session"`
-}
-
 var (
-	rdb       *redis.Client
-	jwtSecret = []byte("secret-test")
+	rdb   *redis.Client
+	store LeaderboardStore
+
+	// verifier authenticates players with the access tokens of users_service
+	verifier *auth.Verifier
 )
 
-func setupApplication() {
-	rdb = redis.NewClient(&redis.Options{
-		Addr:     "localhost:6379",
-		Password: "", // no password set
-		DB:       0,  // use default DB
-	})
+func setupApplication(ctx context.Context, storeType string) {
+	switch storeType {
+	case "redis":
+		rdb = redis.NewClient(&redis.Options{
+			Addr:     "localhost:6379",
+			Password: "", // no password set
+			DB:       0,  // use default DB
+		})
+		store = &RedisStore{client: rdb}
+	case "local":
+		localStore := NewLocalStore(localSessionsFile())
+		go localStore.Follow(ctx, 500*time.Millisecond)
+		store = localStore
+		log.Printf("revoked tokens are only rejected with the redis store")
+	default:
+		log.Fatalf("invalid store %q, must be 'redis' or 'local'", storeType)
+	}
+
+	jwksURL := os.Getenv("JWKS_URL")
+	if jwksURL == "" {
+		jwksURL = jwks.DefaultURL
+	}
+	var revoked auth.RevocationChecker
+	if rdb != nil {
+		revoked = revocation.NewStore(rdb)
+	}
+	verifier = auth.NewVerifier(jwks.NewClient(jwksURL).Keyfunc, revoked)
+	serviceTokens = newServiceTokenSource()
+	setUpInternalClient(serviceTokens.clientID)
 }
 
 type LeaderboardEntry struct {
-	UserName string  `json:"user_name"`
-	UserID   string  `json:"user_id"`
-	Score    float64 `json:"score"`
-	Rank     int64   `json:"rank"`
+	UserName    string  `json:"user_name"`
+	DisplayName string  `json:"display_name,omitempty"`
+	CountryCode string  `json:"country_code,omitempty"`
+	UserID      string  `json:"user_id"`
+	Score       float64 `json:"score"`
+	Rank        int64   `json:"rank"`
+}
+
+// UserInfo is what users_service tells about a player for leaderboards.
+type UserInfo struct {
+	UserName    string `json:"username"`
+	DisplayName string `json:"display_name"`
+	CountryCode string `json:"country_code"`
+}
+
+// setUser fills in the entry's player from their user info.
+func (e *LeaderboardEntry) setUser(info UserInfo) {
+	e.UserName = info.UserName
+	e.DisplayName = info.DisplayName
+	e.CountryCode = info.CountryCode
 }
 
 func corsMiddleware(next http.Handler) http.Handler {
@@ -77,36 +108,31 @@ func corsMiddleware(next http.Handler) http.Handler {
 }
 
 func getTopHandler(w http.ResponseWriter, r *http.Request) {
+	board, err := resolveBoard(r)
+	if err != nil {
+		writeBoardError(w, err)
+		return
+	}
 
-	//hardcoded mode for now can be extended to support other modes from query params.
-	leaderboardKey := getLeaderboardKey("classic")
-	result, err := rdb.ZRevRangeWithScores(r.Context(), leaderboardKey, 0, topN-1).Result()
+	entries, err := store.Top(r.Context(), board, topN)
 	if err != nil {
 		log.Printf("failed to get leaderboard: %v", err)
 		http.Error(w, "internal server error", http.StatusInternalServerError)
 		return
 	}
 
-	var entries []LeaderboardEntry
 	var userIds []string
-	for i, z := range result {
-		userIds = append(userIds, strings.TrimPrefix(z.Member.(string), "user:"))
-		entries = append(entries, LeaderboardEntry{
-			UserID: strings.TrimPrefix(z.Member.(string), "user:"),
-			Score:  z.Score,
-			Rank:   int64(i + 1),
-		})
+	for _, entry := range entries {
+		userIds = append(userIds, entry.UserID)
 	}
 
-	// Get user names from user service
-	userNames := getBatchUserInfo(userIds)
+	// Get user names and profiles from user service
+	users := getBatchUserInfo(userIds)
 
-	// Add user names to entries
+	// Add them to entries
 	for i := range entries {
-		log.Println("user id", entries[i].UserID)
-		if name, ok := userNames[entries[i].UserID]; ok {
-			log.Println("user name", name)
-			entries[i].UserName = name
+		if info, ok := users[entries[i].UserID]; ok {
+			entries[i].setUser(info)
 		}
 	}
 
@@ -118,96 +144,64 @@ func getUserRankHandler(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	userID := vars["userId"]
 
-	//Hard coded to classic for now can be extended in future to support other modes.
-	leaderboardKey := getLeaderboardKey("classic")
-	playerKey := getUserKey(userID)
+	board, err := resolveBoard(r)
+	if err != nil {
+		writeBoardError(w, err)
+		return
+	}
 
-	// Get user's score
-	score, err := rdb.ZScore(r.Context(), leaderboardKey, playerKey).Result()
-	if err == redis.Nil {
+	entry, err := store.Rank(r.Context(), board, userID)
+	if err == errPlayerNotFound {
 		http.Error(w, "user not found", http.StatusNotFound)
 		return
 	} else if err != nil {
-		log.Printf("failed to get user score: %v", err)
-		http.Error(w, "internal server error", http.StatusInternalServerError)
-		return
-	}
-
-	// Get user's rank
-	rank, err := rdb.ZRevRank(r.Context(), leaderboardKey, playerKey).Result()
-	if err != nil {
 		log.Printf("failed to get user rank: %v", err)
 		http.Error(w, "internal server error", http.StatusInternalServerError)
 		return
 	}
 
-	userNames := getBatchUserInfo([]string{userID})
+	users := getBatchUserInfo([]string{userID})
 
-	name := userNames[userID]
+	entry.setUser(users[userID])
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(LeaderboardEntry{
-		UserName: name,
-		UserID:   userID,
-		Score:    score,
-		Rank:     rank + 1,
-	})
+	json.NewEncoder(w).Encode(entry)
 }
 
-func authMiddleware(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		tokenString := r.Header.Get("Authorization")
-		if tokenString == "" {
-			http.Error(w, "Authorization header required", http.StatusUnauthorized)
-			return
-		}
-
-		// Remove 'Bearer ' prefix if present
-		tokenString = strings.TrimPrefix(tokenString, "Bearer ")
-
-		// Parse and validate the token
-		token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
-			// Validate signing method
-			if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-				return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
-			}
-			return jwtSecret, nil
-		})
-
-		if err != nil {
-			http.Error(w, "Invalid token", http.StatusUnauthorized)
-			return
-		}
-
-		if !token.Valid {
-			http.Error(w, "Invalid token", http.StatusUnauthorized)
-			return
-		}
-
-		// Extract claims and add to request context
-		if claims, ok := token.Claims.(jwt.MapClaims); ok {
-			// Add user ID to request context
-			userID := fmt.Sprintf("%v", claims["user_id"])
-			r = r.WithContext(context.WithValue(r.Context(), "user_id", userID))
-		}
+func main() {
 
-		next.ServeHTTP(w, r)
-	})
-}
+	storeType := flag.String("store", "redis", "leaderboard store (redis, or local to follow worker_service's local sink)")
+	flag.Parse()
 
-func main() {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
 
-	setupApplication()
+	setupApplication(ctx, *storeType)
 	// Setup HTTP routes
 	r := mux.NewRouter()
 	
 	r.Use(corsMiddleware)
 	
+	// Admin routes manage the redis leaderboards, so they are only served
+	// with the redis store. They are registered before the /v1 prefix below.
+	if rdb != nil {
+		registerAdminRoutes(r)
+	}
+
 	// Protected routes
 	protected := r.PathPrefix("/v1").Subrouter()
-	protected.Use(authMiddleware)
+	protected.Use(verifier.Middleware)
 	// No need to apply CORS again to protected routes
 	protected.HandleFunc("/leaderboard/top", getTopHandler).Methods("GET")
+	protected.HandleFunc("/leaderboard/recent", getRecentTopHandler).Methods("GET")
+	protected.HandleFunc("/leaderboard/wins", matchBoardHandler(matches.WinsBoard)).Methods("GET")
+	protected.HandleFunc("/leaderboard/winrate", matchBoardHandler(matches.WinRateBoard)).Methods("GET")
+	protected.HandleFunc("/leaderboard/rating", matchBoardHandler(ratings.Board)).Methods("GET")
 	protected.HandleFunc("/rank/{userId}", getUserRankHandler).Methods("GET")
+	protected.HandleFunc("/rank/{userId}/history", getRankHistoryHandler).Methods("GET")
+	protected.HandleFunc("/rank/{userId}/recent", getRecentRankHandler).Methods("GET")
+	protected.HandleFunc("/seasons", listSeasonsHandler).Methods("GET")
+	protected.HandleFunc("/stats/{userId}", getPlayerStatsHandler).Methods("GET")
+	protected.HandleFunc("/rating/{userId}", getPlayerRatingHandler).Methods("GET")
 
 	// Prometheus metrics endpoint
 	r.Handle("/metrics", promhttp.Handler())
@@ -241,16 +235,18 @@ func main() {
 	}
 }
 
-func getLeaderboardKey(gameMode string) string {
-	return "leaderboard:" + gameMode
+// getLeaderboardKey returns the key of a board, a game mode or one of its
+// season boards.
+func getLeaderboardKey(board string) string {
+	return "leaderboard:" + board
 }
 
 func getUserKey(userID string) string {
 	return fmt.Sprintf("user:%s", userID)
 }
 
-func getBatchUserInfo(userIDs []string) map[string]string {
-	userIDMap := make(map[string]string)
+func getBatchUserInfo(userIDs []string) map[string]UserInfo {
+	userIDMap := make(map[string]UserInfo)
 
 	// Prepare request body
 	body, err := json.Marshal(userIDs)
@@ -259,22 +255,39 @@ func getBatchUserInfo(userIDs []string) map[string]string {
 		return userIDMap
 	}
 
+	token, err := serviceTokens.Token(context.Background())
+	if err != nil {
+		log.Printf("Error getting service token: %v", err)
+		return userIDMap
+	}
+
 	// Make request to user service
-	resp, err := http.Post("http://localhost:8084/v1/UserInfo", "application/json", bytes.NewBuffer(body))
+	req, err := http.NewRequest(http.MethodPost, usersInternalURL+"/v1/UserInfo", bytes.NewBuffer(body))
+	if err != nil {
+		log.Printf("Error creating user service request: %v", err)
+		return userIDMap
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	resp, err := usersClient.Do(req)
 	if err != nil {
 		log.Printf("Error calling user service: %v", err)
 		return userIDMap
 	}
 	defer resp.Body.Close()
 
+	if resp.StatusCode == http.StatusUnauthorized {
+		serviceTokens.Invalidate()
+	}
 	if resp.StatusCode != http.StatusOK {
 		log.Printf("User service returned non-200 status: %d", resp.StatusCode)
 		return userIDMap
 	}
 
 	var users []struct {
-		ID       int    `json:"id"`
-		Username string `json:"username"`
+		ID int `json:"id"`
+		UserInfo
 	}
 
 	if err := json.NewDecoder(resp.Body).Decode(&users); err != nil {
@@ -282,11 +295,9 @@ func getBatchUserInfo(userIDs []string) map[string]string {
 		return userIDMap
 	}
 
-	log.Println("recieved users", users)
-
-	// Build map of user ID to username
+	// Build map of user ID to user info
 	for _, user := range users {
-		userIDMap[fmt.Sprintf("%d", user.ID)] = user.Username
+		userIDMap[fmt.Sprintf("%d", user.ID)] = user.UserInfo
 	}
 
 	return userIDMap
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"log"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/redis/go-redis/v9"
+	"shared/matches"
+)
+
+// PlayerStats is a player's match results in a mode. WinRateRank is only set
+// once they have played MinGames games.
+type PlayerStats struct {
+	UserID   string `json:"user_id"`
+	UserName string `json:"user_name"`
+	GameMode string `json:"game_mode"`
+	matches.Stats
+	WinRate     float64 `json:"win_rate"`
+	MinGames    int64   `json:"min_games"`
+	WinRateRank int64   `json:"win_rate_rank,omitempty"`
+}
+
+// matchBoardHandler returns the handler serving the top of the match board
+// of the mode query parameter that board returns.
+func matchBoardHandler(board func(gameMode string) string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if rdb == nil {
+			http.Error(w, "match leaderboards require the redis store", http.StatusBadRequest)
+			return
+		}
+
+		entries, err := store.Top(r.Context(), board(gameModeParam(r)), topN)
+		if err != nil {
+			log.Printf("failed to get match leaderboard: %v", err)
+			http.Error(w, "internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		var userIds []string
+		for _, entry := range entries {
+			userIds = append(userIds, entry.UserID)
+		}
+		users := getBatchUserInfo(userIds)
+
+		for i := range entries {
+			entries[i].setUser(users[entries[i].UserID])
+		}
+
+		writeJSON(w, http.StatusOK, entries)
+	}
+}
+
+func getPlayerStatsHandler(w http.ResponseWriter, r *http.Request) {
+	userID := mux.Vars(r)["userId"]
+	gameMode := gameModeParam(r)
+
+	if rdb == nil {
+		http.Error(w, "match statistics require the redis store", http.StatusBadRequest)
+		return
+	}
+
+	fields, err := rdb.HGetAll(r.Context(), matches.StatsKey(gameMode, userID)).Result()
+	if err != nil {
+		log.Printf("failed to get player stats: %v", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	if len(fields) == 0 {
+		http.Error(w, "user not found", http.StatusNotFound)
+		return
+	}
+
+	minGames, err := rdb.HGet(r.Context(), matches.ConfigKey, "min_games").Result()
+	if err != nil && err != redis.Nil {
+		log.Printf("failed to get min games: %v", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	stats := PlayerStats{
+		UserID:   userID,
+		GameMode: gameMode,
+		Stats:    matches.ParseStats(fields),
+		MinGames: matches.ParseMinGames(minGames),
+	}
+	stats.WinRate = stats.Stats.WinRate()
+
+	entry, err := store.Rank(r.Context(), matches.WinRateBoard(gameMode), userID)
+	if err == nil {
+		stats.WinRateRank = entry.Rank
+	} else if err != errPlayerNotFound {
+		log.Printf("failed to get win rate rank: %v", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	stats.UserName = getBatchUserInfo([]string{userID})[userID].UserName
+	writeJSON(w, http.StatusOK, stats)
+}
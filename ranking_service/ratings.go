@@ -0,0 +1,63 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"shared/ratings"
+)
+
+// PlayerRating is a player's skill rating in a mode. The deviation is grown
+// for the rating periods since their last match.
+type PlayerRating struct {
+	UserID   string `json:"user_id"`
+	UserName string `json:"user_name"`
+	GameMode string `json:"game_mode"`
+	ratings.Rating
+	Rank int64 `json:"rank,omitempty"`
+}
+
+// getPlayerRatingHandler returns a player's Glicko-2 rating. Ratings only
+// live in redis and cannot be rebuilt from the session store, so they are
+// lost if redis is.
+func getPlayerRatingHandler(w http.ResponseWriter, r *http.Request) {
+	userID := mux.Vars(r)["userId"]
+	gameMode := gameModeParam(r)
+
+	if rdb == nil {
+		http.Error(w, "ratings require the redis store", http.StatusBadRequest)
+		return
+	}
+
+	fields, err := rdb.HGetAll(r.Context(), ratings.Key(gameMode, userID)).Result()
+	if err != nil {
+		log.Printf("failed to get player rating: %v", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	rating, ok := ratings.Parse(fields)
+	if !ok {
+		http.Error(w, "user not found", http.StatusNotFound)
+		return
+	}
+
+	player := PlayerRating{
+		UserID:   userID,
+		GameMode: gameMode,
+		Rating:   rating.At(time.Now()),
+	}
+
+	entry, err := store.Rank(r.Context(), ratings.Board(gameMode), userID)
+	if err == nil {
+		player.Rank = entry.Rank
+	} else if err != errPlayerNotFound {
+		log.Printf("failed to get rating rank: %v", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	player.UserName = getBatchUserInfo([]string{userID})[userID].UserName
+	writeJSON(w, http.StatusOK, player)
+}
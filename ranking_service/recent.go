@@ -0,0 +1,92 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"shared/recent"
+)
+
+// loadRecentConfig returns the weighting of the recent boards, writing an
+// error response if it is not available.
+func loadRecentConfig(w http.ResponseWriter, r *http.Request) (recent.Config, bool) {
+	if rdb == nil {
+		http.Error(w, "recent leaderboards require the redis store", http.StatusBadRequest)
+		return recent.Config{}, false
+	}
+
+	fields, err := rdb.HGetAll(r.Context(), recent.ConfigKey).Result()
+	if err != nil {
+		log.Printf("failed to load recent leaderboard config: %v", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return recent.Config{}, false
+	}
+
+	config, err := recent.Parse(fields)
+	if err == recent.ErrNotConfigured {
+		http.Error(w, "recent leaderboards are not configured", http.StatusNotFound)
+		return recent.Config{}, false
+	} else if err != nil {
+		log.Printf("invalid recent leaderboard config: %v", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return recent.Config{}, false
+	}
+
+	return config, true
+}
+
+// getRecentTopHandler returns the top of the recency-weighted board of a
+// mode, with every score decayed to the current time.
+func getRecentTopHandler(w http.ResponseWriter, r *http.Request) {
+	config, ok := loadRecentConfig(w, r)
+	if !ok {
+		return
+	}
+
+	entries, err := store.Top(r.Context(), recent.Board(gameModeParam(r)), topN)
+	if err != nil {
+		log.Printf("failed to get recent leaderboard: %v", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	var userIds []string
+	for _, entry := range entries {
+		userIds = append(userIds, entry.UserID)
+	}
+	users := getBatchUserInfo(userIds)
+
+	now := time.Now()
+	for i := range entries {
+		entries[i].Score = config.Decayed(entries[i].Score, now)
+		entries[i].setUser(users[entries[i].UserID])
+	}
+
+	writeJSON(w, http.StatusOK, entries)
+}
+
+func getRecentRankHandler(w http.ResponseWriter, r *http.Request) {
+	userID := mux.Vars(r)["userId"]
+
+	config, ok := loadRecentConfig(w, r)
+	if !ok {
+		return
+	}
+
+	entry, err := store.Rank(r.Context(), recent.Board(gameModeParam(r)), userID)
+	if err == errPlayerNotFound {
+		http.Error(w, "user not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Printf("failed to get recent user rank: %v", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	entry.Score = config.Decayed(entry.Score, time.Now())
+	entry.setUser(getBatchUserInfo([]string{userID})[userID])
+
+	writeJSON(w, http.StatusOK, entry)
+}
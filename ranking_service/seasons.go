@@ -0,0 +1,198 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/redis/go-redis/v9"
+	"shared/seasons"
+)
+
+const (
+	defaultGameMode = "classic"
+	// allTimeSeason selects the board of all sessions of a mode.
+	allTimeSeason = "all"
+)
+
+var (
+	errSeasonNotFound = errors.New("season not found")
+	errSeasonsStore   = errors.New("seasons require the redis store")
+)
+
+type seasonRequest struct {
+	Start  time.Time `json:"start"`
+	End    time.Time `json:"end"`
+	Modes  []string  `json:"modes"`
+	Reason string    `json:"reason"`
+}
+
+func loadSeasons(ctx context.Context) ([]seasons.Season, error) {
+	fields, err := rdb.HGetAll(ctx, seasons.Key).Result()
+	if err != nil {
+		return nil, err
+	}
+	return seasons.Parse(fields)
+}
+
+// gameModeParam returns the mode query parameter, classic by default.
+func gameModeParam(r *http.Request) string {
+	if gameMode := r.URL.Query().Get("mode"); gameMode != "" {
+		return gameMode
+	}
+	return defaultGameMode
+}
+
+// resolveBoard returns the board a leaderboard request reads from the mode
+// and season query parameters. Without a season the current season of the
+// mode is used, or the all-time board when no season is running.
+func resolveBoard(r *http.Request) (string, error) {
+	gameMode := gameModeParam(r)
+
+	seasonID := r.URL.Query().Get("season")
+	if seasonID == allTimeSeason {
+		return gameMode, nil
+	}
+
+	// The local store only has the all-time boards.
+	if rdb == nil {
+		if seasonID != "" {
+			return "", errSeasonsStore
+		}
+		return gameMode, nil
+	}
+
+	return seasonBoard(r.Context(), gameMode, seasonID)
+}
+
+// seasonBoard returns the board of gameMode for seasonID: the current season
+// when empty, or the all-time board when no season is running.
+func seasonBoard(ctx context.Context, gameMode, seasonID string) (string, error) {
+	if seasonID == allTimeSeason {
+		return gameMode, nil
+	}
+
+	list, err := loadSeasons(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	if seasonID == "" {
+		if season, ok := seasons.Current(list, gameMode, time.Now()); ok {
+			return seasons.Board(gameMode, season.ID), nil
+		}
+		return gameMode, nil
+	}
+
+	for _, season := range list {
+		if season.ID == seasonID && season.HasMode(gameMode) {
+			return seasons.Board(gameMode, season.ID), nil
+		}
+	}
+	return "", errSeasonNotFound
+}
+
+// writeBoardError writes the response for an error from resolveBoard.
+func writeBoardError(w http.ResponseWriter, err error) {
+	switch err {
+	case errSeasonNotFound:
+		http.Error(w, "season not found", http.StatusNotFound)
+	case errSeasonsStore:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	default:
+		log.Printf("failed to resolve leaderboard: %v", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+	}
+}
+
+func listSeasonsHandler(w http.ResponseWriter, r *http.Request) {
+	if rdb == nil {
+		writeJSON(w, http.StatusOK, []seasons.Season{})
+		return
+	}
+
+	list, err := loadSeasons(r.Context())
+	if err != nil {
+		log.Printf("failed to load seasons: %v", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, list)
+}
+
+// putSeasonHandler creates or updates a season. Seasons of the same mode may
+// not overlap and archived seasons can no longer be changed.
+func putSeasonHandler(w http.ResponseWriter, r *http.Request) {
+	var req seasonRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid request format", http.StatusBadRequest)
+		return
+	}
+
+	if req.Reason == "" {
+		http.Error(w, "reason is required", http.StatusBadRequest)
+		return
+	}
+
+	season := seasons.Season{
+		ID:    mux.Vars(r)["seasonId"],
+		Start: req.Start.UTC(),
+		End:   req.End.UTC(),
+		Modes: req.Modes,
+	}
+	if err := season.Validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	list, err := loadSeasons(r.Context())
+	if err != nil {
+		log.Printf("failed to load seasons: %v", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	action := "create_season"
+	for _, other := range list {
+		if other.ID == season.ID {
+			if other.ArchivedAt != nil {
+				http.Error(w, "season is archived", http.StatusConflict)
+				return
+			}
+			action = "update_season"
+			continue
+		}
+		if season.Overlaps(other) {
+			http.Error(w, "season overlaps season "+other.ID, http.StatusConflict)
+			return
+		}
+	}
+
+	data, err := json.Marshal(season)
+	if err != nil {
+		log.Printf("failed to marshal season: %v", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	err = audited(r, AuditEntry{
+		Action:  action,
+		Reason:  req.Reason,
+		Details: map[string]interface{}{"season": season},
+	}, func(pipe redis.Pipeliner) error {
+		pipe.HSet(r.Context(), seasons.Key, season.ID, data)
+		return nil
+	})
+	if err != nil {
+		log.Printf("failed to store season: %v", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, season)
+}
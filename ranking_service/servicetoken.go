@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Local defaults matching users_service's default SERVICE_CLIENTS. The
+// secret is public, so it is only used when DEV_SERVICE_CREDENTIALS is set.
+const (
+	defaultServiceClientID     = "ranking_service"
+	defaultServiceClientSecret = "ranking-service-secret"
+)
+
+// serviceTokenSource gets the access token ranking_service calls the
+// internal API of users_service with, using its client credentials, and
+// reuses it until shortly before it expires.
+type serviceTokenSource struct {
+	url          string
+	clientID     string
+	clientSecret string
+	httpClient   *http.Client
+
+	mu        sync.Mutex
+	token     string
+	expiresAt time.Time
+}
+
+var serviceTokens *serviceTokenSource
+
+func newServiceTokenSource() *serviceTokenSource {
+	clientID := os.Getenv("SERVICE_CLIENT_ID")
+	if clientID == "" {
+		clientID = defaultServiceClientID
+	}
+	clientSecret := os.Getenv("SERVICE_CLIENT_SECRET")
+	if clientSecret == "" {
+		devCredentials, _ := strconv.ParseBool(os.Getenv("DEV_SERVICE_CREDENTIALS"))
+		if !devCredentials {
+			log.Fatal("SERVICE_CLIENT_SECRET is not set; set it, or DEV_SERVICE_CREDENTIALS=true to use the local development pair")
+		}
+		log.Println("WARNING: using the local development service credentials")
+		clientSecret = defaultServiceClientSecret
+	}
+
+	return &serviceTokenSource{
+		url:          "http://localhost:8084/v1/token/service",
+		clientID:     clientID,
+		clientSecret: clientSecret,
+		httpClient:   &http.Client{Timeout: 5 * time.Second},
+	}
+}
+
+// Token returns a valid service token.
+func (s *serviceTokenSource) Token(ctx context.Context) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.token != "" && time.Until(s.expiresAt) > time.Minute {
+		return s.token, nil
+	}
+
+	body, err := json.Marshal(map[string]string{
+		"client_id":     s.clientID,
+		"client_secret": s.clientSecret,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url, bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := s.httpClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("service token request returned status %d", resp.StatusCode)
+	}
+
+	var token struct {
+		Token     string `json:"token"`
+		ExpiresIn int64  `json:"expires_in"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return "", err
+	}
+
+	s.token = token.Token
+	s.expiresAt = time.Now().Add(time.Duration(token.ExpiresIn) * time.Second)
+	return s.token, nil
+}
+
+// Invalidate drops the cached token after users_service rejected it.
+func (s *serviceTokenSource) Invalidate() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.token = ""
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// errPlayerNotFound is returned when a player has no entry on a leaderboard.
+var errPlayerNotFound = errors.New("player not found")
+
+// LeaderboardStore reads the leaderboards maintained by worker_service. A
+// board is a game mode or one of its season boards, see seasons.Board.
+// Returned entries carry the user ID, score and rank but no user name.
+type LeaderboardStore interface {
+	Top(ctx context.Context, board string, n int64) ([]LeaderboardEntry, error)
+	Rank(ctx context.Context, board, userID string) (LeaderboardEntry, error)
+}
+
+// RedisStore reads the leaderboard sorted sets written by the redis sink.
+type RedisStore struct {
+	client *redis.Client
+}
+
+func (s *RedisStore) Top(ctx context.Context, board string, n int64) ([]LeaderboardEntry, error) {
+	result, err := s.client.ZRevRangeWithScores(ctx, getLeaderboardKey(board), 0, n-1).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []LeaderboardEntry
+	for i, z := range result {
+		entries = append(entries, LeaderboardEntry{
+			UserID: strings.TrimPrefix(z.Member.(string), "user:"),
+			Score:  z.Score,
+			Rank:   int64(i + 1),
+		})
+	}
+
+	return entries, nil
+}
+
+func (s *RedisStore) Rank(ctx context.Context, board, userID string) (LeaderboardEntry, error) {
+	leaderboardKey := getLeaderboardKey(board)
+	playerKey := getUserKey(userID)
+
+	// Get user's score
+	score, err := s.client.ZScore(ctx, leaderboardKey, playerKey).Result()
+	if err == redis.Nil {
+		return LeaderboardEntry{}, errPlayerNotFound
+	} else if err != nil {
+		return LeaderboardEntry{}, err
+	}
+
+	// Get user's rank
+	rank, err := s.client.ZRevRank(ctx, leaderboardKey, playerKey).Result()
+	if err == redis.Nil {
+		return LeaderboardEntry{}, errPlayerNotFound
+	} else if err != nil {
+		return LeaderboardEntry{}, err
+	}
+
+	return LeaderboardEntry{
+		UserID: userID,
+		Score:  score,
+		Rank:   rank + 1,
+	}, nil
+}
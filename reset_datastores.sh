@@ -13,6 +13,10 @@ EXIT;# Connect to Redis CLI
 
 redis-cli
 
+# A single leaderboard is better reset through the ranking service admin API,
+# which snapshots it first and records the reset in the audit log:
+# curl -X POST http://localhost:8086/v1/admin/leaderboards/classic/reset -H "Authorization: Bearer $ADMIN_TOKEN" -d '{"reason": "..."}'
+
 # Clear all keys in the current database
 FLUSHDB
 
@@ -25,6 +29,9 @@ KEYS leaderboard:*
 # Exit Redis CLI
 exit
 
+# Leaderboards can be rebuilt from the sessions stored in Cassandra
+cd worker_service && ./worker_service rebuild
+
 #Delete and recreate the topic
 kafka-topics.sh --bootstrap-server localhost:9092 --delete --topic game-sessions
 
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+
+	"scoreservice/models"
+	"shared/auth"
+	"shared/events"
+	"shared/messaging"
+
+	"github.com/gocql/gocql"
+	"github.com/gorilla/mux"
+)
+
+// publishEvent publishes a moderation event synchronously so that the admin
+// learns about failures, unlike scores which are queued. Events are keyed by
+// user so they stay ordered after that user's sessions.
+func publishEvent(ctx context.Context, userID string, event events.Envelope) error {
+	data, err := events.Marshal(event, eventContentType)
+	if err != nil {
+		return err
+	}
+
+	publishCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	return publisher.Publish(publishCtx, messaging.Message{
+		Key:     []byte(userID),
+		Value:   data,
+		Headers: map[string]string{events.ContentTypeHeader: eventContentType},
+	})
+}
+
+func writeEventAccepted(w http.ResponseWriter, event events.Envelope) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]string{
+		"event_id":   event.EventID,
+		"event_type": event.EventType,
+	})
+}
+
+// voidScoreHandler voids a stored session. The event is built from the
+// session cassandra holds, so that the score subtracted is the one that was
+// added.
+func voidScoreHandler(w http.ResponseWriter, r *http.Request) {
+	sessionID, err := gocql.ParseUUID(mux.Vars(r)["sessionId"])
+	if err != nil {
+		http.Error(w, "Invalid session ID", http.StatusBadRequest)
+		return
+	}
+
+	var req models.VoidScoreRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request format", http.StatusBadRequest)
+		return
+	}
+
+	if err := req.Validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	session, err := sessions.get(r.Context(), sessionID)
+	if err == errSessionNotFound {
+		http.Error(w, "Session not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Printf("Error looking up session %v: %v", sessionID, err)
+		http.Error(w, "Session store unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	if session.Voided {
+		http.Error(w, "Session already voided", http.StatusConflict)
+		return
+	}
+
+	event, err := events.NewEnvelope(events.TypeScoreVoided, producerName, events.ScoreVoided{
+		SessionID: sessionID,
+		UserID:    session.UserID,
+		GameMode:  session.GameMode,
+		Score:     session.Score,
+		Reason:    req.Reason,
+		Result:    session.Result,
+	})
+	if err != nil {
+		log.Printf("Error creating event: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	if err := publishEvent(r.Context(), session.UserID, event); err != nil {
+		log.Printf("Error publishing score_voided for session %v: %v", sessionID, err)
+		kafkaWriteErrors.Inc()
+		http.Error(w, "Failed to publish event", http.StatusBadGateway)
+		return
+	}
+
+	claims, _ := auth.FromContext(r.Context())
+	log.Printf("Session %v of user %s voided by %s: %s", sessionID, session.UserID, claims.Username, req.Reason)
+	writeEventAccepted(w, event)
+}
+
+// banHandler returns the handler publishing eventType, user_banned or
+// user_unbanned, for the user in the path.
+func banHandler(eventType string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID := mux.Vars(r)["userId"]
+
+		var req models.BanRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request format", http.StatusBadRequest)
+			return
+		}
+
+		if err := req.Validate(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		event, err := events.NewEnvelope(eventType, producerName, events.UserBan{
+			UserID: userID,
+			Reason: req.Reason,
+		})
+		if err != nil {
+			log.Printf("Error creating event: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		if err := publishEvent(r.Context(), userID, event); err != nil {
+			log.Printf("Error publishing %s for user %s: %v", eventType, userID, err)
+			kafkaWriteErrors.Inc()
+			http.Error(w, "Failed to publish event", http.StatusBadGateway)
+			return
+		}
+
+		claims, _ := auth.FromContext(r.Context())
+		log.Printf("%s for user %s by %s: %s", eventType, userID, claims.Username, req.Reason)
+		writeEventAccepted(w, event)
+	}
+}
@@ -13,29 +13,43 @@ import (
 	"scoreservice/middleware"
 
 	"scoreservice/models"
+	"shared/auth"
+	"shared/events"
+	"shared/jwks"
+	"shared/messaging"
+	"shared/revocation"
 
 	"github.com/gocql/gocql"
-	"github.com/golang-jwt/jwt/v5"
 	"github.com/gorilla/mux"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
-	"github.com/segmentio/kafka-go"
+	"github.com/redis/go-redis/v9"
 )
 
 const (
 	MaxRequestSize = 1024
+
+	// producerName identifies this service in published event envelopes.
+	producerName = "score_service"
 )
 
 // KafkaMessage represents a message to be sent to Kafka
 type KafkaMessage struct {
-	Key   []byte
-	Value []byte
+	Key         []byte
+	Value       []byte
+	ContentType string
 }
 
 var (
-	jwtSecret   = []byte("secret-test")
-	kafkaWriter *kafka.Writer
+	publisher messaging.Publisher
+
+	// verifier authenticates players with the access tokens of users_service
+	verifier *auth.Verifier
+
+	// eventContentType is the encoding of published events, taken from the
+	// EVENT_ENCODING environment variable (json or protobuf).
+	eventContentType = events.ContentTypeJSON
 
 	// Channel for sending messages to Kafka
 	kafkaMessageChan chan KafkaMessage
@@ -104,9 +118,10 @@ func startKafkaWorker(ctx context.Context) {
 					// Create a timeout context for this specific write
 					writeCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
 
-					writeErr = kafkaWriter.WriteMessages(writeCtx, kafka.Message{
-						Key:   msg.Key,
-						Value: msg.Value,
+					writeErr = publisher.Publish(writeCtx, messaging.Message{
+						Key:     msg.Key,
+						Value:   msg.Value,
+						Headers: map[string]string{events.ContentTypeHeader: msg.ContentType},
 					})
 
 					cancel() // Always cancel the context to release resources
@@ -134,13 +149,36 @@ func setUpApplication() {
 	// Initialize Kafka message channel with buffer
 	kafkaMessageChan = make(chan KafkaMessage, 100)
 
-	// Initialize Kafka writer
-	kafkaWriter = kafka.NewWriter(kafka.WriterConfig{
-		Brokers: []string{"localhost:9092"},
-		Topic:   "game-sessions",
-	})
+	// Initialize the game-sessions publisher on the configured transport
+	transport, err := messaging.FromEnv([]string{"localhost:9092"})
+	if err != nil {
+		log.Fatal(err)
+	}
+	publisher = transport.Publisher("game-sessions")
+
+	switch encoding := os.Getenv("EVENT_ENCODING"); encoding {
+	case "", "json":
+		eventContentType = events.ContentTypeJSON
+	case "protobuf":
+		eventContentType = events.ContentTypeProtobuf
+	default:
+		log.Fatalf("invalid EVENT_ENCODING %q, must be 'json' or 'protobuf'", encoding)
+	}
 
 	nonceStore = middleware.NewNonceStore(15 * time.Minute)
+
+	jwksURL := os.Getenv("JWKS_URL")
+	if jwksURL == "" {
+		jwksURL = jwks.DefaultURL
+	}
+
+	// Tokens revoked by users_service are recorded in redis
+	rdb := redis.NewClient(&redis.Options{
+		Addr:     "localhost:6379",
+		Password: "", // no password set
+		DB:       0,  // use default DB
+	})
+	verifier = auth.NewVerifier(jwks.NewClient(jwksURL).Keyfunc, revocation.NewStore(rdb))
 }
 
 func prometheusMiddleware(next http.Handler) http.Handler {
@@ -163,7 +201,8 @@ func prometheusMiddleware(next http.Handler) http.Handler {
 
 func main() {
 	setUpApplication()
-	defer kafkaWriter.Close()
+	defer publisher.Close()
+	defer sessions.Close()
 
 	// Create a context that will be canceled when the application shuts down
 	ctx, cancel := context.WithCancel(context.Background())
@@ -179,16 +218,31 @@ func main() {
 	apiRouter := mux.NewRouter()
 	apiRouter.Use(prometheusMiddleware)
 	apiRouter.Use(corsMiddleware)
-	apiRouter.Use(authMiddleware)
+	apiRouter.Use(verifier.Middleware)
+	apiRouter.Use(auth.RequireRole(auth.RolePlayer, auth.RoleGameServer))
 	apiRouter.Use(rateLimiter.RateLimitMiddleware)
 	apiRouter.Use(nonceStore.IdempotencyMiddleware)
 
 	apiRouter.Use(securityHeadersMiddleware)
 	apiRouter.HandleFunc("/v1/score", createScoreHandler).Methods("POST")
 
+	// Moderation endpoints are for moderators and admins, and are not rate
+	// limited.
+	adminRouter := mux.NewRouter()
+	adminRouter.Use(prometheusMiddleware)
+	adminRouter.Use(corsMiddleware)
+	adminRouter.Use(verifier.Middleware)
+	adminRouter.Use(auth.RequireRole(auth.RoleModerator, auth.RoleAdmin))
+	adminRouter.Use(securityHeadersMiddleware)
+	adminRouter.HandleFunc("/v1/admin/sessions/{sessionId}/void", voidScoreHandler).Methods("POST")
+	adminRouter.HandleFunc("/v1/admin/users/{userId}/ban", banHandler(events.TypeUserBanned)).Methods("POST")
+	adminRouter.HandleFunc("/v1/admin/users/{userId}/unban", banHandler(events.TypeUserUnbanned)).Methods("POST")
+
 	mainHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		if r.URL.Path == "/metrics" {
 			metricsRouter.ServeHTTP(w, r)
+		} else if strings.HasPrefix(r.URL.Path, "/v1/admin/") {
+			adminRouter.ServeHTTP(w, r)
 		} else {
 			apiRouter.ServeHTTP(w, r)
 		}
@@ -203,48 +257,6 @@ func main() {
 	log.Fatal(http.ListenAndServe(":"+port, mainHandler))
 }
 
-func authMiddleware(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		authHeader := r.Header.Get("Authorization")
-		if authHeader == "" {
-			http.Error(w, "Authorization header required", http.StatusUnauthorized)
-			return
-		}
-
-		tokenString := strings.TrimPrefix(authHeader, "Bearer ")
-		token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
-			return jwtSecret, nil
-		})
-
-		if err != nil || !token.Valid {
-			http.Error(w, "Invalid token", http.StatusUnauthorized)
-			return
-		}
-
-		claims, ok := token.Claims.(jwt.MapClaims)
-		if !ok {
-			http.Error(w, "Invalid token claims", http.StatusUnauthorized)
-			return
-		}
-
-		userIDValue, exists := claims["user_id"]
-		if !exists {
-			http.Error(w, "User ID missing in token", http.StatusUnauthorized)
-			return
-		}
-
-		userIDFloat, ok := userIDValue.(float64)
-		if !ok {
-			http.Error(w, "Invalid user ID format", http.StatusUnauthorized)
-			return
-		}
-
-		userID := int(userIDFloat)
-		ctx := context.WithValue(r.Context(), "user_id", userID)
-		next.ServeHTTP(w, r.WithContext(ctx))
-	})
-}
-
 // to-do need to read more about these headers
 func securityHeadersMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -275,8 +287,7 @@ func corsMiddleware(next http.Handler) http.Handler {
 }
 
 func createScoreHandler(w http.ResponseWriter, r *http.Request) {
-	// Extract user ID from JWT token
-	userID := r.Context().Value("user_id").(int)
+	claims, _ := auth.FromContext(r.Context())
 
 	// Decode the request body
 	var session models.GameSession
@@ -286,24 +297,40 @@ func createScoreHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Players submit their own sessions, game servers those of any player
+	// named in the body. Match results are only taken from game servers, so
+	// that players cannot rate themselves up with wins they report.
+	if !claims.HasRole(auth.RoleGameServer) {
+		if session.Result != "" || len(session.Opponents) > 0 || session.MatchID != "" {
+			auth.Forbidden(w, "only game servers may submit match results")
+			return
+		}
+		session.UserID = claims.UserIDString()
+	} else if session.UserID == "" {
+		http.Error(w, "user_id is required", http.StatusBadRequest)
+		return
+	}
+
 	err = session.ValidateSession()
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	session.UserID = fmt.Sprintf("%d", userID)
 	session.SessionID = gocql.TimeUUID()
 	session.Timestamp = session.SessionID.Time()
 
 	// Increment game mode counter
 	gameModeCounter.WithLabelValues(session.GameMode).Inc()
 
-	sessionJSON, err := json.Marshal(map[string]interface{}{
-		"event_type": "game_score_recorded",
-		"session":    session,
-	})
+	event, err := events.NewGameScoreRecorded(producerName, session.GameSession)
+	if err != nil {
+		log.Printf("Error creating event: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
 
+	sessionData, err := events.Marshal(event, eventContentType)
 	if err != nil {
 		log.Printf("Error marshaling session: %v", err)
 		http.Error(w, "Internal server error", http.StatusInternalServerError)
@@ -314,8 +341,9 @@ func createScoreHandler(w http.ResponseWriter, r *http.Request) {
 	// This won't block the HTTP handler
 	select {
 	case kafkaMessageChan <- KafkaMessage{
-		Key:   []byte(session.UserID),
-		Value: sessionJSON,
+		Key:         []byte(session.UserID),
+		Value:       sessionData,
+		ContentType: eventContentType,
 	}:
 		// Message successfully queued
 		log.Printf("Message for user %s queued for Kafka processing", session.UserID)
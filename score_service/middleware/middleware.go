@@ -1,8 +1,8 @@
 package middleware
 
 import (
-	"log"
 	"net/http"
+	"shared/auth"
 	"sync"
 	"time"
 
@@ -36,14 +36,21 @@ func (rl *RateLimiter) getLimiter(userID int) *rate.Limiter {
 
 func (rl *RateLimiter) RateLimitMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		userID, ok := r.Context().Value("user_id").(int)
+		claims, ok := auth.FromContext(r.Context())
 		if !ok {
-			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			auth.Unauthorized(w, "authentication required")
 			return
 		}
 
+		// Game servers submit the sessions of many players
+		if claims.HasRole(auth.RoleGameServer) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		userID := claims.UserID
+
 		limiter := rl.getLimiter(userID)
-		log.Printf("Number of  tokens: %f for user %d ", limiter.Tokens(), userID)
 		if !limiter.Allow() {
 			http.Error(w, "Rate limit exceeded", http.StatusTooManyRequests)
 			return
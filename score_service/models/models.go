@@ -3,23 +3,21 @@ package models
 import (
 	"errors"
 	"regexp"
+	"shared/events"
 	"time"
-
-	"github.com/gocql/gocql"
 )
 
 const (
 	MaxScore        = 500
 	MinScore        = 0
 	ScoreExpiration = 5 * time.Minute
+	MaxOpponents    = 16
 )
 
+// GameSession is a submitted session, the payload of the
+// game_score_recorded event.
 type GameSession struct {
-	SessionID gocql.UUID `json:"session_id"`
-	UserID    string     `json:"user_id"`
-	Score     int        `json:"score"`
-	GameMode  string     `json:"game_mode"`
-	Timestamp time.Time  `json:"timestamp"`
+	events.GameSession
 }
 
 func (s *GameSession) ValidateSession() error {
@@ -31,5 +29,58 @@ func (s *GameSession) ValidateSession() error {
 		return errors.New("invalid game mode format")
 	}
 
+	if !events.ValidResult(s.Result) {
+		return errors.New("invalid result, must be win, loss or draw")
+	}
+
+	if len(s.Opponents) > 0 && s.Result == "" {
+		return errors.New("opponents require a result")
+	}
+
+	if len(s.Opponents) > MaxOpponents {
+		return errors.New("too many opponents")
+	}
+
+	for _, opponent := range s.Opponents {
+		if opponent == "" || opponent == s.UserID {
+			return errors.New("invalid opponent")
+		}
+	}
+
+	if s.MatchID != "" {
+		if s.Result == "" {
+			return errors.New("match_id requires a result")
+		}
+		if !regexp.MustCompile(`^[a-zA-Z0-9_-]{1,64}$`).MatchString(s.MatchID) {
+			return errors.New("invalid match_id format")
+		}
+	}
+
+	return nil
+}
+
+// VoidScoreRequest is the body of the admin endpoint voiding a session. The
+// session itself is looked up by its ID.
+type VoidScoreRequest struct {
+	Reason string `json:"reason"`
+}
+
+func (v *VoidScoreRequest) Validate() error {
+	if v.Reason == "" {
+		return errors.New("reason is required")
+	}
+
+	return nil
+}
+
+// BanRequest is the body of the admin endpoints banning and unbanning a user.
+type BanRequest struct {
+	Reason string `json:"reason"`
+}
+
+func (b *BanRequest) Validate() error {
+	if b.Reason == "" {
+		return errors.New("reason is required")
+	}
 	return nil
 }
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"github.com/gocql/gocql"
+	"shared/events"
+)
+
+var errSessionNotFound = errors.New("session not found")
+
+// storedSession is a session as the worker stored it in cassandra.
+type storedSession struct {
+	events.GameSession
+	Voided bool
+}
+
+// sessionStore looks up stored sessions for the moderation endpoints. It
+// connects to cassandra on first use, so that scores can be submitted while
+// cassandra is down.
+type sessionStore struct {
+	mu      sync.Mutex
+	session *gocql.Session
+}
+
+var sessions = &sessionStore{}
+
+func (s *sessionStore) connect() (*gocql.Session, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.session != nil {
+		return s.session, nil
+	}
+
+	cluster := gocql.NewCluster("127.0.0.1")
+	cluster.Port = 9042
+	cluster.Keyspace = "game_system"
+	cluster.Consistency = gocql.Quorum
+	cluster.ProtoVersion = 4
+
+	session, err := cluster.CreateSession()
+	if err != nil {
+		return nil, err
+	}
+	s.session = session
+	return session, nil
+}
+
+// get returns the stored session with sessionID, found through the
+// game_sessions_session_id index.
+func (s *sessionStore) get(ctx context.Context, sessionID gocql.UUID) (storedSession, error) {
+	session, err := s.connect()
+	if err != nil {
+		return storedSession{}, err
+	}
+
+	var stored storedSession
+	err = session.Query(
+		`SELECT session_id, user_id, score, game_mode, timestamp, result, voided FROM game_system.game_sessions WHERE session_id = ?`,
+		sessionID,
+	).WithContext(ctx).Scan(
+		&stored.SessionID,
+		&stored.UserID,
+		&stored.Score,
+		&stored.GameMode,
+		&stored.Timestamp,
+		&stored.Result,
+		&stored.Voided,
+	)
+	if err == gocql.ErrNotFound {
+		return storedSession{}, errSessionNotFound
+	}
+	return stored, err
+}
+
+func (s *sessionStore) Close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.session != nil {
+		s.session.Close()
+	}
+}
@@ -1,10 +1,13 @@
 #!/bin/bash
 
-echo "Starting worker service."
-cd ./worker_service && ./worker_service -mode cassandra &
+# Local runs use the public development service credentials unless
+# SERVICE_CLIENTS and SERVICE_CLIENT_SECRET are set.
+export DEV_SERVICE_CREDENTIALS=true
+# Password reset tokens go to ../local-data/notifications.jsonl
+export NOTIFIER=${NOTIFIER:-file}
 
 echo "Starting worker service."
-cd ./worker_service && ./worker_service -mode redis &
+cd ./worker_service && ./worker_service -sinks redis,cassandra &
 
 echo "Starting ranking service "
 cd ./ranking_service && ./ranking_service &
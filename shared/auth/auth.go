@@ -0,0 +1,255 @@
+// Package auth authenticates requests with the access tokens of
+// users_service.
+//
+// A Verifier checks a token's signature, algorithm, expiry, issuer and
+// audience, and asks its RevocationChecker whether the token was revoked.
+// Its Middleware puts the verified Claims in the request context, where
+// handlers read them with FromContext. Authentication and authorization
+// failures are answered with a JSON body of the form
+//
+//	{"error": "unauthorized", "message": "invalid token"}
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/golang-jwt/jwt/v5"
+	"shared/jwks"
+)
+
+// Roles granted by access tokens. Players only get RolePlayer. RoleService
+// is given to the tokens other services get with their client credentials.
+const (
+	RolePlayer     = "player"
+	RoleGameServer = "game_server"
+	RoleModerator  = "moderator"
+	RoleAdmin      = "admin"
+	RoleService    = "service"
+)
+
+// ValidUserRole reports whether role can be granted to a user account.
+func ValidUserRole(role string) bool {
+	switch role {
+	case RolePlayer, RoleGameServer, RoleModerator, RoleAdmin:
+		return true
+	}
+	return false
+}
+
+var (
+	// ErrRevoked is returned for tokens revoked by users_service.
+	ErrRevoked = errors.New("auth: token has been revoked")
+	// ErrMissingTokenID is returned for tokens without a "jti" claim,
+	// which cannot be revoked.
+	ErrMissingTokenID = errors.New("auth: token ID missing in token")
+)
+
+// Claims are the claims of an access token. Service tokens have no UserID
+// and carry the client ID as their subject.
+type Claims struct {
+	UserID   int      `json:"user_id"`
+	Username string   `json:"username"`
+	Roles    []string `json:"roles,omitempty"`
+	jwt.RegisteredClaims
+}
+
+// UserIDString returns the user ID in the form leaderboards and events use.
+func (c *Claims) UserIDString() string {
+	return strconv.Itoa(c.UserID)
+}
+
+// HasRole reports whether the token grants any of roles.
+func (c *Claims) HasRole(roles ...string) bool {
+	for _, have := range c.Roles {
+		for _, want := range roles {
+			if have == want {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// RevocationChecker reports whether the token with ID jti was revoked.
+type RevocationChecker interface {
+	IsRevoked(ctx context.Context, jti string) (bool, error)
+}
+
+// Keyfunc returns the key verifying token, like jwt.Keyfunc, with the
+// context of the request the token came with.
+type Keyfunc func(ctx context.Context, token *jwt.Token) (interface{}, error)
+
+// Verifier verifies access tokens.
+type Verifier struct {
+	keyfunc Keyfunc
+	revoked RevocationChecker
+}
+
+// NewVerifier returns a Verifier checking signatures with the keys keyfunc
+// returns. revoked may be nil to skip the revocation check.
+func NewVerifier(keyfunc Keyfunc, revoked RevocationChecker) *Verifier {
+	return &Verifier{keyfunc: keyfunc, revoked: revoked}
+}
+
+// Verify returns the claims of tokenString if it is a valid, unrevoked
+// EdDSA token of jwks.Issuer for jwks.Audience.
+func (v *Verifier) Verify(ctx context.Context, tokenString string) (*Claims, error) {
+	claims := &Claims{}
+	keyfunc := func(token *jwt.Token) (interface{}, error) {
+		return v.keyfunc(ctx, token)
+	}
+	token, err := jwt.ParseWithClaims(tokenString, claims, keyfunc,
+		jwt.WithValidMethods([]string{jwt.SigningMethodEdDSA.Alg()}),
+		jwt.WithIssuer(jwks.Issuer),
+		jwt.WithAudience(jwks.Audience),
+		jwt.WithExpirationRequired(),
+	)
+	if err != nil {
+		return nil, err
+	}
+	if !token.Valid {
+		return nil, errors.New("auth: invalid token")
+	}
+
+	if claims.ID == "" {
+		return nil, ErrMissingTokenID
+	}
+
+	if v.revoked != nil {
+		revoked, err := v.revoked.IsRevoked(ctx, claims.ID)
+		if err != nil {
+			return nil, err
+		}
+		if revoked {
+			return nil, ErrRevoked
+		}
+	}
+
+	return claims, nil
+}
+
+// Middleware rejects requests without a valid bearer token and adds the
+// token's claims to the context of the others.
+func (v *Verifier) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authHeader := r.Header.Get("Authorization")
+		if authHeader == "" {
+			Unauthorized(w, "authorization header required")
+			return
+		}
+
+		claims, err := v.Verify(r.Context(), strings.TrimPrefix(authHeader, "Bearer "))
+		switch {
+		case err == ErrRevoked:
+			Unauthorized(w, "token has been revoked")
+			return
+		case err == ErrMissingTokenID:
+			Unauthorized(w, "token ID missing in token")
+			return
+		case errors.Is(err, jwt.ErrTokenExpired):
+			Unauthorized(w, "token has expired")
+			return
+		case errors.Is(err, jwks.ErrUnavailable):
+			writeError(w, http.StatusServiceUnavailable, "unavailable", "token signing keys could not be fetched")
+			return
+		case err != nil && isTokenError(err):
+			Unauthorized(w, "invalid token")
+			return
+		case err != nil:
+			// The revocation store could not be reached
+			writeError(w, http.StatusServiceUnavailable, "unavailable", "token revocation could not be checked")
+			return
+		}
+
+		next.ServeHTTP(w, r.WithContext(NewContext(r.Context(), claims)))
+	})
+}
+
+// isTokenError reports whether err is about the token itself rather than
+// the checks made around it.
+func isTokenError(err error) bool {
+	for _, tokenErr := range []error{
+		jwt.ErrTokenMalformed,
+		jwt.ErrTokenUnverifiable,
+		jwt.ErrTokenSignatureInvalid,
+		jwt.ErrTokenInvalidClaims,
+		jwt.ErrTokenRequiredClaimMissing,
+		jwt.ErrTokenInvalidIssuer,
+		jwt.ErrTokenInvalidAudience,
+		jwt.ErrTokenNotValidYet,
+		jwt.ErrTokenUsedBeforeIssued,
+	} {
+		if errors.Is(err, tokenErr) {
+			return true
+		}
+	}
+	return false
+}
+
+// RequireRole rejects requests whose token grants none of roles. It must
+// run after Middleware.
+func RequireRole(roles ...string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			claims, ok := FromContext(r.Context())
+			if !ok {
+				Unauthorized(w, "authentication required")
+				return
+			}
+			if !claims.HasRole(roles...) {
+				Forbidden(w, "insufficient role")
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+type contextKey struct{}
+
+// NewContext returns a copy of ctx carrying claims.
+func NewContext(ctx context.Context, claims *Claims) context.Context {
+	return context.WithValue(ctx, contextKey{}, claims)
+}
+
+// FromContext returns the claims added by Middleware.
+func FromContext(ctx context.Context) (*Claims, bool) {
+	claims, ok := ctx.Value(contextKey{}).(*Claims)
+	return claims, ok
+}
+
+// UserID returns the ID of the authenticated user.
+func UserID(ctx context.Context) (int, bool) {
+	claims, ok := FromContext(ctx)
+	if !ok {
+		return 0, false
+	}
+	return claims.UserID, true
+}
+
+type errorResponse struct {
+	Error   string `json:"error"`
+	Message string `json:"message"`
+}
+
+func writeError(w http.ResponseWriter, status int, code, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(errorResponse{Error: code, Message: message})
+}
+
+// Unauthorized answers a request that is not authenticated.
+func Unauthorized(w http.ResponseWriter, message string) {
+	w.Header().Set("WWW-Authenticate", "Bearer")
+	writeError(w, http.StatusUnauthorized, "unauthorized", message)
+}
+
+// Forbidden answers a request that is authenticated but not allowed.
+func Forbidden(w http.ResponseWriter, message string) {
+	writeError(w, http.StatusForbidden, "forbidden", message)
+}
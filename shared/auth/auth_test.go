@@ -0,0 +1,180 @@
+package auth
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"shared/jwks"
+)
+
+// revokedSet is a RevocationChecker over a fixed set of token IDs.
+type revokedSet map[string]bool
+
+func (s revokedSet) IsRevoked(ctx context.Context, jti string) (bool, error) {
+	if jti == "unreachable" {
+		return false, errors.New("revocation store unreachable")
+	}
+	return s[jti], nil
+}
+
+func validClaims() jwt.MapClaims {
+	now := time.Now()
+	return jwt.MapClaims{
+		"iss":      jwks.Issuer,
+		"aud":      jwks.Audience,
+		"user_id":  42,
+		"username": "testuser",
+		"roles":    []string{RolePlayer},
+		"jti":      "token-1",
+		"iat":      now.Unix(),
+		"exp":      now.Add(time.Minute).Unix(),
+	}
+}
+
+func TestVerify(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyfunc := func(ctx context.Context, token *jwt.Token) (interface{}, error) {
+		if kid, _ := token.Header["kid"].(string); kid != "k1" {
+			return nil, jwks.ErrUnknownKey
+		}
+		return pub, nil
+	}
+	verifier := NewVerifier(keyfunc, revokedSet{"revoked": true})
+
+	sign := func(t *testing.T, method jwt.SigningMethod, key interface{}, change func(jwt.MapClaims)) string {
+		t.Helper()
+		claims := validClaims()
+		if change != nil {
+			change(claims)
+		}
+		token := jwt.NewWithClaims(method, claims)
+		token.Header["kid"] = "k1"
+		signed, err := token.SignedString(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return signed
+	}
+
+	tests := []struct {
+		name    string
+		method  jwt.SigningMethod
+		key     interface{}
+		change  func(jwt.MapClaims)
+		wantErr error
+	}{
+		{name: "valid", method: jwt.SigningMethodEdDSA, key: priv},
+		{name: "HS256 with the public key", method: jwt.SigningMethodHS256, key: []byte(pub),
+			wantErr: jwt.ErrTokenSignatureInvalid},
+		{name: "alg none", method: jwt.SigningMethodNone, key: jwt.UnsafeAllowNoneSignatureType,
+			wantErr: jwt.ErrTokenSignatureInvalid},
+		{name: "wrong issuer", method: jwt.SigningMethodEdDSA, key: priv,
+			change: func(c jwt.MapClaims) { c["iss"] = "someone_else" }, wantErr: jwt.ErrTokenInvalidIssuer},
+		{name: "wrong audience", method: jwt.SigningMethodEdDSA, key: priv,
+			change: func(c jwt.MapClaims) { c["aud"] = "other" }, wantErr: jwt.ErrTokenInvalidAudience},
+		{name: "expired", method: jwt.SigningMethodEdDSA, key: priv,
+			change: func(c jwt.MapClaims) { c["exp"] = time.Now().Add(-time.Minute).Unix() }, wantErr: jwt.ErrTokenExpired},
+		{name: "no expiry", method: jwt.SigningMethodEdDSA, key: priv,
+			change: func(c jwt.MapClaims) { delete(c, "exp") }, wantErr: jwt.ErrTokenRequiredClaimMissing},
+		{name: "missing jti", method: jwt.SigningMethodEdDSA, key: priv,
+			change: func(c jwt.MapClaims) { delete(c, "jti") }, wantErr: ErrMissingTokenID},
+		{name: "revoked", method: jwt.SigningMethodEdDSA, key: priv,
+			change: func(c jwt.MapClaims) { c["jti"] = "revoked" }, wantErr: ErrRevoked},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims, err := verifier.Verify(context.Background(), sign(t, tt.method, tt.key, tt.change))
+			if tt.wantErr == nil {
+				if err != nil {
+					t.Fatalf("Verify: %v", err)
+				}
+				if claims.UserID != 42 || claims.Username != "testuser" || !claims.HasRole(RolePlayer) {
+					t.Errorf("claims = %+v", claims)
+				}
+				return
+			}
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("Verify error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+
+	t.Run("signed by another key", func(t *testing.T) {
+		_, other, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := verifier.Verify(context.Background(), sign(t, jwt.SigningMethodEdDSA, other, nil)); !errors.Is(err, jwt.ErrTokenSignatureInvalid) {
+			t.Errorf("Verify error = %v, want %v", err, jwt.ErrTokenSignatureInvalid)
+		}
+	})
+}
+
+func TestMiddlewareStatus(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed := func(jti, kid string) string {
+		claims := validClaims()
+		claims["jti"] = jti
+		token := jwt.NewWithClaims(jwt.SigningMethodEdDSA, claims)
+		token.Header["kid"] = kid
+		s, err := token.SignedString(priv)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+	keyfunc := func(ctx context.Context, token *jwt.Token) (interface{}, error) {
+		switch token.Header["kid"] {
+		case "k1":
+			return pub, nil
+		case "down":
+			return nil, fmt.Errorf("%w: fetching key set: connection refused", jwks.ErrUnavailable)
+		}
+		return nil, jwks.ErrUnknownKey
+	}
+	handler := NewVerifier(keyfunc, revokedSet{"revoked": true}).Middleware(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	tests := []struct {
+		name   string
+		header string
+		want   int
+	}{
+		{"valid", "Bearer " + signed("token-1", "k1"), http.StatusOK},
+		{"no header", "", http.StatusUnauthorized},
+		{"garbage", "Bearer not-a-token", http.StatusUnauthorized},
+		{"unknown key", "Bearer " + signed("token-1", "k2"), http.StatusUnauthorized},
+		{"revoked", "Bearer " + signed("revoked", "k1"), http.StatusUnauthorized},
+		{"key set unavailable", "Bearer " + signed("token-1", "down"), http.StatusServiceUnavailable},
+		{"revocation store unreachable", "Bearer " + signed("unreachable", "k1"), http.StatusServiceUnavailable},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			if tt.header != "" {
+				r.Header.Set("Authorization", tt.header)
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+			if w.Code != tt.want {
+				t.Errorf("status = %d, want %d (%s)", w.Code, tt.want, w.Body.String())
+			}
+		})
+	}
+}
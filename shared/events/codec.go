@@ -0,0 +1,396 @@
+package events
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/gocql/gocql"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// ContentTypeHeader is the message header naming the payload encoding.
+// Messages without it are JSON.
+const ContentTypeHeader = "content-type"
+
+// Supported encodings.
+const (
+	ContentTypeJSON     = "application/json"
+	ContentTypeProtobuf = "application/x-protobuf"
+)
+
+// ErrUnsupportedContentType is returned for encodings this package lacks.
+var ErrUnsupportedContentType = errors.New("events: unsupported content type")
+
+// ErrScoreOutOfRange is returned for scores the int32 score fields of the
+// protobuf messages cannot hold, rather than truncating them.
+var ErrScoreOutOfRange = errors.New("events: score out of the int32 range")
+
+// payloadCodec converts the JSON payload of one event type to and from its
+// protobuf message.
+type payloadCodec struct {
+	marshal   func(payload json.RawMessage) ([]byte, error)
+	unmarshal func(data []byte) (json.RawMessage, error)
+}
+
+var payloadCodecs = map[string]payloadCodec{
+	TypeGameScoreRecorded: {marshal: marshalGameSession, unmarshal: unmarshalGameSession},
+	TypeScoreVoided:       {marshal: marshalScoreVoided, unmarshal: unmarshalScoreVoided},
+	TypeUserBanned:        {marshal: marshalUserBan, unmarshal: unmarshalUserBan},
+	TypeUserUnbanned:      {marshal: marshalUserBan, unmarshal: unmarshalUserBan},
+}
+
+// Marshal serializes env with the given content type.
+func Marshal(env Envelope, contentType string) ([]byte, error) {
+	switch normalizeContentType(contentType) {
+	case ContentTypeJSON:
+		return Encode(env)
+	case ContentTypeProtobuf:
+		return marshalEnvelope(env)
+	default:
+		return nil, fmt.Errorf("%w: %s", ErrUnsupportedContentType, contentType)
+	}
+}
+
+// Unmarshal parses a message encoded with the given content type. An empty
+// content type is JSON, the format used before binary encodings existed.
+func Unmarshal(data []byte, contentType string) (Envelope, error) {
+	switch normalizeContentType(contentType) {
+	case ContentTypeJSON:
+		return Decode(data)
+	case ContentTypeProtobuf:
+		return unmarshalEnvelope(data)
+	default:
+		return Envelope{}, fmt.Errorf("%w: %s", ErrUnsupportedContentType, contentType)
+	}
+}
+
+func normalizeContentType(contentType string) string {
+	contentType, _, _ = strings.Cut(contentType, ";")
+	contentType = strings.ToLower(strings.TrimSpace(contentType))
+	if contentType == "" {
+		return ContentTypeJSON
+	}
+	return contentType
+}
+
+func marshalEnvelope(env Envelope) ([]byte, error) {
+	codec, ok := payloadCodecs[env.EventType]
+	if !ok {
+		return nil, fmt.Errorf("%w: no protobuf payload for %s", ErrUnexpectedType, env.EventType)
+	}
+
+	payload, err := codec.marshal(env.Payload)
+	if err != nil {
+		return nil, err
+	}
+
+	var b []byte
+	b = appendVarintField(b, 1, uint64(env.SchemaVersion))
+	b = appendStringField(b, 2, env.EventID)
+	b = appendStringField(b, 3, env.EventType)
+	b = appendStringField(b, 4, env.Producer)
+	b = appendTimestampField(b, 5, env.OccurredAt)
+	b = protowire.AppendTag(b, 6, protowire.BytesType)
+	b = protowire.AppendBytes(b, payload)
+	return b, nil
+}
+
+func unmarshalEnvelope(data []byte) (Envelope, error) {
+	var env Envelope
+	var payload []byte
+
+	err := consumeFields(data, func(num protowire.Number, typ protowire.Type, b []byte) (int, error) {
+		switch {
+		case num == 1 && typ == protowire.VarintType:
+			v, n := protowire.ConsumeVarint(b)
+			env.SchemaVersion = int(int32(v))
+			return n, nil
+		case num == 2 && typ == protowire.BytesType:
+			return consumeString(b, &env.EventID)
+		case num == 3 && typ == protowire.BytesType:
+			return consumeString(b, &env.EventType)
+		case num == 4 && typ == protowire.BytesType:
+			return consumeString(b, &env.Producer)
+		case num == 5 && typ == protowire.BytesType:
+			return consumeTimestamp(b, &env.OccurredAt)
+		case num == 6 && typ == protowire.BytesType:
+			v, n := protowire.ConsumeBytes(b)
+			payload = v
+			return n, nil
+		}
+		return protowire.ConsumeFieldValue(num, typ, b), nil
+	})
+	if err != nil {
+		return Envelope{}, err
+	}
+
+	if env.SchemaVersion > SchemaVersion || env.SchemaVersion < 1 {
+		return Envelope{}, fmt.Errorf("%w: %d", ErrUnsupportedVersion, env.SchemaVersion)
+	}
+
+	codec, ok := payloadCodecs[env.EventType]
+	if !ok {
+		return Envelope{}, fmt.Errorf("%w: %s", ErrUnexpectedType, env.EventType)
+	}
+
+	env.Payload, err = codec.unmarshal(payload)
+	if err != nil {
+		return Envelope{}, err
+	}
+
+	return env, nil
+}
+
+func marshalGameSession(payload json.RawMessage) ([]byte, error) {
+	var session GameSession
+	if err := json.Unmarshal(payload, &session); err != nil {
+		return nil, err
+	}
+
+	if session.Score < math.MinInt32 || session.Score > math.MaxInt32 {
+		return nil, fmt.Errorf("%w: %d", ErrScoreOutOfRange, session.Score)
+	}
+
+	var b []byte
+	b = protowire.AppendTag(b, 1, protowire.BytesType)
+	b = protowire.AppendBytes(b, session.SessionID.Bytes())
+	b = appendStringField(b, 2, session.UserID)
+	b = appendVarintField(b, 3, uint64(int32(session.Score)))
+	b = appendStringField(b, 4, session.GameMode)
+	b = appendTimestampField(b, 5, session.Timestamp)
+	b = appendStringField(b, 6, session.Result)
+	for _, opponent := range session.Opponents {
+		b = protowire.AppendTag(b, 7, protowire.BytesType)
+		b = protowire.AppendString(b, opponent)
+	}
+	b = appendStringField(b, 8, session.MatchID)
+	return b, nil
+}
+
+func unmarshalGameSession(data []byte) (json.RawMessage, error) {
+	var session GameSession
+
+	err := consumeFields(data, func(num protowire.Number, typ protowire.Type, b []byte) (int, error) {
+		switch {
+		case num == 1 && typ == protowire.BytesType:
+			return consumeUUID(b, &session.SessionID)
+		case num == 2 && typ == protowire.BytesType:
+			return consumeString(b, &session.UserID)
+		case num == 3 && typ == protowire.VarintType:
+			return consumeScore(b, &session.Score)
+		case num == 4 && typ == protowire.BytesType:
+			return consumeString(b, &session.GameMode)
+		case num == 5 && typ == protowire.BytesType:
+			return consumeTimestamp(b, &session.Timestamp)
+		case num == 6 && typ == protowire.BytesType:
+			return consumeString(b, &session.Result)
+		case num == 7 && typ == protowire.BytesType:
+			var opponent string
+			n, err := consumeString(b, &opponent)
+			session.Opponents = append(session.Opponents, opponent)
+			return n, err
+		case num == 8 && typ == protowire.BytesType:
+			return consumeString(b, &session.MatchID)
+		}
+		return protowire.ConsumeFieldValue(num, typ, b), nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(session)
+}
+
+func marshalScoreVoided(payload json.RawMessage) ([]byte, error) {
+	var voided ScoreVoided
+	if err := json.Unmarshal(payload, &voided); err != nil {
+		return nil, err
+	}
+
+	if voided.Score < math.MinInt32 || voided.Score > math.MaxInt32 {
+		return nil, fmt.Errorf("%w: %d", ErrScoreOutOfRange, voided.Score)
+	}
+
+	var b []byte
+	b = protowire.AppendTag(b, 1, protowire.BytesType)
+	b = protowire.AppendBytes(b, voided.SessionID.Bytes())
+	b = appendStringField(b, 2, voided.UserID)
+	b = appendStringField(b, 3, voided.GameMode)
+	b = appendVarintField(b, 4, uint64(int32(voided.Score)))
+	b = appendStringField(b, 5, voided.Reason)
+	b = appendStringField(b, 6, voided.Result)
+	return b, nil
+}
+
+func unmarshalScoreVoided(data []byte) (json.RawMessage, error) {
+	var voided ScoreVoided
+
+	err := consumeFields(data, func(num protowire.Number, typ protowire.Type, b []byte) (int, error) {
+		switch {
+		case num == 1 && typ == protowire.BytesType:
+			return consumeUUID(b, &voided.SessionID)
+		case num == 2 && typ == protowire.BytesType:
+			return consumeString(b, &voided.UserID)
+		case num == 3 && typ == protowire.BytesType:
+			return consumeString(b, &voided.GameMode)
+		case num == 4 && typ == protowire.VarintType:
+			return consumeScore(b, &voided.Score)
+		case num == 5 && typ == protowire.BytesType:
+			return consumeString(b, &voided.Reason)
+		case num == 6 && typ == protowire.BytesType:
+			return consumeString(b, &voided.Result)
+		}
+		return protowire.ConsumeFieldValue(num, typ, b), nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(voided)
+}
+
+func marshalUserBan(payload json.RawMessage) ([]byte, error) {
+	var ban UserBan
+	if err := json.Unmarshal(payload, &ban); err != nil {
+		return nil, err
+	}
+
+	var b []byte
+	b = appendStringField(b, 1, ban.UserID)
+	b = appendStringField(b, 2, ban.Reason)
+	return b, nil
+}
+
+func unmarshalUserBan(data []byte) (json.RawMessage, error) {
+	var ban UserBan
+
+	err := consumeFields(data, func(num protowire.Number, typ protowire.Type, b []byte) (int, error) {
+		switch {
+		case num == 1 && typ == protowire.BytesType:
+			return consumeString(b, &ban.UserID)
+		case num == 2 && typ == protowire.BytesType:
+			return consumeString(b, &ban.Reason)
+		}
+		return protowire.ConsumeFieldValue(num, typ, b), nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(ban)
+}
+
+// consumeFields walks the fields of a message. consume parses the value of
+// one field and returns its length, or a negative protowire error code.
+func consumeFields(data []byte, consume func(num protowire.Number, typ protowire.Type, b []byte) (int, error)) error {
+	for len(data) > 0 {
+		num, typ, n := protowire.ConsumeTag(data)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		data = data[n:]
+
+		n, err := consume(num, typ, data)
+		if err != nil {
+			return err
+		}
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		data = data[n:]
+	}
+	return nil
+}
+
+func consumeUUID(b []byte, id *gocql.UUID) (int, error) {
+	v, n := protowire.ConsumeBytes(b)
+	if n < 0 {
+		return n, nil
+	}
+
+	var err error
+	*id, err = gocql.UUIDFromBytes(v)
+	return n, err
+}
+
+// consumeScore parses an int32 score, refusing values encoded by producers
+// that would not fit.
+func consumeScore(b []byte, score *int) (int, error) {
+	v, n := protowire.ConsumeVarint(b)
+	if n < 0 {
+		return n, nil
+	}
+	if int64(v) != int64(int32(v)) {
+		return n, fmt.Errorf("%w: %d", ErrScoreOutOfRange, int64(v))
+	}
+	*score = int(int32(v))
+	return n, nil
+}
+
+func consumeString(b []byte, s *string) (int, error) {
+	v, n := protowire.ConsumeString(b)
+	*s = v
+	return n, nil
+}
+
+// consumeTimestamp parses an embedded google.protobuf.Timestamp.
+func consumeTimestamp(b []byte, t *time.Time) (int, error) {
+	v, n := protowire.ConsumeBytes(b)
+	if n < 0 {
+		return n, nil
+	}
+
+	var seconds, nanos int64
+	err := consumeFields(v, func(num protowire.Number, typ protowire.Type, b []byte) (int, error) {
+		if typ != protowire.VarintType || (num != 1 && num != 2) {
+			return protowire.ConsumeFieldValue(num, typ, b), nil
+		}
+		v, n := protowire.ConsumeVarint(b)
+		if num == 1 {
+			seconds = int64(v)
+		} else {
+			nanos = int64(int32(v))
+		}
+		return n, nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	*t = time.Unix(seconds, nanos).UTC()
+	return n, nil
+}
+
+func appendVarintField(b []byte, num protowire.Number, v uint64) []byte {
+	if v == 0 {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.VarintType)
+	return protowire.AppendVarint(b, v)
+}
+
+func appendStringField(b []byte, num protowire.Number, s string) []byte {
+	if s == "" {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendString(b, s)
+}
+
+// appendTimestampField appends t as an embedded google.protobuf.Timestamp.
+func appendTimestampField(b []byte, num protowire.Number, t time.Time) []byte {
+	if t.IsZero() {
+		return b
+	}
+
+	var ts []byte
+	ts = appendVarintField(ts, 1, uint64(t.Unix()))
+	ts = appendVarintField(ts, 2, uint64(t.Nanosecond()))
+
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendBytes(b, ts)
+}
@@ -0,0 +1,288 @@
+package events
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"math"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gocql/gocql"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// scalarTypes maps the scalar types events.proto uses to their descriptor
+// types.
+var scalarTypes = map[string]descriptorpb.FieldDescriptorProto_Type{
+	"int32":  descriptorpb.FieldDescriptorProto_TYPE_INT32,
+	"int64":  descriptorpb.FieldDescriptorProto_TYPE_INT64,
+	"bool":   descriptorpb.FieldDescriptorProto_TYPE_BOOL,
+	"string": descriptorpb.FieldDescriptorProto_TYPE_STRING,
+	"bytes":  descriptorpb.FieldDescriptorProto_TYPE_BYTES,
+}
+
+var (
+	protoPackage = regexp.MustCompile(`^package\s+([\w.]+)\s*;$`)
+	protoImport  = regexp.MustCompile(`^import\s+"([^"]+)"\s*;$`)
+	protoMessage = regexp.MustCompile(`^message\s+(\w+)\s*\{$`)
+	protoField   = regexp.MustCompile(`^(repeated\s+)?([\w.]+)\s+(\w+)\s*=\s*(\d+)\s*;$`)
+)
+
+// parseSchema reads the messages of events.proto into a file descriptor, so
+// that the reference messages the hand-written codec is checked against
+// follow the schema as it is. It understands the subset of proto3 the file
+// uses: a package, imports, and messages of scalar, repeated and
+// google.protobuf.Timestamp fields.
+func parseSchema(t *testing.T, path string) *descriptorpb.FileDescriptorProto {
+	t.Helper()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	file := &descriptorpb.FileDescriptorProto{
+		Name:   proto.String(filepath.Base(path)),
+		Syntax: proto.String("proto3"),
+	}
+	var message *descriptorpb.DescriptorProto
+	for i, line := range strings.Split(string(data), "\n") {
+		line, _, _ = strings.Cut(line, "//")
+		line = strings.TrimSpace(line)
+
+		switch {
+		case line == "" || strings.HasPrefix(line, "syntax "):
+		case message == nil && protoPackage.MatchString(line):
+			file.Package = proto.String(protoPackage.FindStringSubmatch(line)[1])
+		case message == nil && protoImport.MatchString(line):
+			file.Dependency = append(file.Dependency, protoImport.FindStringSubmatch(line)[1])
+		case message == nil && protoMessage.MatchString(line):
+			message = &descriptorpb.DescriptorProto{Name: proto.String(protoMessage.FindStringSubmatch(line)[1])}
+		case message != nil && line == "}":
+			file.MessageType = append(file.MessageType, message)
+			message = nil
+		case message != nil && protoField.MatchString(line):
+			match := protoField.FindStringSubmatch(line)
+			number, err := strconv.Atoi(match[4])
+			if err != nil {
+				t.Fatalf("%s:%d: %v", path, i+1, err)
+			}
+			field := &descriptorpb.FieldDescriptorProto{
+				Name:     proto.String(match[3]),
+				Number:   proto.Int32(int32(number)),
+				Label:    descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL.Enum(),
+				JsonName: proto.String(match[3]),
+			}
+			if match[1] != "" {
+				field.Label = descriptorpb.FieldDescriptorProto_LABEL_REPEATED.Enum()
+			}
+			if typ, ok := scalarTypes[match[2]]; ok {
+				field.Type = typ.Enum()
+			} else if match[2] == "google.protobuf.Timestamp" {
+				field.Type = descriptorpb.FieldDescriptorProto_TYPE_MESSAGE.Enum()
+				field.TypeName = proto.String(".google.protobuf.Timestamp")
+			} else {
+				t.Fatalf("%s:%d: unsupported field type %s", path, i+1, match[2])
+			}
+			message.Field = append(message.Field, field)
+		default:
+			t.Fatalf("%s:%d: unsupported line %q", path, i+1, line)
+		}
+	}
+	if message != nil {
+		t.Fatalf("%s: message %s is not closed", path, message.GetName())
+	}
+	return file
+}
+
+// referenceMessages builds the message descriptors of events.proto.
+func referenceMessages(t *testing.T) map[string]protoreflect.MessageDescriptor {
+	t.Helper()
+
+	fd, err := protodesc.NewFile(parseSchema(t, "events.proto"), protoregistry.GlobalFiles)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	messages := make(map[string]protoreflect.MessageDescriptor)
+	for i := 0; i < fd.Messages().Len(); i++ {
+		md := fd.Messages().Get(i)
+		messages[string(md.Name())] = md
+	}
+	for _, name := range []string{"Envelope", "GameSession", "ScoreVoided", "UserBan"} {
+		if messages[name] == nil {
+			t.Fatalf("events.proto has no message %s", name)
+		}
+	}
+	return messages
+}
+
+// referenceEncode encodes values, keyed by field name, as a message of md
+// with the protobuf runtime.
+func referenceEncode(t *testing.T, md protoreflect.MessageDescriptor, values map[string]interface{}) []byte {
+	t.Helper()
+
+	m := dynamicpb.NewMessage(md)
+	for name, value := range values {
+		fd := md.Fields().ByName(protoreflect.Name(name))
+		switch v := value.(type) {
+		case []string:
+			list := m.Mutable(fd).List()
+			for _, s := range v {
+				list.Append(protoreflect.ValueOfString(s))
+			}
+		case time.Time:
+			m.Set(fd, protoreflect.ValueOfMessage(timestamppb.New(v).ProtoReflect()))
+		default:
+			m.Set(fd, protoreflect.ValueOf(v))
+		}
+	}
+
+	data, err := proto.MarshalOptions{Deterministic: true}.Marshal(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestProtobufMatchesReference(t *testing.T) {
+	messages := referenceMessages(t)
+
+	sessionID, err := gocql.ParseUUID("7f96b996-1c31-11f0-a02a-2a50f1ea084a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	timestamp := time.Date(2025, 4, 18, 8, 45, 36, 804495000, time.UTC)
+
+	tests := []struct {
+		eventType string
+		payload   interface{}
+		message   string
+		reference map[string]interface{}
+	}{
+		{
+			eventType: TypeGameScoreRecorded,
+			payload: GameSession{
+				SessionID: sessionID,
+				UserID:    "42",
+				Score:     -120,
+				GameMode:  "ranked",
+				Timestamp: timestamp,
+				Result:    ResultWin,
+				Opponents: []string{"7", "9"},
+				MatchID:   "m-42",
+			},
+			message: "GameSession",
+			reference: map[string]interface{}{
+				"session_id": sessionID.Bytes(),
+				"user_id":    "42",
+				"score":      int32(-120),
+				"game_mode":  "ranked",
+				"timestamp":  timestamp,
+				"result":     ResultWin,
+				"opponents":  []string{"7", "9"},
+				"match_id":   "m-42",
+			},
+		},
+		{
+			eventType: TypeScoreVoided,
+			payload: ScoreVoided{
+				SessionID: sessionID,
+				UserID:    "42",
+				GameMode:  "ranked",
+				Score:     math.MaxInt32,
+				Reason:    "cheating",
+				Result:    ResultLoss,
+			},
+			message: "ScoreVoided",
+			reference: map[string]interface{}{
+				"session_id": sessionID.Bytes(),
+				"user_id":    "42",
+				"game_mode":  "ranked",
+				"score":      int32(math.MaxInt32),
+				"reason":     "cheating",
+				"result":     ResultLoss,
+			},
+		},
+		{
+			eventType: TypeUserBanned,
+			payload:   UserBan{UserID: "42", Reason: "cheating"},
+			message:   "UserBan",
+			reference: map[string]interface{}{
+				"user_id": "42",
+				"reason":  "cheating",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		env, err := NewEnvelope(tt.eventType, "score_service", tt.payload)
+		if err != nil {
+			t.Fatal(err)
+		}
+		env.OccurredAt = timestamp
+
+		payload := referenceEncode(t, messages[tt.message], tt.reference)
+		want := referenceEncode(t, messages["Envelope"], map[string]interface{}{
+			"schema_version": int32(SchemaVersion),
+			"event_id":       env.EventID,
+			"event_type":     env.EventType,
+			"producer":       env.Producer,
+			"occurred_at":    timestamp,
+			"payload":        payload,
+		})
+
+		got, err := Marshal(env, ContentTypeProtobuf)
+		if err != nil {
+			t.Fatalf("%s: Marshal: %v", tt.eventType, err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("%s: encoded\n%x\nwant\n%x", tt.eventType, got, want)
+		}
+
+		decoded, err := Unmarshal(want, ContentTypeProtobuf)
+		if err != nil {
+			t.Fatalf("%s: Unmarshal: %v", tt.eventType, err)
+		}
+		wantPayload, err := json.Marshal(tt.payload)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(decoded.Payload, wantPayload) {
+			t.Errorf("%s: decoded payload %s, want %s", tt.eventType, decoded.Payload, wantPayload)
+		}
+	}
+}
+
+func TestProtobufRejectsOutOfRangeScores(t *testing.T) {
+	session := testSession()
+	session.Score = math.MaxInt32 + 1
+	env, err := NewGameScoreRecorded("score_service", session)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Marshal(env, ContentTypeProtobuf); !errors.Is(err, ErrScoreOutOfRange) {
+		t.Errorf("Marshal error = %v, want ErrScoreOutOfRange", err)
+	}
+
+	// A producer encoding the score as an int64 is refused on decode
+	var payload []byte
+	payload = protowire.AppendTag(payload, 3, protowire.VarintType)
+	payload = protowire.AppendVarint(payload, uint64(int64(math.MaxInt32)+1))
+	if _, err := unmarshalGameSession(payload); !errors.Is(err, ErrScoreOutOfRange) {
+		t.Errorf("unmarshalGameSession error = %v, want ErrScoreOutOfRange", err)
+	}
+}
@@ -0,0 +1,221 @@
+// Package events defines the messages published on the game-sessions topic.
+//
+// Every message is an Envelope. Its schema version follows these rules:
+//
+//   - Within a schema version, fields may only be added, never removed,
+//     renamed or retyped, and new fields must be optional. Consumers ignore
+//     fields they do not know.
+//   - Any other change bumps SchemaVersion. Consumers upgrade messages with
+//     an older version and reject those with a newer one.
+//   - Messages published before the envelope existed ({"event_type",
+//     "session"}) are treated as version 0 and upgraded on decode.
+package events
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/gocql/gocql"
+)
+
+// SchemaVersion is the envelope version produced by this package.
+const SchemaVersion = 1
+
+// Event types carried by the envelope.
+const (
+	TypeGameScoreRecorded = "game_score_recorded"
+	TypeScoreVoided       = "score_voided"
+	TypeUserBanned        = "user_banned"
+	TypeUserUnbanned      = "user_unbanned"
+)
+
+var (
+	// ErrUnsupportedVersion is returned for envelopes newer than SchemaVersion.
+	ErrUnsupportedVersion = errors.New("events: unsupported schema version")
+	// ErrUnexpectedType is returned when a payload is read as the wrong type.
+	ErrUnexpectedType = errors.New("events: unexpected event type")
+)
+
+// Envelope wraps every event with the metadata needed to route, deduplicate
+// and evolve it.
+type Envelope struct {
+	SchemaVersion int             `json:"schema_version"`
+	EventID       string          `json:"event_id"`
+	EventType     string          `json:"event_type"`
+	Producer      string          `json:"producer"`
+	OccurredAt    time.Time       `json:"occurred_at"`
+	Payload       json.RawMessage `json:"payload"`
+}
+
+// Match results of a GameSession.
+const (
+	ResultWin  = "win"
+	ResultLoss = "loss"
+	ResultDraw = "draw"
+)
+
+// GameSession is the payload of a game_score_recorded event. Result and
+// Opponents are only set for sessions that were matches. MatchID is shared by
+// the sessions every player of a match submits.
+type GameSession struct {
+	SessionID gocql.UUID `json:"session_id"`
+	UserID    string     `json:"user_id"`
+	Score     int        `json:"score"`
+	GameMode  string     `json:"game_mode"`
+	Timestamp time.Time  `json:"timestamp"`
+	Result    string     `json:"result,omitempty"`
+	Opponents []string   `json:"opponents,omitempty"`
+	MatchID   string     `json:"match_id,omitempty"`
+}
+
+// ValidResult reports whether result is empty or a known match result.
+func ValidResult(result string) bool {
+	switch result {
+	case "", ResultWin, ResultLoss, ResultDraw:
+		return true
+	}
+	return false
+}
+
+// ScoreVoided is the payload of a score_voided event. It repeats the user,
+// mode and score of the session so that consumers which only keep totals can
+// subtract it.
+type ScoreVoided struct {
+	SessionID gocql.UUID `json:"session_id"`
+	UserID    string     `json:"user_id"`
+	GameMode  string     `json:"game_mode"`
+	Score     int        `json:"score"`
+	Reason    string     `json:"reason"`
+	Result    string     `json:"result,omitempty"`
+}
+
+// UserBan is the payload of the user_banned and user_unbanned events.
+type UserBan struct {
+	UserID string `json:"user_id"`
+	Reason string `json:"reason"`
+}
+
+// NewEnvelope wraps payload in an envelope of the current schema version.
+func NewEnvelope(eventType, producer string, payload interface{}) (Envelope, error) {
+	eventID, err := gocql.RandomUUID()
+	if err != nil {
+		return Envelope{}, err
+	}
+
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return Envelope{}, err
+	}
+
+	return Envelope{
+		SchemaVersion: SchemaVersion,
+		EventID:       eventID.String(),
+		EventType:     eventType,
+		Producer:      producer,
+		OccurredAt:    time.Now().UTC(),
+		Payload:       data,
+	}, nil
+}
+
+// NewGameScoreRecorded returns the event published when a session is scored.
+func NewGameScoreRecorded(producer string, session GameSession) (Envelope, error) {
+	env, err := NewEnvelope(TypeGameScoreRecorded, producer, session)
+	if err != nil {
+		return Envelope{}, err
+	}
+	env.OccurredAt = session.Timestamp
+	return env, nil
+}
+
+// Encode serializes env for publishing.
+func Encode(env Envelope) ([]byte, error) {
+	return json.Marshal(env)
+}
+
+// legacyMessage is the format published before the envelope was introduced.
+type legacyMessage struct {
+	EventType string          `json:"event_type"`
+	Session   json.RawMessage `json:"session"`
+}
+
+// Decode parses a message, upgrading older schema versions to the current
+// one. It returns ErrUnsupportedVersion for versions it does not know.
+func Decode(data []byte) (Envelope, error) {
+	var env Envelope
+	if err := json.Unmarshal(data, &env); err != nil {
+		return Envelope{}, err
+	}
+
+	switch {
+	case env.SchemaVersion > SchemaVersion:
+		return Envelope{}, fmt.Errorf("%w: %d", ErrUnsupportedVersion, env.SchemaVersion)
+	case env.SchemaVersion == 0:
+		return upgradeLegacy(data)
+	case env.SchemaVersion < 0:
+		return Envelope{}, fmt.Errorf("%w: %d", ErrUnsupportedVersion, env.SchemaVersion)
+	}
+
+	if env.EventType == "" || len(env.Payload) == 0 {
+		return Envelope{}, errors.New("events: envelope without event type or payload")
+	}
+
+	return env, nil
+}
+
+// upgradeLegacy converts a version 0 message into an envelope. The session
+// ID doubles as the event ID so redeliveries keep the same identity.
+func upgradeLegacy(data []byte) (Envelope, error) {
+	var legacy legacyMessage
+	if err := json.Unmarshal(data, &legacy); err != nil {
+		return Envelope{}, err
+	}
+	if legacy.EventType == "" || len(legacy.Session) == 0 {
+		return Envelope{}, errors.New("events: message is neither an envelope nor a legacy event")
+	}
+
+	var session GameSession
+	if err := json.Unmarshal(legacy.Session, &session); err != nil {
+		return Envelope{}, err
+	}
+
+	return Envelope{
+		SchemaVersion: SchemaVersion,
+		EventID:       session.SessionID.String(),
+		EventType:     legacy.EventType,
+		Producer:      "legacy",
+		OccurredAt:    session.Timestamp,
+		Payload:       legacy.Session,
+	}, nil
+}
+
+// GameSession returns the payload of a game_score_recorded event.
+func (e Envelope) GameSession() (GameSession, error) {
+	var session GameSession
+	err := e.decodePayload(&session, TypeGameScoreRecorded)
+	return session, err
+}
+
+// ScoreVoided returns the payload of a score_voided event.
+func (e Envelope) ScoreVoided() (ScoreVoided, error) {
+	var voided ScoreVoided
+	err := e.decodePayload(&voided, TypeScoreVoided)
+	return voided, err
+}
+
+// UserBan returns the payload of a user_banned or user_unbanned event.
+func (e Envelope) UserBan() (UserBan, error) {
+	var ban UserBan
+	err := e.decodePayload(&ban, TypeUserBanned, TypeUserUnbanned)
+	return ban, err
+}
+
+func (e Envelope) decodePayload(v interface{}, eventTypes ...string) error {
+	for _, eventType := range eventTypes {
+		if e.EventType == eventType {
+			return json.Unmarshal(e.Payload, v)
+		}
+	}
+	return fmt.Errorf("%w: %s", ErrUnexpectedType, e.EventType)
+}
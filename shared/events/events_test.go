@@ -0,0 +1,125 @@
+package events
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/gocql/gocql"
+)
+
+func testSession() GameSession {
+	sessionID := gocql.TimeUUID()
+	return GameSession{
+		SessionID: sessionID,
+		UserID:    "42",
+		Score:     120,
+		GameMode:  "ranked",
+		Timestamp: sessionID.Time().UTC(),
+		Result:    ResultWin,
+		Opponents: []string{"7", "9"},
+		MatchID:   "m-42",
+	}
+}
+
+func equalSessions(a, b GameSession) bool {
+	if len(a.Opponents) != len(b.Opponents) {
+		return false
+	}
+	for i := range a.Opponents {
+		if a.Opponents[i] != b.Opponents[i] {
+			return false
+		}
+	}
+	return a.SessionID == b.SessionID && a.UserID == b.UserID && a.Score == b.Score &&
+		a.GameMode == b.GameMode && a.Timestamp.Equal(b.Timestamp) &&
+		a.Result == b.Result && a.MatchID == b.MatchID
+}
+
+func TestEnvelopeRoundTrip(t *testing.T) {
+	session := testSession()
+	env, err := NewGameScoreRecorded("score_service", session)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, contentType := range []string{ContentTypeJSON, ContentTypeProtobuf} {
+		data, err := Marshal(env, contentType)
+		if err != nil {
+			t.Fatalf("%s: Marshal: %v", contentType, err)
+		}
+		got, err := Unmarshal(data, contentType)
+		if err != nil {
+			t.Fatalf("%s: Unmarshal: %v", contentType, err)
+		}
+
+		if got.SchemaVersion != SchemaVersion || got.EventID != env.EventID || got.EventType != env.EventType ||
+			got.Producer != env.Producer || !got.OccurredAt.Equal(env.OccurredAt) {
+			t.Errorf("%s: envelope = %+v, want %+v", contentType, got, env)
+		}
+
+		gotSession, err := got.GameSession()
+		if err != nil {
+			t.Fatalf("%s: GameSession: %v", contentType, err)
+		}
+		if !equalSessions(gotSession, session) {
+			t.Errorf("%s: session = %+v, want %+v", contentType, gotSession, session)
+		}
+
+		if _, err := got.ScoreVoided(); !errors.Is(err, ErrUnexpectedType) {
+			t.Errorf("%s: ScoreVoided error = %v, want ErrUnexpectedType", contentType, err)
+		}
+	}
+}
+
+func TestDecodeUpgradesLegacy(t *testing.T) {
+	data := []byte(`{"event_type":"game_score_recorded","session":{"session_id":"7f96b996-1c31-11f0-a02a-2a50f1ea084a","user_id":"1","score":100,"game_mode":"classic","timestamp":"2025-04-18T08:45:36.804495Z","client_ip":"[::1]:54289"}}`)
+
+	// Messages without a content type header are JSON
+	env, err := Unmarshal(data, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if env.SchemaVersion != SchemaVersion {
+		t.Errorf("SchemaVersion = %d, want %d", env.SchemaVersion, SchemaVersion)
+	}
+	if env.EventID != "7f96b996-1c31-11f0-a02a-2a50f1ea084a" {
+		t.Errorf("EventID = %q, want the session ID", env.EventID)
+	}
+	if env.EventType != TypeGameScoreRecorded || env.Producer != "legacy" {
+		t.Errorf("EventType, Producer = %q, %q, want %q, %q", env.EventType, env.Producer, TypeGameScoreRecorded, "legacy")
+	}
+
+	session, err := env.GameSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	timestamp := time.Date(2025, 4, 18, 8, 45, 36, 804495000, time.UTC)
+	if session.UserID != "1" || session.Score != 100 || session.GameMode != "classic" || !session.Timestamp.Equal(timestamp) {
+		t.Errorf("session = %+v", session)
+	}
+	if !env.OccurredAt.Equal(timestamp) {
+		t.Errorf("OccurredAt = %v, want %v", env.OccurredAt, timestamp)
+	}
+}
+
+func TestDecodeRejectsUnknownVersions(t *testing.T) {
+	for _, version := range []int{SchemaVersion + 1, 99, -1} {
+		env, err := NewGameScoreRecorded("score_service", testSession())
+		if err != nil {
+			t.Fatal(err)
+		}
+		env.SchemaVersion = version
+
+		for _, contentType := range []string{ContentTypeJSON, ContentTypeProtobuf} {
+			data, err := Marshal(env, contentType)
+			if err != nil {
+				t.Fatalf("%s: Marshal: %v", contentType, err)
+			}
+			if _, err := Unmarshal(data, contentType); !errors.Is(err, ErrUnsupportedVersion) {
+				t.Errorf("%s: version %d: error = %v, want ErrUnsupportedVersion", contentType, version, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,36 @@
+package events
+
+// NotificationsTopic carries the rank notifications published by
+// worker_service. They are always JSON encoded envelopes.
+const NotificationsTopic = "rank-notifications"
+
+// Rank notification types.
+const (
+	TypeTopNEntered       = "top_n_entered"
+	TypeTopNExited        = "top_n_exited"
+	TypeOvertakenByFriend = "overtaken_by_friend"
+	TypePersonalBest      = "personal_best"
+)
+
+// RankNotification is the payload of every rank notification. UserID is the
+// player being notified; OtherUserID is the player who caused the change,
+// when there is one: the friend who overtook them, or the player who pushed
+// them out of the top. SeasonID is set for crossings on a season board
+// rather than the all-time board of GameMode.
+type RankNotification struct {
+	UserID       string  `json:"user_id"`
+	GameMode     string  `json:"game_mode"`
+	SeasonID     string  `json:"season_id,omitempty"`
+	Rank         int64   `json:"rank,omitempty"`
+	PreviousRank int64   `json:"previous_rank,omitempty"`
+	Score        float64 `json:"score"`
+	TopN         int64   `json:"top_n,omitempty"`
+	OtherUserID  string  `json:"other_user_id,omitempty"`
+}
+
+// RankNotification returns the payload of a rank notification.
+func (e Envelope) RankNotification() (RankNotification, error) {
+	var notification RankNotification
+	err := e.decodePayload(&notification, TypeTopNEntered, TypeTopNExited, TypeOvertakenByFriend, TypePersonalBest)
+	return notification, err
+}
@@ -0,0 +1,233 @@
+// Package jwks publishes and fetches the keys of the access tokens signed by
+// users_service.
+//
+// users_service signs tokens with Ed25519 keys (alg EdDSA) and publishes the
+// public keys as a JSON Web Key Set at /.well-known/jwks.json, each with the
+// key ID that tokens carry in their "kid" header. Keys are rotated by adding
+// a new one before signing with it and removing the old one once the tokens
+// it signed have expired. Client caches the set and fetches it again when it
+// gets stale or a token names a key it does not know, at most every
+// minRefreshInterval. Tokens are verified
+// with those keys by package auth.
+package jwks
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	// Issuer is the "iss" claim of the tokens of users_service.
+	Issuer = "users_service"
+	// Audience is the "aud" claim the services accept.
+	Audience = "leaderboard"
+
+	// DefaultURL is where users_service serves the key set locally.
+	DefaultURL = "http://localhost:8084/.well-known/jwks.json"
+
+	// cacheTTL is how long a fetched key set is used.
+	cacheTTL = 10 * time.Minute
+	// minRefreshInterval limits the fetches caused by unknown key IDs.
+	minRefreshInterval = 30 * time.Second
+)
+
+var (
+	// ErrUnknownKey is returned for tokens signed with a key not in the set.
+	ErrUnknownKey = errors.New("jwks: unknown key ID")
+	// ErrUnavailable is returned when the key set could not be fetched, in
+	// which case tokens cannot be told valid or not.
+	ErrUnavailable = errors.New("jwks: key set unavailable")
+)
+
+// Key is an Ed25519 public key in JSON Web Key form.
+type Key struct {
+	Kty string `json:"kty"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Kid string `json:"kid"`
+	Alg string `json:"alg"`
+	Use string `json:"use"`
+}
+
+// Set is a JSON Web Key Set.
+type Set struct {
+	Keys []Key `json:"keys"`
+}
+
+// PublicKey returns the JSON Web Key of pub.
+func PublicKey(kid string, pub ed25519.PublicKey) Key {
+	return Key{
+		Kty: "OKP",
+		Crv: "Ed25519",
+		X:   base64.RawURLEncoding.EncodeToString(pub),
+		Kid: kid,
+		Alg: jwt.SigningMethodEdDSA.Alg(),
+		Use: "sig",
+	}
+}
+
+// Ed25519 decodes the public key of k.
+func (k Key) Ed25519() (ed25519.PublicKey, error) {
+	if k.Kty != "OKP" || k.Crv != "Ed25519" {
+		return nil, fmt.Errorf("jwks: unsupported key type %s/%s", k.Kty, k.Crv)
+	}
+	x, err := base64.RawURLEncoding.DecodeString(k.X)
+	if err != nil {
+		return nil, fmt.Errorf("jwks: decoding key %s: %w", k.Kid, err)
+	}
+	if len(x) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("jwks: key %s has invalid size %d", k.Kid, len(x))
+	}
+	return ed25519.PublicKey(x), nil
+}
+
+// Client fetches and caches the key set published at a URL. Only one fetch
+// runs at a time, without holding up the lookups of known keys: callers
+// needing the set wait for the running fetch, or give up with their
+// context.
+type Client struct {
+	url        string
+	httpClient *http.Client
+
+	mu        sync.Mutex
+	keys      map[string]ed25519.PublicKey
+	fetchedAt time.Time
+	// attemptedAt is when the last fetch started, successful or not.
+	attemptedAt time.Time
+	fetching    *fetchCall
+}
+
+// fetchCall is a fetch of the key set, done once keys and err are set.
+type fetchCall struct {
+	done chan struct{}
+	keys map[string]ed25519.PublicKey
+	err  error
+}
+
+func NewClient(url string) *Client {
+	return &Client{
+		url:        url,
+		httpClient: &http.Client{Timeout: 5 * time.Second},
+	}
+}
+
+// Key returns the public key with ID kid. A known key is returned from the
+// cache, which is refreshed in the background once stale. An unknown one
+// waits for the set to be fetched again, at most every minRefreshInterval
+// so that tokens with made up key IDs cannot make the client hammer
+// users_service. Failed fetches are reported as ErrUnavailable.
+func (c *Client) Key(ctx context.Context, kid string) (ed25519.PublicKey, error) {
+	c.mu.Lock()
+	key, known := c.keys[kid]
+	stale := time.Since(c.fetchedAt) >= cacheTTL
+	canRefresh := time.Since(c.attemptedAt) >= minRefreshInterval
+	var call *fetchCall
+	if c.keys == nil || (stale && canRefresh) || (!known && canRefresh) {
+		call = c.startFetch(ctx)
+	}
+	c.mu.Unlock()
+
+	// Keep using the cached key while the set is refreshed, or while
+	// users_service is unreachable
+	if known {
+		return key, nil
+	}
+	if call == nil {
+		return nil, ErrUnknownKey
+	}
+
+	select {
+	case <-call.done:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	if call.err != nil {
+		return nil, call.err
+	}
+	key, ok := call.keys[kid]
+	if !ok {
+		return nil, ErrUnknownKey
+	}
+	return key, nil
+}
+
+// startFetch returns the running fetch, or starts one. The fetch outlives
+// the cancellation of ctx, as other callers may be waiting for it. The
+// caller must hold c.mu.
+func (c *Client) startFetch(ctx context.Context) *fetchCall {
+	if c.fetching != nil {
+		return c.fetching
+	}
+
+	call := &fetchCall{done: make(chan struct{})}
+	c.fetching = call
+	c.attemptedAt = time.Now()
+	go func() {
+		keys, err := c.fetch(context.WithoutCancel(ctx))
+
+		c.mu.Lock()
+		if err == nil {
+			c.keys = keys
+			c.fetchedAt = time.Now()
+		}
+		call.keys, call.err = c.keys, err
+		c.fetching = nil
+		c.mu.Unlock()
+		close(call.done)
+	}()
+	return call
+}
+
+func (c *Client) fetch(ctx context.Context) (map[string]ed25519.PublicKey, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("%w: fetching key set: %w", ErrUnavailable, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%w: fetching key set: status %d", ErrUnavailable, resp.StatusCode)
+	}
+
+	var set Set
+	if err := json.NewDecoder(resp.Body).Decode(&set); err != nil {
+		return nil, fmt.Errorf("%w: decoding key set: %w", ErrUnavailable, err)
+	}
+
+	keys := make(map[string]ed25519.PublicKey, len(set.Keys))
+	for _, k := range set.Keys {
+		if k.Alg != "" && k.Alg != jwt.SigningMethodEdDSA.Alg() {
+			continue
+		}
+		key, err := k.Ed25519()
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrUnavailable, err)
+		}
+		keys[k.Kid] = key
+	}
+	return keys, nil
+}
+
+// Keyfunc returns the verification key of token, fetching it with ctx, for
+// auth.NewVerifier.
+func (c *Client) Keyfunc(ctx context.Context, token *jwt.Token) (interface{}, error) {
+	kid, _ := token.Header["kid"].(string)
+	if kid == "" {
+		return nil, errors.New("jwks: token has no key ID")
+	}
+	return c.Key(ctx, kid)
+}
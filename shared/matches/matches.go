@@ -0,0 +1,89 @@
+// Package matches defines the match result statistics kept in redis.
+//
+// For sessions carrying a result worker_service counts the games, wins,
+// losses and draws of each player per mode in the StatsKey hash and keeps
+// two boards: WinsBoard, ordered by number of wins, and WinRateBoard,
+// ordered by wins per game. Players only appear on WinRateBoard once they
+// have played the minimum number of games stored in ConfigKey.
+package matches
+
+import (
+	"strconv"
+
+	"shared/events"
+)
+
+// ConfigKey is the redis hash holding the "min_games" a player needs to be
+// ranked by win rate.
+const ConfigKey = "config:winrate_leaderboard"
+
+// DefaultMinGames is the threshold used until ConfigKey is set.
+const DefaultMinGames = 10
+
+// Stats are a player's match results in a mode.
+type Stats struct {
+	Games  int64 `json:"games"`
+	Wins   int64 `json:"wins"`
+	Losses int64 `json:"losses"`
+	Draws  int64 `json:"draws"`
+}
+
+// WinRate returns the share of games won.
+func (s Stats) WinRate() float64 {
+	if s.Games == 0 {
+		return 0
+	}
+	return float64(s.Wins) / float64(s.Games)
+}
+
+// StatsKey returns the hash of a player's results in gameMode.
+func StatsKey(gameMode, userID string) string {
+	return "stats:" + gameMode + ":user:" + userID
+}
+
+// WinsBoard returns the name of the wins board of gameMode, which is stored
+// under "leaderboard:" + WinsBoard.
+func WinsBoard(gameMode string) string {
+	return gameMode + ":wins"
+}
+
+// WinRateBoard returns the name of the win rate board of gameMode.
+func WinRateBoard(gameMode string) string {
+	return gameMode + ":winrate"
+}
+
+// CounterField returns the StatsKey field counting result.
+func CounterField(result string) string {
+	switch result {
+	case events.ResultWin:
+		return "wins"
+	case events.ResultLoss:
+		return "losses"
+	case events.ResultDraw:
+		return "draws"
+	}
+	return ""
+}
+
+// ParseStats decodes a StatsKey hash as returned by HGETALL.
+func ParseStats(fields map[string]string) Stats {
+	parse := func(field string) int64 {
+		v, _ := strconv.ParseInt(fields[field], 10, 64)
+		return v
+	}
+	return Stats{
+		Games:  parse("games"),
+		Wins:   parse("wins"),
+		Losses: parse("losses"),
+		Draws:  parse("draws"),
+	}
+}
+
+// ParseMinGames decodes the min_games field of ConfigKey.
+func ParseMinGames(value string) int64 {
+	minGames, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || minGames < 1 {
+		return DefaultMinGames
+	}
+	return minGames
+}
@@ -0,0 +1,328 @@
+package messaging
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// filePollInterval is how often a file subscriber that reached the end of
+// its topic looks for new messages.
+const filePollInterval = 200 * time.Millisecond
+
+// FileBroker is a transport for local runs that connects separate processes
+// through a directory. Every topic is a single partition stored as the JSON
+// lines file <topic>.jsonl, the offset of a message being its line number,
+// and the offset committed by a consumer group is kept in
+// <topic>.<group>.offset. Like with the in-memory transport, groups without
+// a committed offset start at the first message.
+//
+// Publishers append every batch with a single write, which keeps the lines
+// of concurrent publishers whole on local filesystems.
+type FileBroker struct {
+	dir string
+}
+
+// fileRecord is a message as it is stored in a topic file.
+type fileRecord struct {
+	Key     []byte            `json:"key,omitempty"`
+	Value   []byte            `json:"value"`
+	Headers map[string]string `json:"headers,omitempty"`
+	Time    time.Time         `json:"time"`
+}
+
+// NewFileBroker returns a broker storing its topics in dir, which is created
+// if needed.
+func NewFileBroker(dir string) (*FileBroker, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	return &FileBroker{dir: dir}, nil
+}
+
+func (b *FileBroker) topicPath(topic string) string {
+	return filepath.Join(b.dir, topic+".jsonl")
+}
+
+func (b *FileBroker) offsetPath(topic, groupID string) string {
+	return filepath.Join(b.dir, topic+"."+groupID+".offset")
+}
+
+// Publisher returns a publisher for topic.
+func (b *FileBroker) Publisher(topic string) Publisher {
+	return &filePublisher{path: b.topicPath(topic)}
+}
+
+// Subscriber returns a subscriber that resumes after the last offset
+// committed by groupID on topic.
+func (b *FileBroker) Subscriber(topic, groupID string) Subscriber {
+	return &fileSubscriber{
+		topic:      topic,
+		path:       b.topicPath(topic),
+		offsetPath: b.offsetPath(topic, groupID),
+		closed:     make(chan struct{}),
+	}
+}
+
+// Partitions returns the single partition of every file topic.
+func (b *FileBroker) Partitions(ctx context.Context, topic string) ([]int, error) {
+	return []int{0}, nil
+}
+
+// scan calls fn with the complete lines of topic until it returns false,
+// and returns the offset it stopped at.
+func (b *FileBroker) scan(topic string, fn func(offset int64, record fileRecord) (bool, error)) (int64, error) {
+	f, err := os.Open(b.topicPath(topic))
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	reader := bufio.NewReader(f)
+	var offset int64
+	for {
+		line, err := reader.ReadBytes('\n')
+		if errors.Is(err, io.EOF) {
+			// A line whose write is not complete yet does not count
+			return offset, nil
+		} else if err != nil {
+			return offset, err
+		}
+
+		if fn != nil {
+			var record fileRecord
+			if err := json.Unmarshal(line, &record); err != nil {
+				return offset, fmt.Errorf("%s offset %d: %w", f.Name(), offset, err)
+			}
+			more, err := fn(offset, record)
+			if err != nil || !more {
+				return offset, err
+			}
+		}
+		offset++
+	}
+}
+
+func (b *FileBroker) Offsets(ctx context.Context, topic string, partition int) (int64, int64, error) {
+	last, err := b.scan(topic, nil)
+	return 0, last, err
+}
+
+func (b *FileBroker) OffsetAt(ctx context.Context, topic string, partition int, t time.Time) (int64, error) {
+	return b.scan(topic, func(offset int64, record fileRecord) (bool, error) {
+		return record.Time.Before(t), nil
+	})
+}
+
+// ReadPartition reads topic from offset on.
+func (b *FileBroker) ReadPartition(topic string, partition int, offset int64) (Reader, error) {
+	return &fileSubscriber{
+		topic:  topic,
+		path:   b.topicPath(topic),
+		start:  offset,
+		closed: make(chan struct{}),
+	}, nil
+}
+
+type filePublisher struct {
+	mu   sync.Mutex
+	path string
+}
+
+func (p *filePublisher) Publish(ctx context.Context, msgs ...Message) error {
+	var buf bytes.Buffer
+	now := time.Now()
+	for _, msg := range msgs {
+		line, err := json.Marshal(fileRecord{Key: msg.Key, Value: msg.Value, Headers: msg.Headers, Time: now})
+		if err != nil {
+			return err
+		}
+		buf.Write(line)
+		buf.WriteByte('\n')
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	f, err := os.OpenFile(p.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(buf.Bytes()); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func (p *filePublisher) Close() error {
+	return nil
+}
+
+type fileSubscriber struct {
+	topic string
+	path  string
+	// offsetPath is empty for readers, which start at start rather than at
+	// a committed offset.
+	offsetPath string
+
+	// file and reader are opened by the first Fetch, as the topic may not
+	// exist yet, and skip the lines before start, the committed offset.
+	// next is the offset of the next line of reader, and partial holds the
+	// start of a line whose write is not complete yet.
+	mu      sync.Mutex
+	file    *os.File
+	reader  *bufio.Reader
+	start   int64
+	next    int64
+	partial []byte
+
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+// committed returns the offset committed by the subscriber's group, or 0.
+func (s *fileSubscriber) committed() (int64, error) {
+	if s.offsetPath == "" {
+		return s.start, nil
+	}
+
+	data, err := os.ReadFile(s.offsetPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+}
+
+// readLine returns the next complete line of the topic and its offset, or
+// nil if there is none yet. The caller must hold s.mu.
+func (s *fileSubscriber) readLine() ([]byte, int64, error) {
+	if s.reader == nil {
+		start, err := s.committed()
+		if err != nil {
+			return nil, 0, err
+		}
+
+		f, err := os.Open(s.path)
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, 0, nil
+		} else if err != nil {
+			return nil, 0, err
+		}
+		s.file = f
+		s.reader = bufio.NewReader(f)
+		s.start = start
+	}
+
+	chunk, err := s.reader.ReadBytes('\n')
+	s.partial = append(s.partial, chunk...)
+	if errors.Is(err, io.EOF) {
+		return nil, 0, nil
+	} else if err != nil {
+		return nil, 0, err
+	}
+
+	line, offset := s.partial, s.next
+	s.partial = nil
+	s.next++
+	return line, offset, nil
+}
+
+func (s *fileSubscriber) Fetch(ctx context.Context) (Message, error) {
+	for {
+		msg, ok, err := s.fetch()
+		if err != nil || ok {
+			return msg, err
+		}
+
+		select {
+		case <-ctx.Done():
+			return Message{}, ctx.Err()
+		case <-s.closed:
+			return Message{}, ErrClosed
+		case <-time.After(filePollInterval):
+		}
+	}
+}
+
+// fetch returns the next message from the committed offset on, if one has
+// been published.
+func (s *fileSubscriber) fetch() (Message, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	select {
+	case <-s.closed:
+		return Message{}, false, ErrClosed
+	default:
+	}
+
+	for {
+		line, offset, err := s.readLine()
+		if err != nil || line == nil {
+			return Message{}, false, err
+		}
+		if offset < s.start {
+			continue
+		}
+
+		var record fileRecord
+		if err := json.Unmarshal(line, &record); err != nil {
+			return Message{}, false, fmt.Errorf("%s offset %d: %w", s.path, offset, err)
+		}
+		return Message{
+			Topic:   s.topic,
+			Key:     record.Key,
+			Value:   record.Value,
+			Headers: record.Headers,
+			Offset:  offset,
+			Time:    record.Time,
+		}, true, nil
+	}
+}
+
+// Commit stores the offset after msg, replacing the offset file atomically.
+func (s *fileSubscriber) Commit(ctx context.Context, msg Message) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	committed, err := s.committed()
+	if err != nil {
+		return err
+	}
+	if msg.Offset+1 <= committed {
+		return nil
+	}
+
+	tmp := s.offsetPath + ".tmp"
+	if err := os.WriteFile(tmp, []byte(strconv.FormatInt(msg.Offset+1, 10)), 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.offsetPath)
+}
+
+func (s *fileSubscriber) Close() error {
+	s.closeOnce.Do(func() { close(s.closed) })
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.file != nil {
+		return s.file.Close()
+	}
+	return nil
+}
@@ -0,0 +1,77 @@
+package messaging
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestFileBrokerResumesAfterCommit(t *testing.T) {
+	dir := t.TempDir()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// Separate brokers on the same directory stand in for separate processes
+	producer, err := NewFileBroker(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	consumer, err := NewFileBroker(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sub := consumer.Subscriber("game-sessions", "worker")
+	err = producer.Publisher("game-sessions").Publish(ctx,
+		Message{Key: []byte("1"), Value: []byte(`{"n":1}`), Headers: map[string]string{"content-type": "application/json"}},
+		Message{Key: []byte("2"), Value: []byte(`{"n":2}`)},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	first, err := sub.Fetch(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.Offset != 0 || string(first.Value) != `{"n":1}` || first.Headers["content-type"] != "application/json" {
+		t.Errorf("first message = %+v", first)
+	}
+	if err := sub.Commit(ctx, first); err != nil {
+		t.Fatal(err)
+	}
+	sub.Close()
+
+	// A half written line is only delivered once it is complete
+	f, err := os.OpenFile(consumer.topicPath("game-sessions"), os.O_APPEND|os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := f.WriteString(`{"value":"eyJuIjozfQ==",`); err != nil {
+		t.Fatal(err)
+	}
+
+	sub = consumer.Subscriber("game-sessions", "worker")
+	defer sub.Close()
+	second, err := sub.Fetch(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if second.Offset != 1 || string(second.Value) != `{"n":2}` {
+		t.Errorf("message after the commit = %+v, want offset 1", second)
+	}
+
+	go func() {
+		time.Sleep(2 * filePollInterval)
+		f.WriteString(`"time":"2025-04-18T08:45:36Z"}` + "\n")
+	}()
+	third, err := sub.Fetch(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if third.Offset != 2 || string(third.Value) != `{"n":3}` {
+		t.Errorf("completed message = %+v, want offset 2", third)
+	}
+}
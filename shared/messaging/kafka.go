@@ -0,0 +1,138 @@
+package messaging
+
+import (
+	"context"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// KafkaPublisher publishes messages with segmentio/kafka-go.
+type KafkaPublisher struct {
+	writer *kafka.Writer
+}
+
+func NewKafkaPublisher(brokers []string, topic string) *KafkaPublisher {
+	return &KafkaPublisher{
+		writer: kafka.NewWriter(kafka.WriterConfig{
+			Brokers: brokers,
+			Topic:   topic,
+		}),
+	}
+}
+
+func (p *KafkaPublisher) Publish(ctx context.Context, msgs ...Message) error {
+	kafkaMsgs := make([]kafka.Message, len(msgs))
+	for i, msg := range msgs {
+		kafkaMsgs[i] = kafka.Message{
+			Key:     msg.Key,
+			Value:   msg.Value,
+			Headers: toKafkaHeaders(msg.Headers),
+		}
+	}
+	return p.writer.WriteMessages(ctx, kafkaMsgs...)
+}
+
+func (p *KafkaPublisher) Close() error {
+	return p.writer.Close()
+}
+
+// KafkaSubscriber consumes a topic as a member of a kafka consumer group.
+type KafkaSubscriber struct {
+	reader *kafka.Reader
+}
+
+// NewKafkaSubscriber joins groupID on topic. startOffset (kafka.FirstOffset or
+// kafka.LastOffset) only applies when the group has no committed offset.
+func NewKafkaSubscriber(brokers []string, topic, groupID string, startOffset int64) *KafkaSubscriber {
+	return &KafkaSubscriber{
+		reader: kafka.NewReader(kafka.ReaderConfig{
+			Brokers:     brokers,
+			Topic:       topic,
+			GroupID:     groupID,
+			StartOffset: startOffset,
+		}),
+	}
+}
+
+func (s *KafkaSubscriber) Fetch(ctx context.Context) (Message, error) {
+	msg, err := s.reader.FetchMessage(ctx)
+	if err != nil {
+		return Message{}, err
+	}
+
+	return fromKafkaMessage(msg), nil
+}
+
+func (s *KafkaSubscriber) Commit(ctx context.Context, msg Message) error {
+	return s.reader.CommitMessages(ctx, kafka.Message{
+		Topic:     msg.Topic,
+		Partition: msg.Partition,
+		Offset:    msg.Offset,
+	})
+}
+
+func (s *KafkaSubscriber) Close() error {
+	return s.reader.Close()
+}
+
+// KafkaReader reads a single partition without a consumer group.
+type KafkaReader struct {
+	reader *kafka.Reader
+}
+
+// NewKafkaReader reads partition of topic from offset on.
+func NewKafkaReader(brokers []string, topic string, partition int, offset int64) (*KafkaReader, error) {
+	reader := kafka.NewReader(kafka.ReaderConfig{
+		Brokers:   brokers,
+		Topic:     topic,
+		Partition: partition,
+	})
+	if err := reader.SetOffset(offset); err != nil {
+		reader.Close()
+		return nil, err
+	}
+	return &KafkaReader{reader: reader}, nil
+}
+
+func (r *KafkaReader) Fetch(ctx context.Context) (Message, error) {
+	msg, err := r.reader.ReadMessage(ctx)
+	if err != nil {
+		return Message{}, err
+	}
+	return fromKafkaMessage(msg), nil
+}
+
+func (r *KafkaReader) Close() error {
+	return r.reader.Close()
+}
+
+func fromKafkaMessage(msg kafka.Message) Message {
+	return Message{
+		Topic:     msg.Topic,
+		Key:       msg.Key,
+		Value:     msg.Value,
+		Headers:   fromKafkaHeaders(msg.Headers),
+		Partition: msg.Partition,
+		Offset:    msg.Offset,
+		Time:      msg.Time,
+	}
+}
+
+func toKafkaHeaders(headers map[string]string) []kafka.Header {
+	var kafkaHeaders []kafka.Header
+	for key, value := range headers {
+		kafkaHeaders = append(kafkaHeaders, kafka.Header{Key: key, Value: []byte(value)})
+	}
+	return kafkaHeaders
+}
+
+func fromKafkaHeaders(kafkaHeaders []kafka.Header) map[string]string {
+	if len(kafkaHeaders) == 0 {
+		return nil
+	}
+	headers := make(map[string]string, len(kafkaHeaders))
+	for _, header := range kafkaHeaders {
+		headers[header.Key] = string(header.Value)
+	}
+	return headers
+}
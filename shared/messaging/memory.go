@@ -0,0 +1,174 @@
+package messaging
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrClosed is returned by the in-memory transport once it has been closed.
+var ErrClosed = errors.New("messaging: closed")
+
+// MemoryBroker is an in-process transport for tests and local runs. Every
+// topic has a single partition and keeps all messages, and consumer groups
+// share committed offsets like they do with kafka.
+type MemoryBroker struct {
+	mu     sync.Mutex
+	topics map[string]*memoryTopic
+}
+
+type memoryTopic struct {
+	messages []Message
+	// notify is closed and replaced whenever a message is appended.
+	notify  chan struct{}
+	commits map[string]int64
+}
+
+func NewMemoryBroker() *MemoryBroker {
+	return &MemoryBroker{topics: make(map[string]*memoryTopic)}
+}
+
+// topic returns the named topic, creating it if needed. The caller must hold
+// b.mu.
+func (b *MemoryBroker) topic(name string) *memoryTopic {
+	t, ok := b.topics[name]
+	if !ok {
+		t = &memoryTopic{
+			notify:  make(chan struct{}),
+			commits: make(map[string]int64),
+		}
+		b.topics[name] = t
+	}
+	return t
+}
+
+// Publisher returns a publisher for topic.
+func (b *MemoryBroker) Publisher(topic string) Publisher {
+	return &memoryPublisher{broker: b, topic: topic}
+}
+
+// Subscriber returns a subscriber that resumes after the last offset
+// committed by groupID on topic.
+func (b *MemoryBroker) Subscriber(topic, groupID string) Subscriber {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return &memorySubscriber{
+		broker:  b,
+		topic:   topic,
+		groupID: groupID,
+		next:    b.topic(topic).commits[groupID],
+		closed:  make(chan struct{}),
+	}
+}
+
+// Partitions returns the single partition of every memory topic.
+func (b *MemoryBroker) Partitions(ctx context.Context, topic string) ([]int, error) {
+	return []int{0}, nil
+}
+
+func (b *MemoryBroker) Offsets(ctx context.Context, topic string, partition int) (int64, int64, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return 0, int64(len(b.topic(topic).messages)), nil
+}
+
+func (b *MemoryBroker) OffsetAt(ctx context.Context, topic string, partition int, t time.Time) (int64, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	messages := b.topic(topic).messages
+	for i, msg := range messages {
+		if !msg.Time.Before(t) {
+			return int64(i), nil
+		}
+	}
+	return int64(len(messages)), nil
+}
+
+// ReadPartition reads topic from offset on.
+func (b *MemoryBroker) ReadPartition(topic string, partition int, offset int64) (Reader, error) {
+	return &memorySubscriber{
+		broker: b,
+		topic:  topic,
+		next:   offset,
+		closed: make(chan struct{}),
+	}, nil
+}
+
+type memoryPublisher struct {
+	broker *MemoryBroker
+	topic  string
+}
+
+func (p *memoryPublisher) Publish(ctx context.Context, msgs ...Message) error {
+	p.broker.mu.Lock()
+	defer p.broker.mu.Unlock()
+
+	t := p.broker.topic(p.topic)
+	for _, msg := range msgs {
+		msg.Topic = p.topic
+		msg.Offset = int64(len(t.messages))
+		msg.Time = time.Now()
+		t.messages = append(t.messages, msg)
+	}
+
+	close(t.notify)
+	t.notify = make(chan struct{})
+	return nil
+}
+
+func (p *memoryPublisher) Close() error {
+	return nil
+}
+
+type memorySubscriber struct {
+	broker  *MemoryBroker
+	topic   string
+	groupID string
+	next    int64
+
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+func (s *memorySubscriber) Fetch(ctx context.Context) (Message, error) {
+	for {
+		s.broker.mu.Lock()
+		t := s.broker.topic(s.topic)
+		if s.next < int64(len(t.messages)) {
+			msg := t.messages[s.next]
+			s.next++
+			s.broker.mu.Unlock()
+			return msg, nil
+		}
+		notify := t.notify
+		s.broker.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return Message{}, ctx.Err()
+		case <-s.closed:
+			return Message{}, ErrClosed
+		case <-notify:
+		}
+	}
+}
+
+func (s *memorySubscriber) Commit(ctx context.Context, msg Message) error {
+	s.broker.mu.Lock()
+	defer s.broker.mu.Unlock()
+
+	t := s.broker.topic(s.topic)
+	if msg.Offset+1 > t.commits[s.groupID] {
+		t.commits[s.groupID] = msg.Offset + 1
+	}
+	return nil
+}
+
+func (s *memorySubscriber) Close() error {
+	s.closeOnce.Do(func() { close(s.closed) })
+	return nil
+}
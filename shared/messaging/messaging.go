@@ -0,0 +1,43 @@
+// Package messaging abstracts the message transport between the services so
+// that they do not depend on a concrete broker client.
+package messaging
+
+import (
+	"context"
+	"time"
+)
+
+// Message is a transport independent message. Partition, Offset and Time are
+// filled in by subscribers and ignored when publishing.
+type Message struct {
+	Topic     string
+	Key       []byte
+	Value     []byte
+	Headers   map[string]string
+	Partition int
+	Offset    int64
+	Time      time.Time
+}
+
+// Publisher publishes messages to a single topic.
+type Publisher interface {
+	Publish(ctx context.Context, msgs ...Message) error
+	Close() error
+}
+
+// Subscriber consumes a single topic as a member of a consumer group.
+type Subscriber interface {
+	// Fetch blocks until the next message is available or ctx is done.
+	Fetch(ctx context.Context) (Message, error)
+	// Commit marks msg, and every message before it on the same partition,
+	// as processed by the consumer group.
+	Commit(ctx context.Context, msg Message) error
+	Close() error
+}
+
+// Reader reads a single partition of a topic outside of any consumer group.
+type Reader interface {
+	// Fetch blocks until the next message is available or ctx is done.
+	Fetch(ctx context.Context) (Message, error)
+	Close() error
+}
@@ -0,0 +1,203 @@
+package messaging
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// Transport opens publishers and subscribers on a single broker, and reads
+// partitions directly for tools such as replays.
+type Transport interface {
+	Publisher(topic string) Publisher
+	// Subscriber joins groupID on topic.
+	Subscriber(topic, groupID string) Subscriber
+
+	// Partitions returns the IDs of the partitions of topic.
+	Partitions(ctx context.Context, topic string) ([]int, error)
+	// Offsets returns the first offset of partition still stored and the
+	// offset the next message published to it will get.
+	Offsets(ctx context.Context, topic string, partition int) (first, last int64, err error)
+	// OffsetAt returns the offset of the first message of partition
+	// published at or after t, or the offset the next message will get if
+	// there is none.
+	OffsetAt(ctx context.Context, topic string, partition int, t time.Time) (int64, error)
+	// ReadPartition reads partition from offset on.
+	ReadPartition(topic string, partition int, offset int64) (Reader, error)
+}
+
+// KafkaTransport connects to a kafka cluster. Consumer groups without a
+// committed offset start with the messages published after they join.
+type KafkaTransport struct {
+	Brokers []string
+}
+
+func (t KafkaTransport) Publisher(topic string) Publisher {
+	return NewKafkaPublisher(t.Brokers, topic)
+}
+
+func (t KafkaTransport) Subscriber(topic, groupID string) Subscriber {
+	return NewKafkaSubscriber(t.Brokers, topic, groupID, kafka.LastOffset)
+}
+
+func (t KafkaTransport) Partitions(ctx context.Context, topic string) ([]int, error) {
+	conn, err := kafka.DialContext(ctx, "tcp", t.Brokers[0])
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	partitions, err := conn.ReadPartitions(topic)
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]int, len(partitions))
+	for i, p := range partitions {
+		ids[i] = p.ID
+	}
+	return ids, nil
+}
+
+func (t KafkaTransport) Offsets(ctx context.Context, topic string, partition int) (int64, int64, error) {
+	conn, err := kafka.DialLeader(ctx, "tcp", t.Brokers[0], topic, partition)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer conn.Close()
+
+	return conn.ReadOffsets()
+}
+
+func (t KafkaTransport) OffsetAt(ctx context.Context, topic string, partition int, at time.Time) (int64, error) {
+	conn, err := kafka.DialLeader(ctx, "tcp", t.Brokers[0], topic, partition)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+
+	offset, err := conn.ReadOffset(at)
+	if err != nil {
+		return 0, err
+	}
+	// No message was produced at or after at
+	if offset < 0 {
+		return conn.ReadLastOffset()
+	}
+	return offset, nil
+}
+
+func (t KafkaTransport) ReadPartition(topic string, partition int, offset int64) (Reader, error) {
+	return NewKafkaReader(t.Brokers, topic, partition, offset)
+}
+
+// GroupSeeder is implemented by transports whose consumer groups can take
+// over the offsets committed by another group.
+type GroupSeeder interface {
+	// SeedGroup commits the offsets committed by the group from on topic for
+	// groupID, unless groupID has committed offsets of its own.
+	SeedGroup(ctx context.Context, topic, from, groupID string) error
+}
+
+func (t KafkaTransport) SeedGroup(ctx context.Context, topic, from, groupID string) error {
+	client := &kafka.Client{Addr: kafka.TCP(t.Brokers...)}
+
+	meta, err := client.Metadata(ctx, &kafka.MetadataRequest{Topics: []string{topic}})
+	if err != nil {
+		return err
+	}
+	var partitions []int
+	for _, tp := range meta.Topics {
+		if tp.Error != nil {
+			return tp.Error
+		}
+		for _, p := range tp.Partitions {
+			partitions = append(partitions, p.ID)
+		}
+	}
+
+	committed := func(group string) ([]kafka.OffsetFetchPartition, error) {
+		resp, err := client.OffsetFetch(ctx, &kafka.OffsetFetchRequest{
+			GroupID: group,
+			Topics:  map[string][]int{topic: partitions},
+		})
+		if err != nil {
+			return nil, err
+		}
+		if resp.Error != nil {
+			return nil, resp.Error
+		}
+		return resp.Topics[topic], nil
+	}
+
+	current, err := committed(groupID)
+	if err != nil {
+		return err
+	}
+	for _, p := range current {
+		if p.CommittedOffset >= 0 {
+			return nil
+		}
+	}
+
+	previous, err := committed(from)
+	if err != nil {
+		return err
+	}
+	var commits []kafka.OffsetCommit
+	for _, p := range previous {
+		if p.Error != nil {
+			return p.Error
+		}
+		// Partitions the group never committed report -1
+		if p.CommittedOffset >= 0 {
+			commits = append(commits, kafka.OffsetCommit{Partition: p.Partition, Offset: p.CommittedOffset})
+		}
+	}
+	if len(commits) == 0 {
+		return nil
+	}
+
+	// A group without members accepts commits outside of any generation
+	resp, err := client.OffsetCommit(ctx, &kafka.OffsetCommitRequest{
+		GroupID:      groupID,
+		GenerationID: -1,
+		Topics:       map[string][]kafka.OffsetCommit{topic: commits},
+	})
+	if err != nil {
+		return err
+	}
+	for _, p := range resp.Topics[topic] {
+		if p.Error != nil {
+			return fmt.Errorf("partition %d: %w", p.Partition, p.Error)
+		}
+	}
+	return nil
+}
+
+// defaultQueueDir is where the file transport keeps its topics unless
+// MESSAGE_QUEUE_DIR says otherwise.
+const defaultQueueDir = "../local-data/queue"
+
+// FromEnv returns the transport named by MESSAGE_TRANSPORT: "kafka", the
+// default, at brokers, "file", which connects local processes through the
+// MESSAGE_QUEUE_DIR directory, or "memory", which only connects the
+// publishers and subscribers of this process.
+func FromEnv(brokers []string) (Transport, error) {
+	switch kind := os.Getenv("MESSAGE_TRANSPORT"); kind {
+	case "", "kafka":
+		return KafkaTransport{Brokers: brokers}, nil
+	case "file":
+		dir := os.Getenv("MESSAGE_QUEUE_DIR")
+		if dir == "" {
+			dir = defaultQueueDir
+		}
+		return NewFileBroker(dir)
+	case "memory":
+		return NewMemoryBroker(), nil
+	default:
+		return nil, fmt.Errorf("invalid MESSAGE_TRANSPORT %q, must be 'kafka', 'file' or 'memory'", kind)
+	}
+}
@@ -0,0 +1,273 @@
+// Package mtls secures the internal APIs between services with mutual TLS.
+//
+// Certificates are issued on the fly by a local certificate authority kept
+// in a directory shared by the services, ../certs when they run from their
+// own directories. The first service to start creates the CA. Every service
+// then issues itself a short-lived certificate, named after the service,
+// valid for both serving and calling, and renews it before it expires.
+// Internal listeners only accept clients presenting a certificate of the CA
+// and check the client's name against the services they serve.
+//
+// This is meant for local and test deployments; elsewhere the CA would be
+// managed outside the services and only its certificate distributed.
+package mtls
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"shared/auth"
+)
+
+const (
+	// DefaultDir is the CA directory relative to a service's directory.
+	DefaultDir = "../certs"
+
+	caFile     = "ca.pem"
+	caValidity = 365 * 24 * time.Hour
+
+	certValidity = 24 * time.Hour
+	// renewBefore is how long before expiry a certificate is replaced.
+	renewBefore = time.Hour
+)
+
+// CA is the local certificate authority.
+type CA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pool *x509.CertPool
+}
+
+// LoadOrCreateCA reads the CA of dir, creating it if there is none yet.
+func LoadOrCreateCA(dir string) (*CA, error) {
+	path := filepath.Join(dir, caFile)
+	ca, err := loadCA(path)
+	if err == nil {
+		return ca, nil
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	if err := createCA(dir, path); err != nil {
+		return nil, err
+	}
+	return loadCA(path)
+}
+
+func loadCA(path string) (*CA, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	ca := &CA{pool: x509.NewCertPool()}
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		switch block.Type {
+		case "CERTIFICATE":
+			ca.cert, err = x509.ParseCertificate(block.Bytes)
+		case "EC PRIVATE KEY":
+			ca.key, err = x509.ParseECPrivateKey(block.Bytes)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("mtls: reading %s: %w", path, err)
+		}
+	}
+	if ca.cert == nil || ca.key == nil {
+		return nil, fmt.Errorf("mtls: %s must hold the CA certificate and key", path)
+	}
+
+	ca.pool.AddCert(ca.cert)
+	return ca, nil
+}
+
+// createCA writes a new CA to path. It is written to a temporary file and
+// linked into place, so services starting together agree on one CA.
+func createCA(dir, path string) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          randomSerial(),
+		Subject:               pkix.Name{CommonName: "leaderboard local CA"},
+		NotBefore:             time.Now().Add(-time.Minute),
+		NotAfter:              time.Now().Add(caValidity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return err
+	}
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(dir, "ca-*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	pem.Encode(tmp, &pem.Block{Type: "CERTIFICATE", Bytes: der})
+	pem.Encode(tmp, &pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Link(tmp.Name(), path); err != nil && !errors.Is(err, os.ErrExist) {
+		return err
+	}
+	return nil
+}
+
+func randomSerial() *big.Int {
+	serial, _ := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 127))
+	return serial
+}
+
+// issue creates a certificate for the service name, valid for localhost.
+func (ca *CA) issue(name string) (*tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: randomSerial(),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     time.Now().Add(certValidity),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		DNSNames:     []string{"localhost", name},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		return nil, err
+	}
+
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+
+	return &tls.Certificate{
+		Certificate: [][]byte{der},
+		PrivateKey:  key,
+		Leaf:        leaf,
+	}, nil
+}
+
+// Identity is the certificate of a service, renewed before it expires.
+type Identity struct {
+	ca   *CA
+	name string
+
+	mu   sync.Mutex
+	cert *tls.Certificate
+}
+
+// NewIdentity issues the first certificate of the service name.
+func NewIdentity(ca *CA, name string) (*Identity, error) {
+	id := &Identity{ca: ca, name: name}
+	if _, err := id.certificate(); err != nil {
+		return nil, err
+	}
+	return id, nil
+}
+
+func (id *Identity) certificate() (*tls.Certificate, error) {
+	id.mu.Lock()
+	defer id.mu.Unlock()
+
+	if id.cert == nil || time.Until(id.cert.Leaf.NotAfter) < renewBefore {
+		cert, err := id.ca.issue(id.name)
+		if err != nil {
+			return nil, fmt.Errorf("mtls: issuing certificate for %s: %w", id.name, err)
+		}
+		id.cert = cert
+	}
+	return id.cert, nil
+}
+
+// ServerConfig returns the TLS config of an internal listener, which
+// requires clients to present a certificate of the CA.
+func (id *Identity) ServerConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		ClientAuth: tls.RequireAndVerifyClientCert,
+		ClientCAs:  id.ca.pool,
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return id.certificate()
+		},
+	}
+}
+
+// ClientConfig returns the TLS config of a client calling internal APIs.
+func (id *Identity) ClientConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		RootCAs:    id.ca.pool,
+		GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return id.certificate()
+		},
+	}
+}
+
+// HTTPClient returns a client presenting the certificate of id.
+func (id *Identity) HTTPClient(timeout time.Duration) *http.Client {
+	return &http.Client{
+		Timeout:   timeout,
+		Transport: &http.Transport{TLSClientConfig: id.ClientConfig()},
+	}
+}
+
+// RequireClient only lets through requests whose verified client certificate
+// names one of clients.
+func RequireClient(clients ...string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+				auth.Unauthorized(w, "client certificate required")
+				return
+			}
+
+			name := r.TLS.VerifiedChains[0][0].Subject.CommonName
+			for _, client := range clients {
+				if name == client {
+					next.ServeHTTP(w, r)
+					return
+				}
+			}
+			auth.Forbidden(w, "client not allowed")
+		})
+	}
+}
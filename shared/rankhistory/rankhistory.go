@@ -0,0 +1,44 @@
+// Package rankhistory defines how players' ranks over time are kept in redis.
+//
+// worker_service's snapshotter records a Point per player and board at a
+// fixed interval, in a sorted set scored by the unix time of the snapshot.
+// To keep the history small a point is only recorded for players in the top
+// of the board or whose rank or score changed since their last point, so a
+// player's rank between two points is that of the earlier one.
+package rankhistory
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// Point is a player's rank and score on a board at a snapshot.
+type Point struct {
+	Time  time.Time `json:"time"`
+	Rank  int64     `json:"rank"`
+	Score float64   `json:"score"`
+}
+
+// Key returns the sorted set holding the points of a player on a board.
+func Key(board, userID string) string {
+	return "rankhistory:" + board + ":user:" + userID
+}
+
+// LastKey returns the hash holding the last recorded rank and score of every
+// player on a board, keyed by player key.
+func LastKey(board string) string {
+	return "rankhistory:" + board + ":last"
+}
+
+// Encode returns the sorted set member of p.
+func Encode(p Point) (string, error) {
+	data, err := json.Marshal(p)
+	return string(data), err
+}
+
+// Decode parses a sorted set member written by Encode.
+func Decode(member string) (Point, error) {
+	var p Point
+	err := json.Unmarshal([]byte(member), &p)
+	return p, err
+}
@@ -0,0 +1,218 @@
+// Package ratings implements Glicko-2 skill ratings for match results.
+//
+// worker_service rates every session that carries a result against its
+// opponents, treating the session as a rating period of its own, and keeps
+// each player's rating in the Key hash and on the Board of the mode. A
+// player's deviation grows back towards DefaultDeviation for every
+// RatingPeriod they do not play.
+//
+// See http://www.glicko.net/glicko/glicko2.pdf for the algorithm.
+package ratings
+
+import (
+	"math"
+	"strconv"
+	"time"
+
+	"shared/events"
+)
+
+const (
+	DefaultRating     = 1500.0
+	DefaultDeviation  = 350.0
+	DefaultVolatility = 0.06
+
+	// RatingPeriod is the inactivity after which a deviation grows by one
+	// period's worth of volatility.
+	RatingPeriod = 24 * time.Hour
+
+	// tau constrains the change in volatility over time.
+	tau = 0.5
+	// scale converts between the Glicko and Glicko-2 scales.
+	scale = 173.7178
+	// epsilon is the convergence tolerance of the volatility iteration.
+	epsilon = 0.000001
+)
+
+// Rating is a player's Glicko-2 rating on the Glicko scale.
+type Rating struct {
+	Rating     float64   `json:"rating"`
+	Deviation  float64   `json:"deviation"`
+	Volatility float64   `json:"volatility"`
+	Games      int64     `json:"games"`
+	UpdatedAt  time.Time `json:"updated_at"`
+}
+
+// Outcome is a game against an opponent: Score is 1 for a win, 0.5 for a
+// draw and 0 for a loss.
+type Outcome struct {
+	Opponent Rating
+	Score    float64
+}
+
+// New returns the rating of a player who has not played yet.
+func New() Rating {
+	return Rating{
+		Rating:     DefaultRating,
+		Deviation:  DefaultDeviation,
+		Volatility: DefaultVolatility,
+	}
+}
+
+// Key returns the hash holding a player's rating in gameMode.
+func Key(gameMode, userID string) string {
+	return "rating:" + gameMode + ":user:" + userID
+}
+
+// Board returns the name of the rating board of gameMode, which is stored
+// under "leaderboard:" + Board.
+func Board(gameMode string) string {
+	return gameMode + ":rating"
+}
+
+// Score returns the outcome score of a match result.
+func Score(result string) float64 {
+	switch result {
+	case events.ResultWin:
+		return 1
+	case events.ResultDraw:
+		return 0.5
+	}
+	return 0
+}
+
+// At returns the rating at t, with the deviation grown for every full
+// rating period without games since UpdatedAt.
+func (r Rating) At(t time.Time) Rating {
+	if r.UpdatedAt.IsZero() {
+		return r
+	}
+
+	periods := math.Floor(t.Sub(r.UpdatedAt).Seconds() / RatingPeriod.Seconds())
+	if periods <= 0 {
+		return r
+	}
+
+	phi := r.Deviation / scale
+	phi = math.Sqrt(phi*phi + periods*r.Volatility*r.Volatility)
+	r.Deviation = math.Min(phi*scale, DefaultDeviation)
+	return r
+}
+
+func g(phi float64) float64 {
+	return 1 / math.Sqrt(1+3*phi*phi/(math.Pi*math.Pi))
+}
+
+func expected(mu, muJ, phiJ float64) float64 {
+	return 1 / (1 + math.Exp(-g(phiJ)*(mu-muJ)))
+}
+
+// Update returns the rating of player after a rating period with outcomes.
+// The player's rating should already be brought up to date with At.
+func Update(player Rating, outcomes []Outcome) Rating {
+	if len(outcomes) == 0 {
+		return player
+	}
+
+	mu := (player.Rating - DefaultRating) / scale
+	phi := player.Deviation / scale
+	sigma := player.Volatility
+
+	var vInv, sum float64
+	for _, o := range outcomes {
+		muJ := (o.Opponent.Rating - DefaultRating) / scale
+		phiJ := o.Opponent.Deviation / scale
+		e := expected(mu, muJ, phiJ)
+		vInv += g(phiJ) * g(phiJ) * e * (1 - e)
+		sum += g(phiJ) * (o.Score - e)
+	}
+	v := 1 / vInv
+	delta := v * sum
+
+	sigma = newVolatility(phi, sigma, v, delta)
+
+	phiStar := math.Sqrt(phi*phi + sigma*sigma)
+	phi = 1 / math.Sqrt(1/(phiStar*phiStar)+1/v)
+	mu += phi * phi * sum
+
+	player.Rating = mu*scale + DefaultRating
+	player.Deviation = phi * scale
+	player.Volatility = sigma
+	player.Games += int64(len(outcomes))
+	return player
+}
+
+// newVolatility solves for the new volatility with the Illinois algorithm,
+// step 5 of the Glicko-2 paper.
+func newVolatility(phi, sigma, v, delta float64) float64 {
+	a := math.Log(sigma * sigma)
+	f := func(x float64) float64 {
+		ex := math.Exp(x)
+		d := phi*phi + v + ex
+		return ex*(delta*delta-phi*phi-v-ex)/(2*d*d) - (x-a)/(tau*tau)
+	}
+
+	A := a
+	var B float64
+	if delta*delta > phi*phi+v {
+		B = math.Log(delta*delta - phi*phi - v)
+	} else {
+		k := 1.0
+		for f(a-k*tau) < 0 {
+			k++
+		}
+		B = a - k*tau
+	}
+
+	fA, fB := f(A), f(B)
+	for math.Abs(B-A) > epsilon {
+		C := A + (A-B)*fA/(fB-fA)
+		fC := f(C)
+		if fC*fB <= 0 {
+			A, fA = B, fB
+		} else {
+			fA /= 2
+		}
+		B, fB = C, fC
+	}
+
+	return math.Exp(A / 2)
+}
+
+// Parse decodes a Key hash as returned by HGETALL. It returns false if the
+// player has no rating yet.
+func Parse(fields map[string]string) (Rating, bool) {
+	if len(fields) == 0 {
+		return New(), false
+	}
+
+	parse := func(field string, fallback float64) float64 {
+		v, err := strconv.ParseFloat(fields[field], 64)
+		if err != nil {
+			return fallback
+		}
+		return v
+	}
+
+	r := Rating{
+		Rating:     parse("rating", DefaultRating),
+		Deviation:  parse("deviation", DefaultDeviation),
+		Volatility: parse("volatility", DefaultVolatility),
+	}
+	r.Games, _ = strconv.ParseInt(fields["games"], 10, 64)
+	if updatedAt, err := strconv.ParseInt(fields["updated_at"], 10, 64); err == nil {
+		r.UpdatedAt = time.Unix(updatedAt, 0).UTC()
+	}
+	return r, true
+}
+
+// Fields returns the Key hash fields of r, for HSET.
+func (r Rating) Fields() []interface{} {
+	return []interface{}{
+		"rating", r.Rating,
+		"deviation", r.Deviation,
+		"volatility", r.Volatility,
+		"games", r.Games,
+		"updated_at", r.UpdatedAt.Unix(),
+	}
+}
@@ -0,0 +1,80 @@
+// Package recent defines the recency-weighted leaderboards.
+//
+// On a recent board a session's score decays exponentially, halving every
+// HalfLife. Rather than rewriting the board periodically, worker_service
+// adds every score multiplied by Weight, which doubles every HalfLife after
+// Epoch. All members' stored values then share the growing factor, so the
+// board is ordered by decayed score at any time, and the decayed score is
+// the stored value divided by the weight of the current time.
+//
+// The weights grow without bound, so worker_service moves Epoch forward,
+// rescaling the boards, before they get too large for a float64.
+package recent
+
+import (
+	"errors"
+	"math"
+	"strconv"
+	"time"
+)
+
+// ConfigKey is the redis hash holding the half-life and epoch, both in unix
+// seconds, as the fields "half_life" and "epoch".
+const ConfigKey = "config:recent_leaderboard"
+
+// ErrNotConfigured is returned by Parse when the config hash is empty.
+var ErrNotConfigured = errors.New("recent: leaderboard is not configured")
+
+// Config is the weighting shared by every recent board.
+type Config struct {
+	HalfLife time.Duration
+	Epoch    time.Time
+}
+
+// Board returns the name of the recent board of gameMode, which is stored
+// under "leaderboard:" + Board.
+func Board(gameMode string) string {
+	return gameMode + ":recent"
+}
+
+// LeaderboardKey returns the redis key of the recent board of gameMode.
+func LeaderboardKey(gameMode string) string {
+	return "leaderboard:" + Board(gameMode)
+}
+
+// Parse decodes the fields of the ConfigKey hash, as returned by HGETALL.
+func Parse(fields map[string]string) (Config, error) {
+	if len(fields) == 0 {
+		return Config{}, ErrNotConfigured
+	}
+
+	halfLife, err := strconv.ParseFloat(fields["half_life"], 64)
+	if err != nil || halfLife <= 0 {
+		return Config{}, errors.New("recent: invalid half_life")
+	}
+	epoch, err := strconv.ParseInt(fields["epoch"], 10, 64)
+	if err != nil {
+		return Config{}, errors.New("recent: invalid epoch")
+	}
+
+	return Config{
+		HalfLife: time.Duration(halfLife * float64(time.Second)),
+		Epoch:    time.Unix(epoch, 0),
+	}, nil
+}
+
+// HalfLives returns the number of half-lives between Epoch and t.
+func (c Config) HalfLives(t time.Time) float64 {
+	return t.Sub(c.Epoch).Seconds() / c.HalfLife.Seconds()
+}
+
+// Weight returns the factor a score of a session played at t is stored
+// with.
+func (c Config) Weight(t time.Time) float64 {
+	return math.Exp2(c.HalfLives(t))
+}
+
+// Decayed returns the decayed score at t of a stored value.
+func (c Config) Decayed(stored float64, t time.Time) float64 {
+	return stored / c.Weight(t)
+}
@@ -0,0 +1,40 @@
+// Package revocation records revoked access tokens in redis.
+//
+// users_service revokes an access token on logout, or when the refresh
+// token family it was issued with is revoked, by setting Key of its "jti"
+// claim until the token would have expired anyway. score_service and
+// ranking_service reject tokens whose Key exists.
+package revocation
+
+import (
+	"context"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Key returns the redis key marking the access token with ID jti as revoked.
+func Key(jti string) string {
+	return "revoked:jti:" + jti
+}
+
+// Store revokes tokens and checks for revoked ones. It implements
+// auth.RevocationChecker.
+type Store struct {
+	client *redis.Client
+}
+
+func NewStore(client *redis.Client) *Store {
+	return &Store{client: client}
+}
+
+// Revoke marks the token with ID jti as revoked for ttl, which should cover
+// the rest of its lifetime.
+func (s *Store) Revoke(ctx context.Context, jti string, ttl time.Duration) error {
+	return s.client.Set(ctx, Key(jti), 1, ttl).Err()
+}
+
+func (s *Store) IsRevoked(ctx context.Context, jti string) (bool, error) {
+	n, err := s.client.Exists(ctx, Key(jti)).Result()
+	return n > 0, err
+}
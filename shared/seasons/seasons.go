@@ -0,0 +1,115 @@
+// Package seasons defines the seasons leaderboards are split into.
+//
+// Seasons are stored as JSON in the redis hash Key, keyed by season ID. They
+// are managed through ranking_service's admin API and read by worker_service,
+// which adds every session to the board of the season covering it, next to
+// the all-time board of its mode.
+package seasons
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// Key is the redis hash holding every season.
+const Key = "seasons"
+
+// Season is a time window, [Start, End), over a set of game modes.
+type Season struct {
+	ID    string    `json:"id"`
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+	Modes []string  `json:"modes"`
+
+	// ArchivedAt is set once the final standings have been archived. An
+	// archived season no longer accepts scores.
+	ArchivedAt *time.Time `json:"archived_at,omitempty"`
+}
+
+// Board returns the name of the season's board for gameMode, which is
+// stored under "leaderboard:" + Board.
+func Board(gameMode, seasonID string) string {
+	return gameMode + ":season:" + seasonID
+}
+
+// LeaderboardKey returns the redis key of the season's board for gameMode.
+func LeaderboardKey(gameMode, seasonID string) string {
+	return "leaderboard:" + Board(gameMode, seasonID)
+}
+
+// Validate checks that the season is complete.
+func (s Season) Validate() error {
+	if s.ID == "" {
+		return errors.New("id is required")
+	}
+	if s.Start.IsZero() || s.End.IsZero() {
+		return errors.New("start and end are required")
+	}
+	if !s.End.After(s.Start) {
+		return errors.New("end must be after start")
+	}
+	if len(s.Modes) == 0 {
+		return errors.New("at least one mode is required")
+	}
+	return nil
+}
+
+// HasMode reports whether the season includes gameMode.
+func (s Season) HasMode(gameMode string) bool {
+	for _, mode := range s.Modes {
+		if mode == gameMode {
+			return true
+		}
+	}
+	return false
+}
+
+// Covers reports whether a session of gameMode played at t counts towards
+// the season.
+func (s Season) Covers(gameMode string, t time.Time) bool {
+	return s.HasMode(gameMode) && !t.Before(s.Start) && t.Before(s.End)
+}
+
+// Overlaps reports whether the two seasons share a mode and a point in time.
+func (s Season) Overlaps(other Season) bool {
+	if !s.Start.Before(other.End) || !other.Start.Before(s.End) {
+		return false
+	}
+	for _, mode := range s.Modes {
+		if other.HasMode(mode) {
+			return true
+		}
+	}
+	return false
+}
+
+// Parse decodes the fields of the Key hash, as returned by HGETALL, into
+// seasons ordered by start.
+func Parse(fields map[string]string) ([]Season, error) {
+	list := make([]Season, 0, len(fields))
+	for id, data := range fields {
+		var season Season
+		if err := json.Unmarshal([]byte(data), &season); err != nil {
+			return nil, fmt.Errorf("seasons: decoding season %q: %w", id, err)
+		}
+		list = append(list, season)
+	}
+
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Start.Before(list[j].Start)
+	})
+	return list, nil
+}
+
+// Current returns the season of gameMode running at t, if there is one.
+func Current(list []Season, gameMode string, t time.Time) (Season, bool) {
+	for _, season := range list {
+		if season.Covers(gameMode, t) {
+			return season, true
+		}
+	}
+	return Season{}, false
+}
@@ -0,0 +1,318 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+	"userservice/models"
+
+	"github.com/lib/pq"
+	"golang.org/x/crypto/bcrypt"
+	"shared/auth"
+)
+
+const (
+	resetTokenTTL = 30 * time.Minute
+	// resetCooldown is how often a reset token is sent to the same user.
+	resetCooldown = time.Minute
+)
+
+var errInvalidResetToken = errors.New("invalid or expired reset token")
+
+func resetCooldownKey(userID int) string {
+	return "password_reset:cooldown:" + strconv.Itoa(userID)
+}
+
+// setPassword replaces the password of userID and revokes all the user's
+// refresh tokens, returning the access tokens to revoke once committed.
+func setPassword(ctx context.Context, tx *sql.Tx, userID int, password string) ([]string, error) {
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := tx.ExecContext(ctx,
+		"UPDATE users SET password = $1 WHERE id = $2",
+		string(hashedPassword), userID,
+	); err != nil {
+		return nil, err
+	}
+	return revokeUserSessions(ctx, tx, userID)
+}
+
+// changePasswordHandler changes the password of the authenticated user
+// given their current one. Every session of the user is signed out and the
+// caller gets the tokens of a new one.
+func changePasswordHandler(w http.ResponseWriter, r *http.Request) {
+	claims, _ := auth.FromContext(r.Context())
+
+	var req models.ChangePasswordRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request format", http.StatusBadRequest)
+		return
+	}
+
+	var user models.User
+	err := db.QueryRowContext(r.Context(),
+		"SELECT id, username, password, roles FROM users WHERE id = $1",
+		claims.UserID,
+	).Scan(&user.ID, &user.Username, &user.Password, pq.Array(&user.Roles))
+	if err == sql.ErrNoRows {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Printf("Database error during password change: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	// Guessing the current password is throttled like logins
+	attempt, retryAfter, err := newLoginGuard(r, user.Username).reserve(r.Context())
+	if err != nil {
+		log.Printf("Error checking login lockout: %v", err)
+		http.Error(w, "Password change temporarily unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	if retryAfter > 0 {
+		tooManyAttempts(w, retryAfter)
+		return
+	}
+
+	if err := bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(req.CurrentPassword)); err != nil {
+		attempt.fail("wrong_password")
+		var errs models.ValidationErrors
+		errs.Add("current_password", "is incorrect")
+		writeValidationErrors(w, errs)
+		return
+	}
+	if err := attempt.succeed(r.Context()); err != nil {
+		log.Printf("Error clearing failed logins: %v", err)
+	}
+
+	errs := passwords.validate("new_password", user.Username, req.NewPassword)
+	if len(errs) == 0 && req.NewPassword == req.CurrentPassword {
+		errs.Add("new_password", "must differ from the current password")
+	}
+	if len(errs) > 0 {
+		writeValidationErrors(w, errs)
+		return
+	}
+
+	familyID, err := randomHex(16)
+	if err != nil {
+		log.Printf("Error generating token family: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	tx, err := db.BeginTx(r.Context(), nil)
+	if err != nil {
+		log.Printf("Error starting password change transaction: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	jtis, err := setPassword(r.Context(), tx, user.ID, req.NewPassword)
+	if err != nil {
+		log.Printf("Error changing password: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	resp, err := issueTokens(r.Context(), tx, user, familyID)
+	if err != nil {
+		log.Printf("Error generating tokens: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		log.Printf("Error committing password change: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	if err := revokeAccessTokens(r.Context(), append(jtis, claims.ID)); err != nil {
+		log.Printf("Error revoking access tokens: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("Password of user %d changed", user.ID)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// requestPasswordResetHandler sends a reset token to the user through the
+// notifier. It answers the same whether the user exists or not, before
+// looking them up, so that it reveals neither by content nor by timing.
+func requestPasswordResetHandler(w http.ResponseWriter, r *http.Request) {
+	var req models.PasswordResetRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Username == "" {
+		http.Error(w, "Invalid request format", http.StatusBadRequest)
+		return
+	}
+
+	go func(username string) {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		if err := sendPasswordReset(ctx, username); err != nil {
+			log.Printf("Error sending password reset: %v", err)
+		}
+	}(models.NormalizeUsername(req.Username))
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	w.Write([]byte(`{"message": "If the account exists, a reset token has been sent"}`))
+}
+
+// sendPasswordReset replaces the unused reset tokens of username with a new
+// one and sends it, at most once per resetCooldown.
+func sendPasswordReset(ctx context.Context, username string) error {
+	var user models.User
+	err := db.QueryRowContext(ctx,
+		"SELECT id, username FROM users WHERE LOWER(username) = LOWER($1)",
+		username,
+	).Scan(&user.ID, &user.Username)
+	if err == sql.ErrNoRows {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	sent, err := rdb.SetNX(ctx, resetCooldownKey(user.ID), 1, resetCooldown).Result()
+	if err != nil {
+		return err
+	}
+	if !sent {
+		log.Printf("Password reset for user %d requested again within %s, not sent", user.ID, resetCooldown)
+		return nil
+	}
+
+	token, err := randomToken()
+	if err != nil {
+		return err
+	}
+	expiresAt := time.Now().Add(resetTokenTTL)
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx,
+		"DELETE FROM password_reset_tokens WHERE user_id = $1 AND used_at IS NULL",
+		user.ID,
+	); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx,
+		"INSERT INTO password_reset_tokens (user_id, token_hash, expires_at) VALUES ($1, $2, $3)",
+		user.ID, hashToken(token), expiresAt,
+	); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	return notifier.PasswordReset(ctx, user, token, expiresAt)
+}
+
+// resetPasswordHandler sets a new password with a reset token, which can
+// only be used once. Every session of the user is signed out.
+func resetPasswordHandler(w http.ResponseWriter, r *http.Request) {
+	var req models.ResetPasswordRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Token == "" {
+		http.Error(w, "Invalid request format", http.StatusBadRequest)
+		return
+	}
+
+	tx, err := db.BeginTx(r.Context(), nil)
+	if err != nil {
+		log.Printf("Error starting password reset transaction: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	user, err := useResetToken(r.Context(), tx, req.Token)
+	if err == errInvalidResetToken {
+		http.Error(w, "Invalid or expired reset token", http.StatusBadRequest)
+		return
+	} else if err != nil {
+		log.Printf("Database error during password reset: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	if errs := passwords.validate("new_password", user.Username, req.NewPassword); len(errs) > 0 {
+		writeValidationErrors(w, errs)
+		return
+	}
+
+	jtis, err := setPassword(r.Context(), tx, user.ID, req.NewPassword)
+	if err != nil {
+		log.Printf("Error resetting password: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		log.Printf("Error committing password reset: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	if err := revokeAccessTokens(r.Context(), jtis); err != nil {
+		log.Printf("Error revoking access tokens: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if err := clearLoginFailures(r.Context(), user.Username); err != nil {
+		log.Printf("Error clearing failed logins: %v", err)
+	}
+
+	log.Printf("Password of user %d reset", user.ID)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// useResetToken marks a valid reset token used and returns its user. The
+// token stays unused if the transaction is rolled back.
+func useResetToken(ctx context.Context, tx *sql.Tx, token string) (models.User, error) {
+	var (
+		id        int64
+		user      models.User
+		expiresAt time.Time
+		usedAt    sql.NullTime
+	)
+	err := tx.QueryRowContext(ctx,
+		`SELECT prt.id, u.id, u.username, prt.expires_at, prt.used_at
+		FROM password_reset_tokens prt JOIN users u ON u.id = prt.user_id
+		WHERE prt.token_hash = $1
+		FOR UPDATE OF prt`,
+		hashToken(token),
+	).Scan(&id, &user.ID, &user.Username, &expiresAt, &usedAt)
+	if err == sql.ErrNoRows {
+		return models.User{}, errInvalidResetToken
+	} else if err != nil {
+		return models.User{}, err
+	}
+
+	if usedAt.Valid || time.Now().After(expiresAt) {
+		return models.User{}, errInvalidResetToken
+	}
+
+	if _, err := tx.ExecContext(ctx, "UPDATE password_reset_tokens SET used_at = NOW() WHERE id = $1", id); err != nil {
+		return models.User{}, err
+	}
+	return user, nil
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"os"
+
+	"github.com/gorilla/mux"
+	"shared/auth"
+	"shared/mtls"
+)
+
+// serveInternal serves the API other services call on its own listener,
+// which only accepts clients with a certificate of the local CA named after
+// one of the service clients. Requests still need a service token.
+func serveInternal() {
+	certsDir := os.Getenv("INTERNAL_CERTS_DIR")
+	if certsDir == "" {
+		certsDir = mtls.DefaultDir
+	}
+	ca, err := mtls.LoadOrCreateCA(certsDir)
+	if err != nil {
+		log.Fatalf("Failed to load internal CA: %v", err)
+	}
+	identity, err := mtls.NewIdentity(ca, "users_service")
+	if err != nil {
+		log.Fatalf("Failed to issue internal certificate: %v", err)
+	}
+
+	clients := make([]string, 0, len(serviceClients))
+	for id := range serviceClients {
+		clients = append(clients, id)
+	}
+
+	r := mux.NewRouter()
+	r.Use(mtls.RequireClient(clients...), verifier.Middleware)
+
+	internalOnly := auth.RequireRole(auth.RoleService, auth.RoleAdmin)
+	r.Handle("/v1/UserInfo", internalOnly(http.HandlerFunc(getUserInfo))).Methods("POST")
+
+	port := os.Getenv("INTERNAL_PORT")
+	if port == "" {
+		port = "8443"
+	}
+
+	server := &http.Server{
+		Addr:      ":" + port,
+		Handler:   r,
+		TLSConfig: identity.ServerConfig(),
+	}
+
+	log.Printf("internal API listening with mTLS on port %s\n", port)
+	log.Fatal(server.ListenAndServeTLS("", ""))
+}
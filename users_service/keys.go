@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"shared/jwks"
+)
+
+// signingKeys are the Ed25519 keys in the keys directory, one PEM encoded
+// PKCS #8 private key per <kid>.pem file. Every key is published in the key
+// set and the last by key ID signs new tokens, so a key is rotated in by
+// adding a file with a later ID, e.g. the date, and rotated out by removing
+// it once the tokens it signed have expired.
+type signingKeys struct {
+	keys      map[string]ed25519.PrivateKey
+	activeKid string
+}
+
+var keys *signingKeys
+
+// loadSigningKeys reads the keys of dir, generating one if there is none.
+func loadSigningKeys(dir string) (*signingKeys, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+
+	paths, err := filepath.Glob(filepath.Join(dir, "*.pem"))
+	if err != nil {
+		return nil, err
+	}
+
+	if len(paths) == 0 {
+		path, err := generateSigningKey(dir)
+		if err != nil {
+			return nil, err
+		}
+		log.Printf("Generated signing key %s", path)
+		paths = []string{path}
+	}
+
+	sk := &signingKeys{keys: make(map[string]ed25519.PrivateKey)}
+	var kids []string
+	for _, path := range paths {
+		kid := strings.TrimSuffix(filepath.Base(path), ".pem")
+		key, err := readSigningKey(path)
+		if err != nil {
+			return nil, fmt.Errorf("reading signing key %s: %w", path, err)
+		}
+		sk.keys[kid] = key
+		kids = append(kids, kid)
+	}
+
+	sort.Strings(kids)
+	sk.activeKid = kids[len(kids)-1]
+	return sk, nil
+}
+
+func readSigningKey(path string) (ed25519.PrivateKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM data")
+	}
+
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	edKey, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, errors.New("not an Ed25519 key")
+	}
+	return edKey, nil
+}
+
+// generateSigningKey writes a new key to dir, named after the current date.
+func generateSigningKey(dir string) (string, error) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return "", err
+	}
+
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return "", err
+	}
+
+	path := filepath.Join(dir, time.Now().UTC().Format("20060102T150405")+".pem")
+	data := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+	return path, os.WriteFile(path, data, 0o600)
+}
+
+// sign signs claims with the active key.
+func (sk *signingKeys) sign(claims jwt.MapClaims) (string, error) {
+	token := jwt.NewWithClaims(jwt.SigningMethodEdDSA, claims)
+	token.Header["kid"] = sk.activeKid
+	return token.SignedString(sk.keys[sk.activeKid])
+}
+
+// keyfunc returns the public key of a token signed by this service.
+func (sk *signingKeys) keyfunc(ctx context.Context, token *jwt.Token) (interface{}, error) {
+	kid, _ := token.Header["kid"].(string)
+	key, ok := sk.keys[kid]
+	if !ok {
+		return nil, jwks.ErrUnknownKey
+	}
+	return key.Public(), nil
+}
+
+func jwksHandler(w http.ResponseWriter, r *http.Request) {
+	set := jwks.Set{Keys: []jwks.Key{}}
+	for kid, key := range keys.keys {
+		set.Keys = append(set.Keys, jwks.PublicKey(kid, key.Public().(ed25519.PublicKey)))
+	}
+	sort.Slice(set.Keys, func(i, j int) bool { return set.Keys[i].Kid < set.Keys[j].Kid })
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	json.NewEncoder(w).Encode(set)
+}
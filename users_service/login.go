@@ -0,0 +1,306 @@
+package main
+
+import (
+	"context"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/redis/go-redis/v9"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Failed logins are counted per username and IP pair and per client IP.
+// After the free attempts of a scope, every further failure locks it for
+// twice as long as the previous one, from a second up to maxLockout. A
+// locked pair or IP is refused before its password is checked, and every
+// other attempt is counted as a failure before its password is checked,
+// atomically with the lock check. Counts are forgotten once a scope has had
+// no failure for failureWindow, and a successful login clears the counts of
+// its username.
+//
+// Failures of a username from any IP are counted too, but only slow its
+// logins down, from baseLockout doubling up to maxUserDelay, rather than
+// lock it: a lock would let anyone keep its owner out by failing on
+// purpose, while the delay still caps guesses spread over many IPs.
+const (
+	freePairAttempts = 5
+	freeIPAttempts   = 20
+	freeUserAttempts = 10
+	baseLockout      = time.Second
+	maxLockout       = 15 * time.Minute
+	maxUserDelay     = 10 * time.Second
+	failureWindow    = time.Hour
+)
+
+var (
+	loginFailures = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "users_service_login_failures_total",
+			Help: "Total number of failed logins by reason",
+		},
+		[]string{"reason"},
+	)
+
+	loginLockouts = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "users_service_login_lockouts_total",
+			Help: "Total number of lockouts caused by failed logins by scope",
+		},
+		[]string{"scope"},
+	)
+
+	loginDelays = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "users_service_login_delays_total",
+			Help: "Total number of logins slowed down by the failures of their username",
+		},
+	)
+)
+
+// dummyHash is compared against the passwords given for unknown usernames,
+// so that they take as long to reject as wrong passwords.
+var dummyHash []byte
+
+func init() {
+	var err error
+	dummyHash, err = bcrypt.GenerateFromPassword([]byte("not a real password"), bcrypt.DefaultCost)
+	if err != nil {
+		log.Fatalf("Failed to hash dummy password: %v", err)
+	}
+}
+
+// trustForwardedFor makes client IPs be read from X-Forwarded-For, for when
+// users_service runs behind a proxy.
+var trustForwardedFor = os.Getenv("TRUST_FORWARDED_FOR") == "true"
+
+func clientIP(r *http.Request) string {
+	if trustForwardedFor {
+		if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
+			// The last address is the one the proxy saw
+			last := forwarded[strings.LastIndex(forwarded, ",")+1:]
+			if ip := net.ParseIP(strings.TrimSpace(last)); ip != nil {
+				return ip.String()
+			}
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+func loginFailuresKey(scope, id string) string {
+	return "login:failures:" + scope + ":" + id
+}
+
+func loginLockKey(scope, id string) string {
+	return "login:lock:" + scope + ":" + id
+}
+
+// reserveAttemptScript refuses a login while its username and IP pair or
+// its IP is locked, returning the remaining lockout in milliseconds.
+// Otherwise it counts the attempt as a failure of every scope before the
+// password is checked, so that parallel guesses cannot outrun the count,
+// and locks the scopes whose free attempts are used up for the length of
+// the attempt and beyond. It returns {lockout, pair locked, ip locked,
+// username delay ms}.
+//
+// KEYS: pair failures, pair lock, ip failures, ip lock, user failures
+// ARGV: failure window ms, free pair attempts, free ip attempts,
+// base lockout ms, max lockout ms, free user attempts, max user delay ms
+var reserveAttemptScript = redis.NewScript(`
+local locked = math.max(redis.call("PTTL", KEYS[2]), redis.call("PTTL", KEYS[4]))
+if locked > 0 then
+	return {locked, 0, 0, 0}
+end
+local result = {0, 0, 0, 0}
+for i, free in ipairs({tonumber(ARGV[2]), tonumber(ARGV[3])}) do
+	local count = redis.call("INCR", KEYS[2 * i - 1])
+	redis.call("PEXPIRE", KEYS[2 * i - 1], ARGV[1])
+	local over = count - free
+	if over > 0 then
+		local lockout = math.min(tonumber(ARGV[4]) * 2 ^ math.min(over - 1, 30), tonumber(ARGV[5]))
+		redis.call("SET", KEYS[2 * i], 1, "PX", math.floor(lockout))
+		result[i + 1] = 1
+	end
+end
+local count = redis.call("INCR", KEYS[5])
+redis.call("PEXPIRE", KEYS[5], ARGV[1])
+local over = count - tonumber(ARGV[6])
+if over > 0 then
+	result[4] = math.floor(math.min(tonumber(ARGV[4]) * 2 ^ math.min(over - 1, 30), tonumber(ARGV[7])))
+end
+return result
+`)
+
+// releaseAttemptScript takes back the failure an attempt reserved, and the
+// lock it set if any.
+//
+// KEYS: failures, lock
+// ARGV: "1" if the attempt set the lock
+var releaseAttemptScript = redis.NewScript(`
+local count = tonumber(redis.call("GET", KEYS[1]))
+if count and count > 0 then
+	redis.call("DECR", KEYS[1])
+end
+if ARGV[1] == "1" then
+	redis.call("DEL", KEYS[2])
+end
+return 0
+`)
+
+// loginGuard throttles the login attempts of a username from an IP.
+type loginGuard struct {
+	userID string
+	ip     string
+}
+
+// newLoginGuard hashes the username in keys so that long ones cannot bloat
+// redis. Usernames are unique whatever their case, and so are their counts.
+func newLoginGuard(r *http.Request, username string) loginGuard {
+	return loginGuard{userID: loginUserID(username), ip: clientIP(r)}
+}
+
+func loginUserID(username string) string {
+	return hashToken(strings.ToLower(username))
+}
+
+// pairID identifies the username and IP pair of the guard.
+func (g loginGuard) pairID() string {
+	return g.userID + ":" + g.ip
+}
+
+// loginAttempt is an attempt reserved by loginGuard.reserve, counted as a
+// failure until it succeeds or is released.
+type loginAttempt struct {
+	guard      loginGuard
+	lockedPair bool
+	lockedIP   bool
+}
+
+// reserve starts an attempt, unless the username and IP pair or the IP is
+// locked, in which case it returns how long for. Once the username has
+// failed too often from anywhere, reserve waits before returning the
+// attempt.
+func (g loginGuard) reserve(ctx context.Context) (loginAttempt, time.Duration, error) {
+	result, err := reserveAttemptScript.Run(ctx, rdb,
+		[]string{
+			loginFailuresKey("pair", g.pairID()), loginLockKey("pair", g.pairID()),
+			loginFailuresKey("ip", g.ip), loginLockKey("ip", g.ip),
+			loginFailuresKey("user", g.userID),
+		},
+		failureWindow.Milliseconds(), freePairAttempts, freeIPAttempts,
+		baseLockout.Milliseconds(), maxLockout.Milliseconds(),
+		freeUserAttempts, maxUserDelay.Milliseconds(),
+	).Int64Slice()
+	if err != nil {
+		return loginAttempt{}, 0, err
+	}
+	if result[0] > 0 {
+		return loginAttempt{}, time.Duration(result[0]) * time.Millisecond, nil
+	}
+
+	attempt := loginAttempt{guard: g, lockedPair: result[1] == 1, lockedIP: result[2] == 1}
+	if delay := time.Duration(result[3]) * time.Millisecond; delay > 0 {
+		loginDelays.Inc()
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			if err := attempt.release(context.WithoutCancel(ctx)); err != nil {
+				log.Printf("Error releasing login attempt: %v", err)
+			}
+			return loginAttempt{}, 0, ctx.Err()
+		}
+	}
+	return attempt, 0, nil
+}
+
+// fail records why the attempt failed; it was counted when reserved.
+func (a loginAttempt) fail(reason string) {
+	loginFailures.WithLabelValues(reason).Inc()
+	if a.lockedPair {
+		loginLockouts.WithLabelValues("pair").Inc()
+	}
+	if a.lockedIP {
+		loginLockouts.WithLabelValues("ip").Inc()
+	}
+}
+
+// succeed clears the failures of the username from this IP and from
+// anywhere, and takes back the attempt from those of the IP.
+func (a loginAttempt) succeed(ctx context.Context) error {
+	pairID := a.guard.pairID()
+	err := rdb.Del(ctx,
+		loginFailuresKey("pair", pairID), loginLockKey("pair", pairID),
+		loginFailuresKey("user", a.guard.userID),
+	).Err()
+	if err != nil {
+		return err
+	}
+	return releaseAttemptScript.Run(ctx, rdb,
+		[]string{loginFailuresKey("ip", a.guard.ip), loginLockKey("ip", a.guard.ip)},
+		boolArg(a.lockedIP),
+	).Err()
+}
+
+// release takes back an attempt that ended before the password was checked.
+func (a loginAttempt) release(ctx context.Context) error {
+	for _, scope := range []struct {
+		name, id string
+		locked   bool
+	}{
+		{"pair", a.guard.pairID(), a.lockedPair},
+		{"ip", a.guard.ip, a.lockedIP},
+		// The username scope has no lock
+		{"user", a.guard.userID, false},
+	} {
+		err := releaseAttemptScript.Run(ctx, rdb,
+			[]string{loginFailuresKey(scope.name, scope.id), loginLockKey(scope.name, scope.id)},
+			boolArg(scope.locked),
+		).Err()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func boolArg(b bool) string {
+	if b {
+		return "1"
+	}
+	return "0"
+}
+
+// clearLoginFailures unlocks username from every IP, once its password has
+// been reset.
+func clearLoginFailures(ctx context.Context, username string) error {
+	userID := loginUserID(username)
+	keys := []string{loginFailuresKey("user", userID)}
+	for _, pattern := range []string{loginFailuresKey("pair", userID+":*"), loginLockKey("pair", userID+":*")} {
+		iter := rdb.Scan(ctx, 0, pattern, 100).Iterator()
+		for iter.Next(ctx) {
+			keys = append(keys, iter.Val())
+		}
+		if err := iter.Err(); err != nil {
+			return err
+		}
+	}
+	return rdb.Del(ctx, keys...).Err()
+}
+
+// tooManyAttempts refuses a login while its username and IP pair or its IP
+// is locked.
+func tooManyAttempts(w http.ResponseWriter, retryAfter time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+	http.Error(w, "Too many failed login attempts, try again later", http.StatusTooManyRequests)
+}
@@ -7,20 +7,23 @@ import (
 	"net/http"
 	"os"
 	"strings"
-	"time"
 	"userservice/models"
 
-	"github.com/golang-jwt/jwt/v5"
 	"github.com/gorilla/mux"
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
+	"github.com/redis/go-redis/v9"
 	"golang.org/x/crypto/bcrypt"
+	"shared/auth"
+	"shared/revocation"
 
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 var (
-	db                 *sql.DB
-	jwtSecret          = []byte("secret-test")
+	db          *sql.DB
+	rdb         *redis.Client
+	revocations *revocation.Store
+	verifier    *auth.Verifier
 )
 
 func isDuplicateKeyError(err error) bool {
@@ -29,6 +32,31 @@ func isDuplicateKeyError(err error) bool {
 
 func setUpApplication() {
 	db = setupDatabase()
+
+	keysDir := os.Getenv("JWT_KEYS_DIR")
+	if keysDir == "" {
+		keysDir = "keys"
+	}
+	var err error
+	keys, err = loadSigningKeys(keysDir)
+	if err != nil {
+		log.Fatalf("Failed to load signing keys: %v", err)
+	}
+	log.Printf("Signing tokens with key %s", keys.activeKid)
+
+	// Revoked access tokens are recorded in redis for the other services,
+	// along with failed logins
+	rdb = redis.NewClient(&redis.Options{
+		Addr:     "localhost:6379",
+		Password: "", // no password set
+		DB:       0,  // use default DB
+	})
+	revocations = revocation.NewStore(rdb)
+
+	verifier = auth.NewVerifier(keys.keyfunc, revocations)
+	serviceClients = loadServiceClients()
+	passwords = loadPasswordPolicy()
+	notifier = newNotifier()
 }
 
 func main() {
@@ -39,9 +67,21 @@ func main() {
 	r := mux.NewRouter()
 	r.HandleFunc("/v1/signup", signupHandler).Methods("POST")
 	r.HandleFunc("/v1/login", loginHandler).Methods("POST")
-
-	//inter service api no auth needed
-	r.HandleFunc("/v1/UserInfo", getUserInfo).Methods("POST")
+	r.HandleFunc("/v1/token/refresh", refreshHandler).Methods("POST")
+	r.Handle("/v1/logout", verifier.Middleware(http.HandlerFunc(logoutHandler))).Methods("POST")
+	r.HandleFunc("/v1/token/service", serviceTokenHandler).Methods("POST")
+	r.Handle("/v1/password", verifier.Middleware(http.HandlerFunc(changePasswordHandler))).Methods("PUT")
+	r.HandleFunc("/v1/password/reset/request", requestPasswordResetHandler).Methods("POST")
+	r.HandleFunc("/v1/password/reset", resetPasswordHandler).Methods("POST")
+	r.HandleFunc("/.well-known/jwks.json", jwksHandler).Methods("GET")
+
+	r.HandleFunc("/v1/users/{userId}/profile", getUserProfileHandler).Methods("GET")
+	r.Handle("/v1/profile", verifier.Middleware(http.HandlerFunc(getOwnProfileHandler))).Methods("GET")
+	r.Handle("/v1/profile", verifier.Middleware(http.HandlerFunc(updateProfileHandler))).Methods("PATCH")
+
+	admin := r.PathPrefix("/v1/admin").Subrouter()
+	admin.Use(verifier.Middleware, auth.RequireRole(auth.RoleAdmin))
+	admin.HandleFunc("/users/{userId}/roles", setRolesHandler).Methods("PUT")
 
 	// Prometheus metrics endpoint
 	r.Handle("/metrics", promhttp.Handler())
@@ -51,6 +91,9 @@ func main() {
 		port = "8084"
 	}
 
+	// The internal API for other services is only served over mTLS
+	go serveInternal()
+
 	log.Printf("user service starting on port %s\n", port)
 	log.Fatal(http.ListenAndServe(":"+port, r))
 }
@@ -73,8 +116,11 @@ func signupHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if !user.ValidateUserName() {
-		http.Error(w, "Username must be between 3 and 50 characters", http.StatusBadRequest)
+	user.Username = models.NormalizeUsername(user.Username)
+	errs := user.ValidateUserName()
+	errs = append(errs, passwords.validate("password", user.Username, user.Password)...)
+	if len(errs) > 0 {
+		writeValidationErrors(w, errs)
 		return
 	}
 
@@ -114,44 +160,65 @@ func loginHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	credentials.Username = models.NormalizeUsername(credentials.Username)
+
+	// Locked usernames and IPs are refused before any password is hashed
+	attempt, retryAfter, err := newLoginGuard(r, credentials.Username).reserve(r.Context())
+	if err != nil {
+		log.Printf("Error checking login lockout: %v", err)
+		http.Error(w, "Login temporarily unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	if retryAfter > 0 {
+		loginFailures.WithLabelValues("locked").Inc()
+		tooManyAttempts(w, retryAfter)
+		return
+	}
+
 	var storedUser models.User
-	err := db.QueryRow(
-		"SELECT id, username, password FROM users WHERE username = $1",
+	err = db.QueryRow(
+		"SELECT id, username, password, roles FROM users WHERE LOWER(username) = LOWER($1)",
 		credentials.Username,
-	).Scan(&storedUser.ID, &storedUser.Username, &storedUser.Password)
+	).Scan(&storedUser.ID, &storedUser.Username, &storedUser.Password, pq.Array(&storedUser.Roles))
 
+	reason := ""
 	if err == sql.ErrNoRows {
-		http.Error(w, "Invalid username or password", http.StatusUnauthorized)
-		return
+		// Hash anyway so unknown usernames cannot be told apart by timing
+		bcrypt.CompareHashAndPassword(dummyHash, []byte(credentials.Password))
+		reason = "unknown_user"
 	} else if err != nil {
 		log.Printf("Database error during login: %v", err)
+		if err := attempt.release(r.Context()); err != nil {
+			log.Printf("Error releasing login attempt: %v", err)
+		}
 		http.Error(w, "Internal server error", http.StatusInternalServerError)
 		return
-	}
-
-	if err := bcrypt.CompareHashAndPassword(
+	} else if err := bcrypt.CompareHashAndPassword(
 		[]byte(storedUser.Password),
 		[]byte(credentials.Password),
 	); err != nil {
+		reason = "wrong_password"
+	}
+
+	if reason != "" {
+		attempt.fail(reason)
 		http.Error(w, "Invalid username or password", http.StatusUnauthorized)
 		return
 	}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
-		"user_id":  storedUser.ID,
-		"username": storedUser.Username,
-		"exp":      time.Now().Add(24 * time.Hour).Unix(),
-	})
+	if err := attempt.succeed(r.Context()); err != nil {
+		log.Printf("Error clearing failed logins: %v", err)
+	}
 
-	tokenString, err := token.SignedString(jwtSecret)
+	resp, err := startSession(r.Context(), storedUser)
 	if err != nil {
-		log.Printf("Error generating JWT token: %v", err)
+		log.Printf("Error generating tokens: %v", err)
 		http.Error(w, "Internal server error", http.StatusInternalServerError)
 		return
 	}
 
 	w.Header().Set("Content-Type", "application/json")
-	w.Write([]byte(`{"token": "` + tokenString + `"}`))
+	json.NewEncoder(w).Encode(resp)
 }
 
 func getUserInfo(w http.ResponseWriter, r *http.Request) {
@@ -161,15 +228,12 @@ func getUserInfo(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	log.Println("userIds", userIds)
-
 	var users []models.User
 	for _, userId := range userIds {
-		var user models.User
-		err := db.QueryRow(
-			"SELECT id, username, join_date FROM users WHERE id = $1",
+		user, err := scanProfile(db.QueryRow(
+			"SELECT "+profileColumns+" FROM users WHERE id = $1",
 			userId,
-		).Scan(&user.ID, &user.Username, &user.JoinDate)
+		))
 
 		if err == sql.ErrNoRows {
 			http.Error(w, "User not found", http.StatusNotFound)
@@ -183,8 +247,6 @@ func getUserInfo(w http.ResponseWriter, r *http.Request) {
 		users = append(users, user)
 	}
 
-	log.Println("users", users)
-
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(users)
 }
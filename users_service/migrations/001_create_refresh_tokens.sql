@@ -0,0 +1,19 @@
+-- Refresh tokens, stored as the SHA-256 of the token. Every login starts a
+-- family that each refresh rotates into a new token. Presenting a rotated or
+-- revoked token again revokes the whole family. access_jti is the ID of the
+-- access token issued with the refresh token, revoked along with it.
+
+CREATE TABLE IF NOT EXISTS refresh_tokens (
+    id BIGSERIAL PRIMARY KEY,
+    user_id INTEGER NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    family_id CHAR(32) NOT NULL,
+    token_hash CHAR(64) NOT NULL UNIQUE,
+    access_jti CHAR(32) NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    expires_at TIMESTAMPTZ NOT NULL,
+    rotated_at TIMESTAMPTZ,
+    revoked_at TIMESTAMPTZ
+);
+
+CREATE INDEX IF NOT EXISTS refresh_tokens_family_id_idx ON refresh_tokens (family_id);
+CREATE INDEX IF NOT EXISTS refresh_tokens_access_jti_idx ON refresh_tokens (access_jti);
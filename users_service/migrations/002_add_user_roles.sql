@@ -0,0 +1,4 @@
+-- Roles of a user, embedded in their access tokens: "player",
+-- "game_server", "moderator" and "admin". Every account starts as a player.
+
+ALTER TABLE users ADD COLUMN IF NOT EXISTS roles TEXT[] NOT NULL DEFAULT '{player}';
@@ -0,0 +1,5 @@
+-- Usernames are unique whatever their case, and looked up by their lower
+-- case form at login. Accounts whose names only differ by case must be
+-- renamed before this index can be created.
+
+CREATE UNIQUE INDEX IF NOT EXISTS users_username_lower_key ON users (LOWER(username));
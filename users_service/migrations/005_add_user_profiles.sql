@@ -0,0 +1,7 @@
+-- Profile fields users set themselves, shown on leaderboards. They are NULL
+-- until set, and set back to NULL when cleared.
+
+ALTER TABLE users ADD COLUMN IF NOT EXISTS display_name TEXT;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS avatar_url TEXT;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS country_code CHAR(2);
+ALTER TABLE users ADD COLUMN IF NOT EXISTS bio TEXT;
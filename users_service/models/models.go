@@ -7,15 +7,62 @@ type User struct {
 	Username string    `json:"username"`
 	Password string    `json:"password,omitempty"`
 	JoinDate time.Time `json:"join_date"`
+	Roles    []string  `json:"roles,omitempty"`
+	Profile
 }
 
-func (u *User) ValidateUserName() bool {
-	if len(u.Username) < 3 || len(u.Username) > 50 {
-		return false
-	}
-	return true
+// Profile is what users tell about themselves, shown on leaderboards. Every
+// field is optional.
+type Profile struct {
+	DisplayName string `json:"display_name,omitempty"`
+	AvatarURL   string `json:"avatar_url,omitempty"`
+	CountryCode string `json:"country_code,omitempty"`
+	Bio         string `json:"bio,omitempty"`
 }
 
+// UpdateProfileRequest changes the profile fields it sets. Setting a field
+// to "" clears it.
+type UpdateProfileRequest struct {
+	DisplayName *string `json:"display_name"`
+	AvatarURL   *string `json:"avatar_url"`
+	CountryCode *string `json:"country_code"`
+	Bio         *string `json:"bio"`
+}
+
+// LoginResponse carries a short-lived access token and the refresh token
+// exchanged for the next one.
 type LoginResponse struct {
-	Token string `json:"token"`
+	Token        string `json:"token"`
+	RefreshToken string `json:"refresh_token"`
+	ExpiresIn    int64  `json:"expires_in"`
+}
+
+type RefreshRequest struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
+type RolesRequest struct {
+	Roles []string `json:"roles"`
+}
+
+// ServiceTokenRequest holds the client credentials of another service.
+type ServiceTokenRequest struct {
+	ClientID     string `json:"client_id"`
+	ClientSecret string `json:"client_secret"`
+}
+
+type ChangePasswordRequest struct {
+	CurrentPassword string `json:"current_password"`
+	NewPassword     string `json:"new_password"`
+}
+
+// PasswordResetRequest asks for a reset token to be sent to the user.
+type PasswordResetRequest struct {
+	Username string `json:"username"`
+}
+
+// ResetPasswordRequest sets a new password with a reset token.
+type ResetPasswordRequest struct {
+	Token       string `json:"token"`
+	NewPassword string `json:"new_password"`
 }
@@ -0,0 +1,116 @@
+package models
+
+import (
+	"strings"
+	"unicode"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// scriptCombinations are the sets of scripts written together, which a name
+// may mix like it would use a single script.
+var scriptCombinations = [][]string{
+	{"Han", "Hiragana", "Katakana"},
+	{"Han", "Hangul"},
+	{"Han", "Bopomofo"},
+}
+
+// scriptOf returns the name of the script of r, or "" for the characters
+// every script uses, such as ASCII digits, punctuation and combining marks.
+func scriptOf(r rune) string {
+	if unicode.Is(unicode.Common, r) || unicode.Is(unicode.Inherited, r) {
+		return ""
+	}
+	for name, table := range unicode.Scripts {
+		if unicode.Is(table, r) {
+			return name
+		}
+	}
+	return ""
+}
+
+// singleScript reports whether the letters and digits of s are all of one
+// script, or of one of scriptCombinations, so that a name cannot slip a
+// lookalike letter of another script, e.g. a Cyrillic "а", into a Latin
+// name.
+func singleScript(s string) bool {
+	scripts := make(map[string]bool)
+	for _, r := range s {
+		if name := scriptOf(r); name != "" {
+			scripts[name] = true
+		}
+	}
+	if len(scripts) <= 1 {
+		return true
+	}
+
+	for _, combination := range scriptCombinations {
+		covered := 0
+		for _, name := range combination {
+			if scripts[name] {
+				covered++
+			}
+		}
+		if covered == len(scripts) {
+			return true
+		}
+	}
+	return false
+}
+
+// confusables maps characters to the Latin letter they are mistaken for.
+// It is the part of the Unicode confusables (UTS #39) that matters for
+// names: the Cyrillic and Greek letters, digits and capitals shaped like
+// Latin letters, so that whole-script lookalikes of a reserved name, which
+// singleScript lets through, are caught by skeleton.
+var confusables = map[rune]rune{
+	// Cyrillic
+	'а': 'a', 'в': 'b', 'е': 'e', 'ё': 'e', 'һ': 'h', 'і': 'l', 'ї': 'l', 'ј': 'j',
+	'к': 'k', 'ӏ': 'l', 'м': 'm', 'н': 'h', 'п': 'n', 'о': 'o', 'р': 'p', 'с': 'c', 'т': 't',
+	'ѕ': 's', 'у': 'y', 'х': 'x', 'ԁ': 'd', 'ԛ': 'q', 'ԝ': 'w', 'ү': 'y', 'ɡ': 'g',
+	'А': 'a', 'В': 'b', 'Е': 'e', 'К': 'k', 'М': 'm', 'Н': 'h', 'О': 'o', 'Р': 'p',
+	'С': 'c', 'Т': 't', 'Х': 'x', 'Ѕ': 's', 'І': 'l', 'Ј': 'j', 'Ү': 'y', 'Ԁ': 'd',
+	// Greek
+	'α': 'a', 'β': 'b', 'ε': 'e', 'ι': 'l', 'κ': 'k', 'ν': 'v', 'ο': 'o', 'ρ': 'p',
+	'τ': 't', 'υ': 'u', 'χ': 'x', 'γ': 'y', 'Α': 'a', 'Β': 'b', 'Ε': 'e', 'Ζ': 'z',
+	'Η': 'h', 'Ι': 'l', 'Κ': 'k', 'Μ': 'm', 'Ν': 'n', 'Ο': 'o', 'Ρ': 'p', 'Τ': 't',
+	'Υ': 'y', 'Χ': 'x',
+	// Latin and digits; i, l and I are all read as l
+	'i': 'l', 'I': 'l', '1': 'l', '|': 'l', 'ı': 'l', 'ℓ': 'l', '0': 'o', '5': 's',
+}
+
+// skeleton returns the form of s that lookalike names share: decomposed
+// without marks, in lower case with confusable characters replaced by the
+// Latin letter they look like, and "rn" read as "m".
+func skeleton(s string) string {
+	var b strings.Builder
+	for _, r := range norm.NFKD.String(s) {
+		if unicode.Is(unicode.Mn, r) {
+			continue
+		}
+		// Capitals are looked up first as some look unlike their lower case
+		if latin, ok := confusables[r]; ok {
+			r = latin
+		} else if latin, ok := confusables[unicode.ToLower(r)]; ok {
+			r = latin
+		} else {
+			r = unicode.ToLower(r)
+		}
+		b.WriteRune(r)
+	}
+	return strings.ReplaceAll(b.String(), "rn", "m")
+}
+
+// reservedSkeletons holds the skeletons of reservedUsernames.
+var reservedSkeletons = func() map[string]bool {
+	skeletons := make(map[string]bool, len(reservedUsernames))
+	for name := range reservedUsernames {
+		skeletons[skeleton(name)] = true
+	}
+	return skeletons
+}()
+
+// isReserved reports whether name is, or looks like, a reserved name.
+func isReserved(name string) bool {
+	return reservedSkeletons[skeleton(name)]
+}
@@ -0,0 +1,192 @@
+package models
+
+import (
+	"net/url"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/language"
+	"golang.org/x/text/unicode/norm"
+)
+
+const (
+	MinUsernameLength = 3
+	MaxUsernameLength = 50
+)
+
+// reservedUsernames cannot be registered, whatever their case, so that
+// nobody can pass for the staff or the services.
+var reservedUsernames = map[string]bool{
+	"admin":           true,
+	"administrator":   true,
+	"moderator":       true,
+	"root":            true,
+	"system":          true,
+	"support":         true,
+	"staff":           true,
+	"official":        true,
+	"service":         true,
+	"users_service":   true,
+	"score_service":   true,
+	"ranking_service": true,
+	"worker_service":  true,
+	"null":            true,
+	"undefined":       true,
+	"anonymous":       true,
+	"me":              true,
+}
+
+// FieldError describes why the value of a request field is invalid.
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// ValidationErrors lists every invalid field of a request.
+type ValidationErrors []FieldError
+
+func (e ValidationErrors) Error() string {
+	messages := make([]string, len(e))
+	for i, fieldErr := range e {
+		messages[i] = fieldErr.Field + ": " + fieldErr.Message
+	}
+	return strings.Join(messages, "; ")
+}
+
+// Add records that field is invalid.
+func (e *ValidationErrors) Add(field, message string) {
+	*e = append(*e, FieldError{Field: field, Message: message})
+}
+
+// NormalizeUsername returns the form usernames are stored and looked up in:
+// trimmed and NFKC normalized, so that canonically equivalent spellings and
+// compatibility variants, such as full-width letters, are the same name.
+// NFKC does not fold lookalike letters of different scripts, which
+// ValidateUserName rejects instead.
+func NormalizeUsername(username string) string {
+	return norm.NFKC.String(strings.TrimSpace(username))
+}
+
+// ValidateUserName checks the normalized username of u. Usernames are made
+// of letters, digits, '_', '-' and '.' of a single script, start with a
+// letter or digit, and must not look like a reserved name.
+func (u *User) ValidateUserName() ValidationErrors {
+	var errs ValidationErrors
+
+	length := utf8.RuneCountInString(u.Username)
+	if length < MinUsernameLength || length > MaxUsernameLength {
+		errs.Add("username", "must be between 3 and 50 characters")
+		return errs
+	}
+
+	for i, r := range u.Username {
+		switch {
+		case unicode.IsLetter(r) || unicode.IsDigit(r):
+		case r == '_' || r == '-' || r == '.':
+			if i == 0 {
+				errs.Add("username", "must start with a letter or digit")
+				return errs
+			}
+		default:
+			errs.Add("username", "may only contain letters, digits, '_', '-' and '.'")
+			return errs
+		}
+	}
+
+	if !singleScript(u.Username) {
+		errs.Add("username", "must not mix letters of different scripts")
+		return errs
+	}
+
+	if isReserved(u.Username) {
+		errs.Add("username", "is reserved")
+	}
+	return errs
+}
+
+// isControlOrFormat reports whether r is a control character or an invisible
+// formatting one, such as the bidi override U+202E that shows a name
+// reversed.
+func isControlOrFormat(r rune) bool {
+	return unicode.IsControl(r) || unicode.Is(unicode.Cf, r)
+}
+
+// isReservedDisplayName reports whether name, without its separators, or one
+// of its words looks like a reserved name. Words shorter than a username are
+// not checked, so that "Call me Bob" is not taken for "me".
+func isReservedDisplayName(name string) bool {
+	isSeparator := func(r rune) bool {
+		return unicode.IsSpace(r) || r == '_' || r == '-' || r == '.'
+	}
+	words := strings.FieldsFunc(name, isSeparator)
+	if isReserved(strings.Join(words, "")) || isReserved(strings.Join(words, "_")) {
+		return true
+	}
+	for _, word := range words {
+		if utf8.RuneCountInString(word) >= MinUsernameLength && isReserved(word) {
+			return true
+		}
+	}
+	return false
+}
+
+const (
+	MaxDisplayNameLength = 32
+	MaxAvatarURLLength   = 512
+	MaxBioLength         = 280
+)
+
+// Validate normalizes the fields p sets and checks them. Display names are
+// NFKC normalized like usernames and, like them, must be of a single script
+// and must not look like a reserved name. Country codes are ISO 3166-1
+// alpha-2 codes in upper case, and avatars are https URLs.
+func (p *UpdateProfileRequest) Validate() ValidationErrors {
+	var errs ValidationErrors
+
+	if p.DisplayName != nil {
+		name := norm.NFKC.String(strings.TrimSpace(*p.DisplayName))
+		if utf8.RuneCountInString(name) > MaxDisplayNameLength {
+			errs.Add("display_name", "must be at most 32 characters")
+		} else if strings.IndexFunc(name, isControlOrFormat) >= 0 {
+			errs.Add("display_name", "must not contain control or formatting characters")
+		} else if !singleScript(name) {
+			errs.Add("display_name", "must not mix letters of different scripts")
+		} else if isReservedDisplayName(name) {
+			errs.Add("display_name", "is reserved")
+		}
+		p.DisplayName = &name
+	}
+
+	if p.AvatarURL != nil && *p.AvatarURL != "" {
+		u, err := url.Parse(*p.AvatarURL)
+		switch {
+		case len(*p.AvatarURL) > MaxAvatarURLLength:
+			errs.Add("avatar_url", "must be at most 512 characters")
+		case err != nil || u.Scheme != "https" || u.Host == "" || u.User != nil:
+			errs.Add("avatar_url", "must be an https URL")
+		}
+	}
+
+	if p.CountryCode != nil && *p.CountryCode != "" {
+		code := strings.ToUpper(*p.CountryCode)
+		region, err := language.ParseRegion(code)
+		// UN and UK parse as countries but have no ISO 3166 alpha-3 code
+		if len(code) != 2 || err != nil || !region.IsCountry() || region.ISO3() == "ZZZ" {
+			errs.Add("country_code", "must be an ISO 3166-1 alpha-2 country code")
+		}
+		p.CountryCode = &code
+	}
+
+	if p.Bio != nil {
+		bio := strings.TrimSpace(*p.Bio)
+		if utf8.RuneCountInString(bio) > MaxBioLength {
+			errs.Add("bio", "must be at most 280 characters")
+		} else if strings.IndexFunc(bio, func(r rune) bool { return unicode.IsControl(r) && r != '\n' }) >= 0 {
+			errs.Add("bio", "must not contain control characters other than newlines")
+		}
+		p.Bio = &bio
+	}
+
+	return errs
+}
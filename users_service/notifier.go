@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+	"userservice/models"
+)
+
+// Notifier delivers messages to users. Accounts have no contact details
+// yet, so the notifiers here are for local use; one sending email would
+// look the user's address up.
+type Notifier interface {
+	// PasswordReset sends user the token resetting their password.
+	PasswordReset(ctx context.Context, user models.User, token string, expiresAt time.Time) error
+}
+
+var notifier Notifier
+
+// newNotifier returns the notifier NOTIFIER names: "log" or "file", which
+// appends to NOTIFIER_FILE. Both expose live reset tokens to whoever can
+// read them, so there is no default and one must be chosen explicitly.
+func newNotifier() Notifier {
+	switch kind := os.Getenv("NOTIFIER"); kind {
+	case "":
+		log.Fatal("NOTIFIER is not set; set it to 'log' or 'file' to choose where password reset tokens are written")
+		return nil
+	case "log":
+		log.Println("WARNING: password reset tokens are written to the service log")
+		return logNotifier{}
+	case "file":
+		path := os.Getenv("NOTIFIER_FILE")
+		if path == "" {
+			path = "../local-data/notifications.jsonl"
+		}
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			log.Fatalf("Failed to create notifications directory: %v", err)
+		}
+		return &fileNotifier{path: path}
+	default:
+		log.Fatalf("Invalid NOTIFIER %q, must be 'log' or 'file'", kind)
+		return nil
+	}
+}
+
+// logNotifier writes notifications to the service log.
+type logNotifier struct{}
+
+func (logNotifier) PasswordReset(ctx context.Context, user models.User, token string, expiresAt time.Time) error {
+	log.Printf("Password reset token for %s (user %d), valid until %s: %s",
+		user.Username, user.ID, expiresAt.Format(time.RFC3339), token)
+	return nil
+}
+
+// notification is a line of the file written by fileNotifier.
+type notification struct {
+	Type      string    `json:"type"`
+	UserID    int       `json:"user_id"`
+	Username  string    `json:"username"`
+	Token     string    `json:"token"`
+	ExpiresAt time.Time `json:"expires_at"`
+	SentAt    time.Time `json:"sent_at"`
+}
+
+// fileNotifier appends notifications to a JSON lines file.
+type fileNotifier struct {
+	path string
+	mu   sync.Mutex
+}
+
+func (n *fileNotifier) PasswordReset(ctx context.Context, user models.User, token string, expiresAt time.Time) error {
+	line, err := json.Marshal(notification{
+		Type:      "password_reset",
+		UserID:    user.ID,
+		Username:  user.Username,
+		Token:     token,
+		ExpiresAt: expiresAt,
+		SentAt:    time.Now(),
+	})
+	if err != nil {
+		return err
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	f, err := os.OpenFile(n.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+	"userservice/models"
+)
+
+// maxPasswordBytes is the most bcrypt hashes. Longer passwords are refused
+// rather than silently truncated.
+const maxPasswordBytes = 72
+
+const (
+	defaultMinPasswordLength = 10
+	// defaultBreachedPasswordsFile is used when it exists and
+	// BREACHED_PASSWORDS_FILE is not set.
+	defaultBreachedPasswordsFile = "breached_passwords.txt"
+)
+
+// passwordPolicy holds the rules new passwords must follow.
+type passwordPolicy struct {
+	minLength int // in characters
+	maxLength int // in characters, at most maxPasswordBytes bytes in any case
+	breached  *breachedPasswords
+}
+
+var passwords passwordPolicy
+
+// loadPasswordPolicy reads the policy from PASSWORD_MIN_LENGTH,
+// PASSWORD_MAX_LENGTH and BREACHED_PASSWORDS_FILE.
+func loadPasswordPolicy() passwordPolicy {
+	policy := passwordPolicy{
+		minLength: envInt("PASSWORD_MIN_LENGTH", defaultMinPasswordLength),
+		maxLength: envInt("PASSWORD_MAX_LENGTH", maxPasswordBytes),
+	}
+	if policy.minLength < 1 || policy.maxLength < policy.minLength {
+		log.Fatalf("Invalid password length range %d-%d", policy.minLength, policy.maxLength)
+	}
+
+	path := os.Getenv("BREACHED_PASSWORDS_FILE")
+	if path == "" {
+		if _, err := os.Stat(defaultBreachedPasswordsFile); err != nil {
+			log.Printf("No breached passwords list, passwords are not checked against one")
+			return policy
+		}
+		path = defaultBreachedPasswordsFile
+	}
+
+	breached, err := loadBreachedPasswords(path)
+	if err != nil {
+		log.Fatalf("Failed to load breached passwords: %v", err)
+	}
+	log.Printf("Checking passwords against %d breached password hashes from %s", breached.count, path)
+	policy.breached = breached
+	return policy
+}
+
+func envInt(name string, fallback int) int {
+	value := os.Getenv(name)
+	if value == "" {
+		return fallback
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		log.Fatalf("Invalid %s %q: %v", name, value, err)
+	}
+	return n
+}
+
+// validate checks a new password of username. Errors are reported for field.
+func (p passwordPolicy) validate(field, username, password string) models.ValidationErrors {
+	var errs models.ValidationErrors
+
+	length := utf8.RuneCountInString(password)
+	switch {
+	case length < p.minLength:
+		errs.Add(field, fmt.Sprintf("must be at least %d characters", p.minLength))
+		return errs
+	case length > p.maxLength || len(password) > maxPasswordBytes:
+		errs.Add(field, fmt.Sprintf("must be at most %d characters and %d bytes", p.maxLength, maxPasswordBytes))
+		return errs
+	}
+
+	if username != "" && strings.Contains(strings.ToLower(password), strings.ToLower(username)) {
+		errs.Add(field, "must not contain the username")
+	} else if p.breached != nil && p.breached.contains(password) {
+		errs.Add(field, "has appeared in a data breach, choose another one")
+	}
+	return errs
+}
+
+// breachedPasswords is a local copy of a list of breached password hashes
+// in the k-anonymity layout of Have I Been Pwned: SHA-1 hashes grouped in
+// ranges by their first 5 hex characters. A password is looked up by asking
+// for the range of its prefix and comparing suffixes, which is also how a
+// remote range API would be queried.
+type breachedPasswords struct {
+	ranges map[string][]string
+	count  int
+}
+
+// loadBreachedPasswords reads a file with one upper or lower case SHA-1
+// hash per line, optionally followed by ":<count>" as in downloaded range
+// files. Empty lines and lines starting with '#' are ignored.
+func loadBreachedPasswords(path string) (*breachedPasswords, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	b := &breachedPasswords{ranges: make(map[string][]string)}
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		hash, _, _ := strings.Cut(text, ":")
+		hash = strings.ToUpper(hash)
+		if len(hash) != 2*sha1.Size {
+			return nil, fmt.Errorf("%s:%d: not a SHA-1 hash", path, line)
+		}
+		if _, err := hex.DecodeString(hash); err != nil {
+			return nil, fmt.Errorf("%s:%d: not a SHA-1 hash", path, line)
+		}
+		b.ranges[hash[:5]] = append(b.ranges[hash[:5]], hash[5:])
+		b.count++
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	for _, suffixes := range b.ranges {
+		sort.Strings(suffixes)
+	}
+	return b, nil
+}
+
+// rangeOf returns the sorted hash suffixes of the range prefix.
+func (b *breachedPasswords) rangeOf(prefix string) []string {
+	return b.ranges[prefix]
+}
+
+func (b *breachedPasswords) contains(password string) bool {
+	sum := sha1.Sum([]byte(password))
+	hash := strings.ToUpper(hex.EncodeToString(sum[:]))
+
+	suffixes := b.rangeOf(hash[:5])
+	i := sort.SearchStrings(suffixes, hash[5:])
+	return i < len(suffixes) && suffixes[i] == hash[5:]
+}
+
+type validationResponse struct {
+	Error   string                  `json:"error"`
+	Message string                  `json:"message"`
+	Fields  models.ValidationErrors `json:"fields"`
+}
+
+// writeValidationErrors answers a request with invalid fields.
+func writeValidationErrors(w http.ResponseWriter, errs models.ValidationErrors) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusBadRequest)
+	json.NewEncoder(w).Encode(validationResponse{
+		Error:   "validation_failed",
+		Message: "Some fields are invalid",
+		Fields:  errs,
+	})
+}
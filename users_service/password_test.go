@@ -0,0 +1,55 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestPasswordPolicyValidate(t *testing.T) {
+	// The SHA-1 hash of "correct-horse-battery", in a range file as
+	// downloaded, with its count
+	path := filepath.Join(t.TempDir(), "breached.txt")
+	list := "# breached passwords\n\nf97979ff44a9a1a4105f4bae6fe809715e0a0a84:3\n"
+	if err := os.WriteFile(path, []byte(list), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	breached, err := loadBreachedPasswords(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	policy := passwordPolicy{minLength: 10, maxLength: maxPasswordBytes, breached: breached}
+
+	tests := []struct {
+		name     string
+		username string
+		password string
+		want     string // the error message, "" if valid
+	}{
+		{"valid", "testuser", "violet-harbor-72", ""},
+		{"too short", "testuser", "short-pw", "must be at least 10 characters"},
+		{"counts characters rather than bytes", "testuser", "ééééééééé", "must be at least 10 characters"},
+		{"too long", "testuser", strings.Repeat("a", 73), "must be at most 72 characters and 72 bytes"},
+		// 40 characters but 80 bytes, more than bcrypt hashes
+		{"too many bytes", "testuser", strings.Repeat("é", 40), "must be at most 72 characters and 72 bytes"},
+		{"contains the username", "testuser", "my-TestUser-password", "must not contain the username"},
+		{"no username", "", "violet-harbor-72", ""},
+		{"breached", "testuser", "correct-horse-battery", "has appeared in a data breach, choose another one"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			errs := policy.validate("password", tt.username, tt.password)
+			if tt.want == "" {
+				if len(errs) != 0 {
+					t.Errorf("validate() = %v, want no error", errs)
+				}
+				return
+			}
+			if len(errs) != 1 || errs[0].Field != "password" || errs[0].Message != tt.want {
+				t.Errorf("validate() = %v, want password: %s", errs, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"userservice/models"
+
+	"github.com/gorilla/mux"
+	"shared/auth"
+)
+
+// profileColumns selects the public fields of a user, scanned by
+// scanProfile.
+const profileColumns = `id, username, join_date,
+	COALESCE(display_name, ''), COALESCE(avatar_url, ''), COALESCE(country_code, ''), COALESCE(bio, '')`
+
+func scanProfile(row *sql.Row) (models.User, error) {
+	var user models.User
+	err := row.Scan(&user.ID, &user.Username, &user.JoinDate,
+		&user.DisplayName, &user.AvatarURL, &user.CountryCode, &user.Bio)
+	return user, err
+}
+
+func getProfile(ctx context.Context, userID int) (models.User, error) {
+	return scanProfile(db.QueryRowContext(ctx,
+		"SELECT "+profileColumns+" FROM users WHERE id = $1",
+		userID,
+	))
+}
+
+func writeProfile(w http.ResponseWriter, user models.User, err error) {
+	if err == sql.ErrNoRows {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Printf("Database error during profile lookup: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(user)
+}
+
+// getUserProfileHandler returns the public profile of any user.
+func getUserProfileHandler(w http.ResponseWriter, r *http.Request) {
+	userID, err := strconv.Atoi(mux.Vars(r)["userId"])
+	if err != nil {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+
+	user, err := getProfile(r.Context(), userID)
+	writeProfile(w, user, err)
+}
+
+// getOwnProfileHandler returns the profile of the authenticated user.
+func getOwnProfileHandler(w http.ResponseWriter, r *http.Request) {
+	userID, _ := auth.UserID(r.Context())
+	user, err := getProfile(r.Context(), userID)
+	writeProfile(w, user, err)
+}
+
+// updateProfileHandler changes the fields of the authenticated user's
+// profile the request sets, and returns the updated profile.
+func updateProfileHandler(w http.ResponseWriter, r *http.Request) {
+	userID, _ := auth.UserID(r.Context())
+
+	var req models.UpdateProfileRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request format", http.StatusBadRequest)
+		return
+	}
+
+	if errs := req.Validate(); len(errs) > 0 {
+		writeValidationErrors(w, errs)
+		return
+	}
+
+	// Fields the request leaves out keep their value, and "" clears a field
+	query := "UPDATE users SET "
+	args := []interface{}{}
+	for _, field := range []struct {
+		column string
+		value  *string
+	}{
+		{"display_name", req.DisplayName},
+		{"avatar_url", req.AvatarURL},
+		{"country_code", req.CountryCode},
+		{"bio", req.Bio},
+	} {
+		if field.value == nil {
+			continue
+		}
+		args = append(args, *field.value)
+		query += field.column + " = NULLIF($" + strconv.Itoa(len(args)) + ", ''), "
+	}
+	if len(args) == 0 {
+		http.Error(w, "No profile fields to update", http.StatusBadRequest)
+		return
+	}
+	args = append(args, userID)
+	query = query[:len(query)-2] + " WHERE id = $" + strconv.Itoa(len(args)) + " RETURNING " + profileColumns
+
+	user, err := scanProfile(db.QueryRowContext(r.Context(), query, args...))
+	writeProfile(w, user, err)
+}
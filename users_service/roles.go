@@ -0,0 +1,197 @@
+package main
+
+import (
+	"crypto/subtle"
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"userservice/models"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+	"shared/auth"
+	"shared/jwks"
+)
+
+const serviceTokenTTL = 15 * time.Minute
+
+// defaultServiceClients lets the local ranking_service call the internal
+// endpoints. As its secret is public it is only used when
+// DEV_SERVICE_CREDENTIALS is set and SERVICE_CLIENTS is not.
+const defaultServiceClients = "ranking_service:ranking-service-secret"
+
+// serviceClients maps the client IDs of other services to their secrets,
+// configured as "id:secret,id:secret" in SERVICE_CLIENTS.
+var serviceClients map[string]string
+
+func loadServiceClients() map[string]string {
+	config := os.Getenv("SERVICE_CLIENTS")
+	if config == "" {
+		devCredentials, _ := strconv.ParseBool(os.Getenv("DEV_SERVICE_CREDENTIALS"))
+		if !devCredentials {
+			log.Fatal("SERVICE_CLIENTS is not set; set it, or DEV_SERVICE_CREDENTIALS=true to accept the local development pair")
+		}
+		log.Println("WARNING: accepting the local development service credentials")
+		config = defaultServiceClients
+	}
+
+	clients := make(map[string]string)
+	for _, pair := range strings.Split(config, ",") {
+		id, secret, ok := strings.Cut(strings.TrimSpace(pair), ":")
+		if !ok || id == "" || secret == "" {
+			log.Fatalf("Invalid SERVICE_CLIENTS entry %q, must be id:secret", pair)
+		}
+		clients[id] = secret
+	}
+	return clients
+}
+
+// serviceTokenHandler exchanges the client credentials of a service for an
+// access token with the service role.
+func serviceTokenHandler(w http.ResponseWriter, r *http.Request) {
+	var req models.ServiceTokenRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request format", http.StatusBadRequest)
+		return
+	}
+
+	secret, ok := serviceClients[req.ClientID]
+	if !ok || subtle.ConstantTimeCompare([]byte(req.ClientSecret), []byte(secret)) != 1 {
+		http.Error(w, "Invalid client credentials", http.StatusUnauthorized)
+		return
+	}
+
+	jti, err := randomHex(16)
+	if err != nil {
+		log.Printf("Error generating token ID: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	now := time.Now()
+	tokenString, err := keys.sign(jwt.MapClaims{
+		"iss":   jwks.Issuer,
+		"aud":   jwks.Audience,
+		"sub":   req.ClientID,
+		"roles": []string{auth.RoleService},
+		"jti":   jti,
+		"iat":   now.Unix(),
+		"exp":   now.Add(serviceTokenTTL).Unix(),
+	})
+	if err != nil {
+		log.Printf("Error signing service token: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(models.LoginResponse{
+		Token:     tokenString,
+		ExpiresIn: int64(serviceTokenTTL.Seconds()),
+	})
+}
+
+// setRolesHandler replaces the roles of a user. They are embedded in the
+// user's tokens from their next login or refresh, so removing a role also
+// signs the user out everywhere, lest their current tokens keep it.
+func setRolesHandler(w http.ResponseWriter, r *http.Request) {
+	userID, err := strconv.Atoi(mux.Vars(r)["userId"])
+	if err != nil {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+
+	var req models.RolesRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request format", http.StatusBadRequest)
+		return
+	}
+
+	if len(req.Roles) == 0 {
+		http.Error(w, "At least one role is required", http.StatusBadRequest)
+		return
+	}
+	for _, role := range req.Roles {
+		if !auth.ValidUserRole(role) {
+			http.Error(w, "Invalid role "+role, http.StatusBadRequest)
+			return
+		}
+	}
+
+	tx, err := db.BeginTx(r.Context(), nil)
+	if err != nil {
+		log.Printf("Database error updating roles: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	var previous []string
+	err = tx.QueryRowContext(r.Context(),
+		"SELECT roles FROM users WHERE id = $1 FOR UPDATE",
+		userID,
+	).Scan(pq.Array(&previous))
+	if err == sql.ErrNoRows {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Printf("Database error updating roles: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	var user models.User
+	if err := tx.QueryRowContext(r.Context(),
+		"UPDATE users SET roles = $1 WHERE id = $2 RETURNING id, username, roles",
+		pq.Array(req.Roles), userID,
+	).Scan(&user.ID, &user.Username, pq.Array(&user.Roles)); err != nil {
+		log.Printf("Database error updating roles: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	var jtis []string
+	if removesRole(previous, req.Roles) {
+		jtis, err = revokeUserSessions(r.Context(), tx, userID)
+		if err != nil {
+			log.Printf("Error revoking sessions: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		log.Printf("Error committing roles: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	if err := revokeAccessTokens(r.Context(), jtis); err != nil {
+		log.Printf("Error revoking access tokens: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	claims, _ := auth.FromContext(r.Context())
+	log.Printf("Roles of user %d set to %v by %s", user.ID, user.Roles, claims.Username)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(user)
+}
+
+// removesRole reports whether a role of previous is not in roles.
+func removesRole(previous, roles []string) bool {
+	for _, role := range previous {
+		if !slices.Contains(roles, role) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,310 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+	"userservice/models"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/lib/pq"
+	"shared/auth"
+	"shared/jwks"
+)
+
+const (
+	accessTokenTTL  = 15 * time.Minute
+	refreshTokenTTL = 30 * 24 * time.Hour
+)
+
+var errInvalidRefreshToken = errors.New("invalid refresh token")
+
+// randomHex returns n random bytes, hex encoded.
+func randomHex(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// randomToken returns an opaque token of 32 random bytes.
+func randomToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// hashToken returns the hash a refresh or reset token is stored under.
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// issueTokens signs an access token for user and stores a new refresh token
+// of familyID alongside it. The roles are read again on every refresh, so
+// changes apply from the next one.
+func issueTokens(ctx context.Context, tx *sql.Tx, user models.User, familyID string) (models.LoginResponse, error) {
+	jti, err := randomHex(16)
+	if err != nil {
+		return models.LoginResponse{}, err
+	}
+
+	now := time.Now()
+	tokenString, err := keys.sign(jwt.MapClaims{
+		"iss":      jwks.Issuer,
+		"aud":      jwks.Audience,
+		"user_id":  user.ID,
+		"username": user.Username,
+		"roles":    user.Roles,
+		"jti":      jti,
+		"iat":      now.Unix(),
+		"exp":      now.Add(accessTokenTTL).Unix(),
+	})
+	if err != nil {
+		return models.LoginResponse{}, fmt.Errorf("signing access token: %w", err)
+	}
+
+	refreshToken, err := randomToken()
+	if err != nil {
+		return models.LoginResponse{}, err
+	}
+
+	_, err = tx.ExecContext(ctx,
+		`INSERT INTO refresh_tokens (user_id, family_id, token_hash, access_jti, expires_at)
+		VALUES ($1, $2, $3, $4, $5)`,
+		user.ID, familyID, hashToken(refreshToken), jti, now.Add(refreshTokenTTL),
+	)
+	if err != nil {
+		return models.LoginResponse{}, fmt.Errorf("storing refresh token: %w", err)
+	}
+
+	return models.LoginResponse{
+		Token:        tokenString,
+		RefreshToken: refreshToken,
+		ExpiresIn:    int64(accessTokenTTL.Seconds()),
+	}, nil
+}
+
+// startSession issues the first tokens of a new family for user.
+func startSession(ctx context.Context, user models.User) (models.LoginResponse, error) {
+	familyID, err := randomHex(16)
+	if err != nil {
+		return models.LoginResponse{}, err
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return models.LoginResponse{}, err
+	}
+	defer tx.Rollback()
+
+	resp, err := issueTokens(ctx, tx, user, familyID)
+	if err != nil {
+		return models.LoginResponse{}, err
+	}
+	return resp, tx.Commit()
+}
+
+// revokeFamily revokes every refresh token of familyID and returns the IDs
+// of the access tokens issued with them that may not have expired yet.
+func revokeFamily(ctx context.Context, tx *sql.Tx, familyID string) ([]string, error) {
+	rows, err := tx.QueryContext(ctx,
+		`UPDATE refresh_tokens SET revoked_at = NOW()
+		WHERE family_id = $1 AND revoked_at IS NULL
+		RETURNING access_jti, created_at`,
+		familyID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return unexpiredAccessTokens(rows)
+}
+
+// revokeUserSessions revokes every refresh token of userID, signing them
+// out everywhere, and returns the access tokens to revoke like revokeFamily.
+func revokeUserSessions(ctx context.Context, tx *sql.Tx, userID int) ([]string, error) {
+	rows, err := tx.QueryContext(ctx,
+		`UPDATE refresh_tokens SET revoked_at = NOW()
+		WHERE user_id = $1 AND revoked_at IS NULL
+		RETURNING access_jti, created_at`,
+		userID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return unexpiredAccessTokens(rows)
+}
+
+// unexpiredAccessTokens reads the access_jti and created_at rows of revoked
+// refresh tokens and returns the access tokens that may still be valid.
+func unexpiredAccessTokens(rows *sql.Rows) ([]string, error) {
+	defer rows.Close()
+
+	var jtis []string
+	for rows.Next() {
+		var jti string
+		var createdAt time.Time
+		if err := rows.Scan(&jti, &createdAt); err != nil {
+			return nil, err
+		}
+		if time.Since(createdAt) < accessTokenTTL {
+			jtis = append(jtis, jti)
+		}
+	}
+	return jtis, rows.Err()
+}
+
+// revokeAccessTokens marks access tokens as revoked until they would have
+// expired.
+func revokeAccessTokens(ctx context.Context, jtis []string) error {
+	for _, jti := range jtis {
+		if err := revocations.Revoke(ctx, jti, accessTokenTTL); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rotateRefreshToken exchanges a refresh token for new tokens of the same
+// family. Presenting a token that was already rotated or revoked means it
+// leaked, so the whole family is revoked.
+func rotateRefreshToken(ctx context.Context, refreshToken string) (models.LoginResponse, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return models.LoginResponse{}, err
+	}
+	defer tx.Rollback()
+
+	var (
+		id        int64
+		user      models.User
+		familyID  string
+		expiresAt time.Time
+		rotatedAt sql.NullTime
+		revokedAt sql.NullTime
+	)
+	err = tx.QueryRowContext(ctx,
+		`SELECT rt.id, u.id, u.username, u.roles, rt.family_id, rt.expires_at, rt.rotated_at, rt.revoked_at
+		FROM refresh_tokens rt JOIN users u ON u.id = rt.user_id
+		WHERE rt.token_hash = $1
+		FOR UPDATE OF rt`,
+		hashToken(refreshToken),
+	).Scan(&id, &user.ID, &user.Username, pq.Array(&user.Roles), &familyID, &expiresAt, &rotatedAt, &revokedAt)
+	if err == sql.ErrNoRows {
+		return models.LoginResponse{}, errInvalidRefreshToken
+	} else if err != nil {
+		return models.LoginResponse{}, err
+	}
+
+	if rotatedAt.Valid || revokedAt.Valid {
+		log.Printf("Refresh token reuse detected for user %d, revoking family %s", user.ID, familyID)
+		jtis, err := revokeFamily(ctx, tx, familyID)
+		if err != nil {
+			return models.LoginResponse{}, err
+		}
+		if err := tx.Commit(); err != nil {
+			return models.LoginResponse{}, err
+		}
+		if err := revokeAccessTokens(ctx, jtis); err != nil {
+			return models.LoginResponse{}, err
+		}
+		return models.LoginResponse{}, errInvalidRefreshToken
+	}
+
+	if time.Now().After(expiresAt) {
+		return models.LoginResponse{}, errInvalidRefreshToken
+	}
+
+	if _, err := tx.ExecContext(ctx, "UPDATE refresh_tokens SET rotated_at = NOW() WHERE id = $1", id); err != nil {
+		return models.LoginResponse{}, err
+	}
+
+	resp, err := issueTokens(ctx, tx, user, familyID)
+	if err != nil {
+		return models.LoginResponse{}, err
+	}
+	return resp, tx.Commit()
+}
+
+func refreshHandler(w http.ResponseWriter, r *http.Request) {
+	var req models.RefreshRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.RefreshToken == "" {
+		http.Error(w, "Invalid request format", http.StatusBadRequest)
+		return
+	}
+
+	resp, err := rotateRefreshToken(r.Context(), req.RefreshToken)
+	if err == errInvalidRefreshToken {
+		http.Error(w, "Invalid refresh token", http.StatusUnauthorized)
+		return
+	} else if err != nil {
+		log.Printf("Error refreshing token: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// logoutHandler revokes the presented access token and the refresh token
+// family it was issued with.
+func logoutHandler(w http.ResponseWriter, r *http.Request) {
+	claims, _ := auth.FromContext(r.Context())
+	jti := claims.ID
+
+	tx, err := db.BeginTx(r.Context(), nil)
+	if err != nil {
+		log.Printf("Error starting logout transaction: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	jtis := []string{jti}
+
+	var familyID string
+	err = tx.QueryRowContext(r.Context(),
+		"SELECT family_id FROM refresh_tokens WHERE access_jti = $1",
+		jti,
+	).Scan(&familyID)
+	if err == nil {
+		familyJtis, err := revokeFamily(r.Context(), tx, familyID)
+		if err != nil {
+			log.Printf("Error revoking token family: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		jtis = append(jtis, familyJtis...)
+	} else if err != sql.ErrNoRows {
+		log.Printf("Database error during logout: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		log.Printf("Error committing logout: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	if err := revokeAccessTokens(r.Context(), jtis); err != nil {
+		log.Printf("Error revoking access tokens: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
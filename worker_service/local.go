@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"shared/events"
+)
+
+// defaultLocalSessionsFile is shared with ranking_service's local store. Both
+// services are started from their own directory, hence the parent path.
+const defaultLocalSessionsFile = "../local-data/sessions.jsonl"
+
+// LocalWriter appends every session as a JSON line to a local file. It lets
+// the pipeline run on a laptop without Cassandra or Redis: ranking_service's
+// local store tails the same file and keeps the leaderboards in memory.
+type LocalWriter struct {
+	mu   sync.Mutex
+	file *os.File
+}
+
+func (l *LocalWriter) Write(ctx context.Context, session events.GameSession) error {
+	log.Printf("[Local] Writing session: ID=%v, UserID=%s, Score=%d, GameMode=%s",
+		session.SessionID, session.UserID, session.Score, session.GameMode)
+
+	timer := prometheus.NewTimer(storageWriteDuration.WithLabelValues("local"))
+	defer timer.ObserveDuration()
+
+	line, err := json.Marshal(session)
+	if err != nil {
+		storageWriteErrors.WithLabelValues("local").Inc()
+		return err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if _, err := l.file.Write(append(line, '\n')); err != nil {
+		log.Printf("[Local] Error writing session: %v", err)
+		storageWriteErrors.WithLabelValues("local").Inc()
+		return err
+	}
+
+	return nil
+}
+
+func (l *LocalWriter) Close() {
+	l.file.Close()
+}
+
+// localSessionsFile returns the sessions file, which can be moved with the
+// LOCAL_SESSIONS_FILE environment variable.
+func localSessionsFile() string {
+	if path := os.Getenv("LOCAL_SESSIONS_FILE"); path != "" {
+		return path
+	}
+	return defaultLocalSessionsFile
+}
+
+func setupLocal() (*LocalWriter, error) {
+	path := localSessionsFile()
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, err
+	}
+
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		return nil, err
+	}
+
+	return &LocalWriter{file: file}, nil
+}
@@ -2,13 +2,15 @@ package main
 
 import (
 	"context"
-	"encoding/json"
+	"errors"
 	"flag"
+	"fmt"
 	"log"
 	"net/http"
 	"os"
 	"os/signal"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 
@@ -17,7 +19,9 @@ import (
 	"github.com/prometheus/client_golang/prometheus/promauto"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/redis/go-redis/v9"
-	"github.com/segmentio/kafka-go"
+	"shared/events"
+	"shared/messaging"
+	"shared/seasons"
 )
 
 const (
@@ -25,24 +29,26 @@ const (
 	kafkaGroupID = "worker-service"
 	kafkaServer  = "localhost:9092"
 	redisServer  = "localhost:6379"
+
+	maxRetryBackoff = 30 * time.Second
 )
 
 var (
-	messagesProcessed = promauto.NewCounter(prometheus.CounterOpts{
+	messagesProcessed = promauto.NewCounterVec(prometheus.CounterOpts{
 		Name: "worker_messages_processed_total",
 		Help: "The total number of processed messages",
-	})
+	}, []string{"sink"})
 
-	messageProcessingErrors = promauto.NewCounter(prometheus.CounterOpts{
+	messageProcessingErrors = promauto.NewCounterVec(prometheus.CounterOpts{
 		Name: "worker_message_processing_errors_total",
 		Help: "The total number of message processing errors",
-	})
+	}, []string{"sink"})
 
-	messageProcessingDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+	messageProcessingDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
 		Name:    "worker_message_processing_duration_seconds",
 		Help:    "The duration of message processing in seconds",
 		Buckets: prometheus.DefBuckets,
-	})
+	}, []string{"sink"})
 
 	storageWriteDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
 		Name:    "worker_storage_write_duration_seconds",
@@ -58,24 +64,30 @@ var (
 	gameModeCounter = promauto.NewCounterVec(prometheus.CounterOpts{
 		Name: "worker_game_mode_total",
 		Help: "The total number of processed games by mode",
-	}, []string{"game_mode"})
-)
+	}, []string{"sink", "game_mode"})
 
-type GameSession struct {
-	SessionID gocql.UUID `json:"session_id"`
-	UserID    string     `json:"user_id"`
-	Score     int        `json:"score"`
-	GameMode  string     `json:"game_mode"`
-	Timestamp time.Time  `json:"timestamp"`
-}
+	messagesRejected = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "worker_messages_rejected_total",
+		Help: "The total number of messages skipped because they could not be decoded",
+	}, []string{"sink", "reason"})
+
+	sinkUp = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "worker_sink_up",
+		Help: "Whether the storage sink is connected and consuming (1) or not (0)",
+	}, []string{"sink"})
+)
 
-type KafkaMessage struct {
-	EventType string      `json:"event_type"`
-	Session   GameSession `json:"session"`
+// sinkFactories maps the names accepted by -sinks to the setup function of
+// the matching StorageWriter.
+var sinkFactories = map[string]func() (StorageWriter, error){
+	"redis":     func() (StorageWriter, error) { return setupRedis() },
+	"cassandra": func() (StorageWriter, error) { return setupCassandra() },
+	"postgres":  func() (StorageWriter, error) { return setupPostgres() },
+	"local":     func() (StorageWriter, error) { return setupLocal() },
 }
 
 type StorageWriter interface {
-	Write(ctx context.Context, session GameSession) error
+	Write(ctx context.Context, session events.GameSession) error
 	Close()
 }
 
@@ -83,7 +95,7 @@ type CassandraWriter struct {
 	session *gocql.Session
 }
 
-func (c *CassandraWriter) Write(ctx context.Context, session GameSession) error {
+func (c *CassandraWriter) Write(ctx context.Context, session events.GameSession) error {
 	log.Printf("[Cassandra] Writing session: ID=%v, UserID=%s, Score=%d, GameMode=%s",
 		session.SessionID, session.UserID, session.Score, session.GameMode)
 
@@ -91,12 +103,15 @@ func (c *CassandraWriter) Write(ctx context.Context, session GameSession) error
 	defer timer.ObserveDuration()
 
 	err := c.session.Query(
-		`INSERT INTO game_system.game_sessions (session_id, user_id, score, game_mode, timestamp) VALUES (?, ?, ?, ?, ?)`,
+		`INSERT INTO game_system.game_sessions (session_id, user_id, score, game_mode, timestamp, result, opponents, match_id) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
 		session.SessionID,
 		session.UserID,
 		session.Score,
 		session.GameMode,
 		session.Timestamp,
+		session.Result,
+		session.Opponents,
+		session.MatchID,
 	).Exec()
 
 	if err != nil {
@@ -114,10 +129,15 @@ func (c *CassandraWriter) Close() {
 }
 
 type RedisWriter struct {
-	client *redis.Client
+	client  *redis.Client
+	seasons *seasonCache
+
+	// notifier is only set for the live consumer, so that rebuilds and
+	// replays do not notify players again.
+	notifier *rankNotifier
 }
 
-func (r *RedisWriter) Write(ctx context.Context, session GameSession) error {
+func (r *RedisWriter) Write(ctx context.Context, session events.GameSession) error {
 	leaderboardKey := "leaderboard:" + session.GameMode
 	playerKey := "user:" + session.UserID
 
@@ -127,15 +147,78 @@ func (r *RedisWriter) Write(ctx context.Context, session GameSession) error {
 	timer := prometheus.NewTimer(storageWriteDuration.WithLabelValues("redis"))
 	defer timer.ObserveDuration()
 
-	err := r.client.ZIncrBy(ctx, leaderboardKey, float64(session.Score), playerKey).Err()
+	// Every step is recorded under the session ID, so that retrying the
+	// session after a later step failed does not apply the earlier ones
+	// again.
+	sessionID := session.SessionID.String()
+
+	season, inSeason, err := r.seasons.current(ctx, session.GameMode, session.Timestamp)
+	if err != nil {
+		log.Printf("[Redis] Error loading seasons: %v", err)
+		storageWriteErrors.WithLabelValues("redis").Inc()
+		return err
+	}
+
+	var boards []notifiedBoard
+	if r.notifier != nil {
+		seasonID := ""
+		if inSeason {
+			seasonID = season.ID
+		}
+		boards = notifiedBoards(session.GameMode, seasonID)
+		if err := r.notifier.ranksBefore(ctx, r.client, playerKey, boards); err != nil {
+			log.Printf("[Redis] Error getting rank before update: %v", err)
+			storageWriteErrors.WithLabelValues("redis").Inc()
+			return err
+		}
+	}
+
+	err = r.addScore(ctx, leaderboardKey, playerKey, float64(session.Score), sessionDedupe(sessionID, "all"))
 	if err != nil {
 		log.Printf("[Redis] Error updating leaderboard: %v", err)
 		storageWriteErrors.WithLabelValues("redis").Inc()
 		return err
 	}
 
+	if inSeason {
+		seasonKey := seasons.LeaderboardKey(session.GameMode, season.ID)
+		if err := r.addScore(ctx, seasonKey, playerKey, float64(session.Score), sessionDedupe(sessionID, "season:"+season.ID)); err != nil {
+			log.Printf("[Redis] Error updating season leaderboard: %v", err)
+			storageWriteErrors.WithLabelValues("redis").Inc()
+			return err
+		}
+	}
+
+	if err := r.addRecentScore(ctx, session.GameMode, playerKey, float64(session.Score), sessionDedupe(sessionID, "recent"), session.Timestamp); err != nil {
+		log.Printf("[Redis] Error updating recent leaderboard: %v", err)
+		storageWriteErrors.WithLabelValues("redis").Inc()
+		return err
+	}
+
+	if session.Result != "" {
+		if err := r.recordMatch(ctx, session.GameMode, session.UserID, session.Result, 1, sessionDedupe(sessionID, "match")); err != nil {
+			log.Printf("[Redis] Error recording match result: %v", err)
+			storageWriteErrors.WithLabelValues("redis").Inc()
+			return err
+		}
+	}
+
+	if session.Result != "" && len(session.Opponents) > 0 {
+		if err := r.updateRating(ctx, session, sessionDedupe(sessionID, "rating")); err != nil {
+			log.Printf("[Redis] Error updating rating: %v", err)
+			storageWriteErrors.WithLabelValues("redis").Inc()
+			return err
+		}
+	}
+
+	if r.notifier != nil {
+		r.notifier.afterUpdate(ctx, r.client, session, boards)
+	}
+
 	score, err := r.client.ZScore(ctx, leaderboardKey, playerKey).Result()
-	if err != nil {
+	if err == redis.Nil {
+		log.Printf("[Redis] Held score for banned player %s", playerKey)
+	} else if err != nil {
 		log.Printf("[Redis] Error getting updated score: %v", err)
 	} else {
 		log.Printf("[Redis] Updated total score for %s: %.0f", playerKey, score)
@@ -165,7 +248,7 @@ func setupCassandra() (*CassandraWriter, error) {
 
 func setupRedis() (*RedisWriter, error) {
 	client := redis.NewClient(&redis.Options{
-		Addr:     "localhost:6379",
+		Addr:     redisServer,
 		Password: "",
 		DB:       0,
 	})
@@ -174,113 +257,365 @@ func setupRedis() (*RedisWriter, error) {
 		return nil, err
 	}
 
-	return &RedisWriter{client: client}, nil
-}
+	if err := initRecentConfig(context.Background(), client, defaultRecentHalfLife, false); err != nil {
+		client.Close()
+		return nil, err
+	}
 
-func processMessages(ctx context.Context, writer StorageWriter, mode string) error {
-	// Create a new reader with a specific partition
-	r := kafka.NewReader(kafka.ReaderConfig{
-		Brokers:     []string{"localhost:9092"},
-		Topic:       kafkaTopic,
-		StartOffset: kafka.LastOffset,
-	})
-	defer r.Close()
+	return &RedisWriter{client: client, seasons: &seasonCache{client: client}}, nil
+}
 
-	log.Println("starting message processor...")
+// processMessages consumes game-sessions on behalf of a single sink. Every sink
+// has its own consumer group so offsets are tracked per sink, and an offset is
+// only committed once the sink has stored the message.
+func processMessages(ctx context.Context, sub messaging.Subscriber, writer StorageWriter, sink string) error {
+	log.Printf("[%s] starting message processor...", sink)
 
 	for {
 		select {
 		case <-ctx.Done():
-			log.Println("shutting down message processor...")
+			log.Printf("[%s] shutting down message processor...", sink)
 			return nil
 		default:
-			msg, err := r.ReadMessage(ctx)
+			msg, err := sub.Fetch(ctx)
 			if err != nil {
+				if ctx.Err() != nil {
+					continue
+				}
 				if err.Error() == "EOF" || strings.Contains(err.Error(), "fetching message: EOF") {
 					time.Sleep(time.Second)
 					continue
 				}
-				log.Printf("error reading message: %v", err)
-				messageProcessingErrors.Inc()
+				log.Printf("[%s] error reading message: %v", sink, err)
+				messageProcessingErrors.WithLabelValues(sink).Inc()
 				time.Sleep(time.Second)
 				continue
 			}
 
 			// Start timing message processing
-			timer := prometheus.NewTimer(messageProcessingDuration)
+			timer := prometheus.NewTimer(messageProcessingDuration.WithLabelValues(sink))
 
 			// Parse the message
-			var kafkaMsg KafkaMessage
-			log.Printf("message: %s", string(msg.Value))
-			if err := json.Unmarshal(msg.Value, &kafkaMsg); err != nil {
-				log.Printf("error unmarshaling message: %v", err)
-				messageProcessingErrors.Inc()
-				timer.ObserveDuration() 
+			ev, err := decodeEvent(msg.Value, msg.Headers[events.ContentTypeHeader])
+			if err != nil {
+				// A message that cannot be decoded will never succeed, so
+				// skip past it.
+				log.Printf("[%s] rejecting message from partition %d offset %d: %v", sink, msg.Partition, msg.Offset, err)
+				messagesRejected.WithLabelValues(sink, rejectReason(err)).Inc()
+				timer.ObserveDuration()
+				commitMessage(ctx, sub, msg, sink)
 				continue
 			}
 
 			// Increment game mode counter
-			gameModeCounter.WithLabelValues(kafkaMsg.Session.GameMode).Inc()
+			if ev.Type == events.TypeGameScoreRecorded {
+				gameModeCounter.WithLabelValues(sink, ev.Session.GameMode).Inc()
+			}
 
-			// Write the session to the database
-			if err := writer.Write(ctx, kafkaMsg.Session); err != nil {
-				log.Printf("error writing session: %v", err)
-				messageProcessingErrors.Inc()
-				timer.ObserveDuration() 
+			// Apply the event to the database, retrying until it succeeds so
+			// that an outage only stalls this sink and loses no messages.
+			if err := applyWithRetry(ctx, writer, sink, ev); err != nil {
+				timer.ObserveDuration()
 				continue
 			}
 
+			commitMessage(ctx, sub, msg, sink)
+
 			// Record successful processing
-			messagesProcessed.Inc()
+			messagesProcessed.WithLabelValues(sink).Inc()
 			timer.ObserveDuration()
 
-			log.Printf("processed message from partition %d offset %d: score %d for user %s",
-				msg.Partition, msg.Offset, kafkaMsg.Session.Score, kafkaMsg.Session.UserID)
+			log.Printf("[%s] processed %s from partition %d offset %d for user %s",
+				sink, ev.Type, msg.Partition, msg.Offset, ev.UserID())
 		}
 	}
 }
 
-func main() {
+// event is a decoded game-sessions message. Only the field matching Type is
+// set.
+type event struct {
+	Type    string
+	Session events.GameSession
+	Voided  events.ScoreVoided
+	Ban     events.UserBan
+}
 
-	mode := flag.String("mode", "", "storage mode (redis or cassandra)")
-	flag.Parse()
+// UserID returns the user the event is about.
+func (e event) UserID() string {
+	switch e.Type {
+	case events.TypeScoreVoided:
+		return e.Voided.UserID
+	case events.TypeUserBanned, events.TypeUserUnbanned:
+		return e.Ban.UserID
+	default:
+		return e.Session.UserID
+	}
+}
+
+// decodeEvent decodes a game-sessions message with the encoding named by its
+// content type header, upgrading older schema versions. Messages without
+// the header are JSON.
+func decodeEvent(data []byte, contentType string) (event, error) {
+	env, err := events.Unmarshal(data, contentType)
+	if err != nil {
+		return event{}, err
+	}
+
+	ev := event{Type: env.EventType}
+	switch env.EventType {
+	case events.TypeGameScoreRecorded:
+		ev.Session, err = env.GameSession()
+	case events.TypeScoreVoided:
+		ev.Voided, err = env.ScoreVoided()
+	case events.TypeUserBanned, events.TypeUserUnbanned:
+		ev.Ban, err = env.UserBan()
+	default:
+		err = fmt.Errorf("%w: %s", events.ErrUnexpectedType, env.EventType)
+	}
+
+	return ev, err
+}
+
+// applyEvent stores ev in writer. Moderation events are ignored by sinks that
+// have no use for them.
+func applyEvent(ctx context.Context, writer StorageWriter, ev event) error {
+	switch ev.Type {
+	case events.TypeScoreVoided:
+		if voider, ok := writer.(SessionVoider); ok {
+			return voider.VoidSession(ctx, ev.Voided)
+		}
+	case events.TypeUserBanned:
+		if banner, ok := writer.(UserBanner); ok {
+			return banner.BanUser(ctx, ev.Ban)
+		}
+	case events.TypeUserUnbanned:
+		if banner, ok := writer.(UserBanner); ok {
+			return banner.UnbanUser(ctx, ev.Ban)
+		}
+	default:
+		return writer.Write(ctx, ev.Session)
+	}
+	return nil
+}
 
-	if *mode != "redis" && *mode != "cassandra" {
-		log.Fatal("invalid mode, must be 'redis' or 'cassandra'")
+// rejectReason classifies a decode error for the rejected messages metric.
+func rejectReason(err error) string {
+	switch {
+	case errors.Is(err, events.ErrUnsupportedVersion):
+		return "unsupported_version"
+	case errors.Is(err, events.ErrUnexpectedType):
+		return "unknown_event_type"
+	case errors.Is(err, events.ErrUnsupportedContentType):
+		return "unsupported_content_type"
+	default:
+		return "malformed"
 	}
+}
+
+func commitMessage(ctx context.Context, sub messaging.Subscriber, msg messaging.Message, sink string) {
+	if err := sub.Commit(ctx, msg); err != nil && ctx.Err() == nil {
+		log.Printf("[%s] error committing offset %d: %v", sink, msg.Offset, err)
+		messageProcessingErrors.WithLabelValues(sink).Inc()
+	}
+}
+
+// applyWithRetry keeps retrying a failed event with exponential backoff. It
+// only gives up when ctx is cancelled.
+func applyWithRetry(ctx context.Context, writer StorageWriter, sink string, ev event) error {
+	backoff := time.Second
+	for {
+		err := applyEvent(ctx, writer, ev)
+		if err == nil {
+			sinkUp.WithLabelValues(sink).Set(1)
+			return nil
+		}
+
+		log.Printf("[%s] error applying %s, retrying in %s: %v", sink, ev.Type, backoff, err)
+		messageProcessingErrors.WithLabelValues(sink).Inc()
+		sinkUp.WithLabelValues(sink).Set(0)
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+
+		backoff *= 2
+		if backoff > maxRetryBackoff {
+			backoff = maxRetryBackoff
+		}
+	}
+}
+
+// sinkGroupID is the consumer group of sink. Before every sink had its own
+// group the worker consumed as kafkaGroupID, which seedGroup takes over.
+func sinkGroupID(sink string) string {
+	return kafkaGroupID + "-" + sink
+}
+
+// seedGroup starts the consumer group of sink from the offsets the shared
+// kafkaGroupID committed, so that upgrading from a single group resumes
+// where it stopped instead of skipping the pending messages.
+func seedGroup(ctx context.Context, transport messaging.Transport, sink string) error {
+	seeder, ok := transport.(messaging.GroupSeeder)
+	if !ok {
+		return nil
+	}
+	return seeder.SeedGroup(ctx, kafkaTopic, kafkaGroupID, sinkGroupID(sink))
+}
+
+// runSink connects to the sink's datastore, retrying until it is reachable,
+// and then processes messages until ctx is cancelled. The notifier, if any,
+// is attached to the redis sink.
+func runSink(ctx context.Context, transport messaging.Transport, sink string, notifier *rankNotifier) {
+	setup := sinkFactories[sink]
+	backoff := time.Second
 
 	var writer StorageWriter
-	var err error
+	for {
+		var err error
+		writer, err = setup()
+		if err == nil {
+			if err = seedGroup(ctx, transport, sink); err == nil {
+				break
+			}
+			writer.Close()
+		}
 
-	if *mode == "redis" {
+		log.Printf("[%s] failed to setup sink, retrying in %s: %v", sink, backoff, err)
+		sinkUp.WithLabelValues(sink).Set(0)
 
-		go func() {
-			http.Handle("/metrics", promhttp.Handler())
-			log.Println("metrics endpoint running on :2112/metrics")
-			log.Fatal(http.ListenAndServe(":2112", nil))
-		}()
-		writer, err = setupRedis()
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
 
-	} else {
+		backoff *= 2
+		if backoff > maxRetryBackoff {
+			backoff = maxRetryBackoff
+		}
+	}
+	defer writer.Close()
 
-		go func() {
-			http.Handle("/metrics", promhttp.Handler())
-			log.Println("metrics endpoint running on :2113/metrics")
-			log.Fatal(http.ListenAndServe(":2113", nil))
-		}()
-		writer, err = setupCassandra()
+	if redisWriter, ok := writer.(*RedisWriter); ok {
+		redisWriter.notifier = notifier
 	}
+
+	sub := transport.Subscriber(kafkaTopic, sinkGroupID(sink))
+	defer sub.Close()
+
+	sinkUp.WithLabelValues(sink).Set(1)
+	if err := processMessages(ctx, sub, writer, sink); err != nil {
+		log.Printf("[%s] failed to process messages: %v", sink, err)
+	}
+	sinkUp.WithLabelValues(sink).Set(0)
+}
+
+// parseSinks splits the -sinks flag value and validates every entry.
+func parseSinks(value string) ([]string, error) {
+	var sinks []string
+	seen := make(map[string]bool)
+	for _, sink := range strings.Split(value, ",") {
+		sink = strings.TrimSpace(sink)
+		if sink == "" || seen[sink] {
+			continue
+		}
+		if _, ok := sinkFactories[sink]; !ok {
+			return nil, fmt.Errorf("unknown sink %q", sink)
+		}
+		seen[sink] = true
+		sinks = append(sinks, sink)
+	}
+
+	if len(sinks) == 0 {
+		return nil, errors.New("at least one sink is required")
+	}
+
+	return sinks, nil
+}
+
+func main() {
+
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "rebuild":
+			runRebuild(os.Args[2:])
+			return
+		case "replay":
+			runReplay(os.Args[2:])
+			return
+		case "archive":
+			runArchive(os.Args[2:])
+			return
+		case "snapshotter":
+			runSnapshotter(os.Args[2:])
+			return
+		case "webhook-sink":
+			runWebhookSink(os.Args[2:])
+			return
+		}
+	}
+
+	mode := flag.String("mode", "", "storage mode (redis, cassandra, postgres or local), shorthand for a single entry in -sinks")
+	sinksFlag := flag.String("sinks", "", "comma separated storage sinks to run in this process (redis,cassandra,postgres,local)")
+	metricsAddr := flag.String("metrics-addr", ":2112", "address to serve the metrics endpoint on")
+	notifyTop := flag.Int64("notify-top", 10, "size of the top whose entry and exit the redis sink notifies, 0 disables rank notifications")
+	webhooksFile := flag.String("webhooks", "", "JSON file listing the webhooks rank notifications are posted to")
+	flag.Parse()
+
+	if *sinksFlag == "" {
+		*sinksFlag = *mode
+	}
+
+	sinks, err := parseSinks(*sinksFlag)
 	if err != nil {
-		log.Fatalf("failed to setup %s: %v", *mode, err)
+		log.Fatalf("invalid sinks: %v", err)
 	}
 
+	go func() {
+		http.Handle("/metrics", promhttp.Handler())
+		log.Printf("metrics endpoint running on %s/metrics", *metricsAddr)
+		log.Fatal(http.ListenAndServe(*metricsAddr, nil))
+	}()
+
 	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
 	defer stop()
 
-	// Start the message processor
-	if err := processMessages(ctx, writer, *mode); err != nil {
-		log.Fatalf("failed to process messages: %v", err)
+	transport, err := messaging.FromEnv([]string{kafkaServer})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var notifier *rankNotifier
+	if *notifyTop > 0 {
+		var webhooks []WebhookConfig
+		if *webhooksFile != "" {
+			if webhooks, err = loadWebhooks(*webhooksFile); err != nil {
+				log.Fatalf("invalid webhooks: %v", err)
+			}
+		}
+
+		publisher := transport.Publisher(events.NotificationsTopic)
+		defer publisher.Close()
+
+		notifier = newRankNotifier(*notifyTop, publisher, webhooks)
+		go notifier.Run(ctx)
+	}
+
+	log.Printf("worker service started with sinks %s", strings.Join(sinks, ","))
+
+	// Every sink runs independently so a slow or failing datastore does not
+	// hold back the others.
+	var wg sync.WaitGroup
+	for _, sink := range sinks {
+		wg.Add(1)
+		go func(sink string) {
+			defer wg.Done()
+			runSink(ctx, transport, sink, notifier)
+		}(sink)
 	}
+	wg.Wait()
 
-	log.Printf("worker service started in %s mode", *mode)
+	log.Println("worker service stopped")
 }
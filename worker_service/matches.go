@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/redis/go-redis/v9"
+	"shared/matches"
+)
+
+// matchResultScript counts a match result, or uncounts it with a negative
+// delta, and updates the player's wins and win rate boards. While the player
+// is banned the board values are kept in their held scores instead, so they
+// are current when the ban is lifted. If a dedupe ID is given the change is
+// only applied the first time that ID is added to the dedupe set, which
+// then expires after the ttl unless it is 0.
+//
+// KEYS: stats, wins board, win rate board, matches config, banned users,
+// held scores, dedupe set
+// ARGV: counter field, player key, delta, dedupe ID or "", default min games,
+// dedupe ttl seconds
+var matchResultScript = redis.NewScript(`
+if ARGV[4] ~= "" then
+	if redis.call("SADD", KEYS[7], ARGV[4]) == 0 then
+		return 0
+	end
+	if tonumber(ARGV[6]) > 0 then
+		redis.call("EXPIRE", KEYS[7], ARGV[6])
+	end
+end
+local delta = tonumber(ARGV[3])
+local games = redis.call("HINCRBY", KEYS[1], "games", delta)
+redis.call("HINCRBY", KEYS[1], ARGV[1], delta)
+local wins = tonumber(redis.call("HGET", KEYS[1], "wins") or "0")
+local minGames = tonumber(redis.call("HGET", KEYS[4], "min_games")) or tonumber(ARGV[5])
+
+local winRate = nil
+if games > 0 and games >= minGames then
+	winRate = wins / games
+end
+
+if redis.call("SISMEMBER", KEYS[5], ARGV[2]) == 1 then
+	if wins > 0 then
+		redis.call("HSET", KEYS[6], KEYS[2], wins)
+	else
+		redis.call("HDEL", KEYS[6], KEYS[2])
+	end
+	if winRate then
+		redis.call("HSET", KEYS[6], KEYS[3], winRate)
+	else
+		redis.call("HDEL", KEYS[6], KEYS[3])
+	end
+	return 0
+end
+
+if wins > 0 then
+	redis.call("ZADD", KEYS[2], wins, ARGV[2])
+else
+	redis.call("ZREM", KEYS[2], ARGV[2])
+end
+if winRate then
+	redis.call("ZADD", KEYS[3], winRate, ARGV[2])
+else
+	redis.call("ZREM", KEYS[3], ARGV[2])
+end
+return 1
+`)
+
+// recordMatch applies a match result of userID to the stats and boards of
+// gameMode. delta is 1 to count the result and -1 to void it.
+func (r *RedisWriter) recordMatch(ctx context.Context, gameMode, userID, result string, delta int, d dedupe) error {
+	field := matches.CounterField(result)
+	if field == "" {
+		return fmt.Errorf("unknown match result %q", result)
+	}
+
+	playerKey := "user:" + userID
+	id, ttl := d.args()
+	return matchResultScript.Run(ctx, r.client,
+		[]string{
+			matches.StatsKey(gameMode, userID),
+			"leaderboard:" + matches.WinsBoard(gameMode),
+			"leaderboard:" + matches.WinRateBoard(gameMode),
+			matches.ConfigKey,
+			bannedUsersKey,
+			heldScoresKey(playerKey),
+			d.key,
+		},
+		field, playerKey, delta, id, matches.DefaultMinGames, ttl,
+	).Err()
+}
@@ -0,0 +1,21 @@
+-- Game sessions for the postgres sink, partitioned by month.
+--
+-- Partitioned tables only allow unique constraints that include the
+-- partition key, so the primary key is (session_id, timestamp). Session IDs
+-- are time based UUIDs whose time is the session timestamp, so this is as
+-- strict as a unique session_id.
+--
+-- Monthly partitions are created on demand by the worker, e.g.
+--   CREATE TABLE game_sessions_y2025m04 PARTITION OF game_sessions
+--       FOR VALUES FROM ('2025-04-01') TO ('2025-05-01');
+
+CREATE TABLE IF NOT EXISTS game_sessions (
+    session_id UUID NOT NULL,
+    user_id VARCHAR(255) NOT NULL,
+    score INTEGER NOT NULL,
+    game_mode VARCHAR(255) NOT NULL,
+    timestamp TIMESTAMPTZ NOT NULL,
+    PRIMARY KEY (session_id, timestamp)
+) PARTITION BY RANGE (timestamp);
+
+CREATE INDEX IF NOT EXISTS game_sessions_user_id_idx ON game_sessions (user_id, timestamp DESC);
@@ -0,0 +1,2 @@
+-- Sessions voided by a score_voided event are kept but flagged.
+ALTER TABLE game_sessions ADD COLUMN IF NOT EXISTS voided BOOLEAN NOT NULL DEFAULT FALSE;
@@ -0,0 +1,14 @@
+-- Final standings of ended seasons, written by the worker's archive
+-- subcommand. Archiving a season again replaces its standings.
+
+CREATE TABLE IF NOT EXISTS season_standings (
+    season_id VARCHAR(255) NOT NULL,
+    game_mode VARCHAR(255) NOT NULL,
+    rank BIGINT NOT NULL,
+    user_id VARCHAR(255) NOT NULL,
+    score DOUBLE PRECISION NOT NULL,
+    archived_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    PRIMARY KEY (season_id, game_mode, rank)
+);
+
+CREATE INDEX IF NOT EXISTS season_standings_user_id_idx ON season_standings (user_id);
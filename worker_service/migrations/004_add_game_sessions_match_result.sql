@@ -0,0 +1,4 @@
+-- Match outcome of sessions that were matches: "win", "loss" or "draw", and
+-- the user IDs of the other players.
+ALTER TABLE game_sessions ADD COLUMN IF NOT EXISTS result VARCHAR(16);
+ALTER TABLE game_sessions ADD COLUMN IF NOT EXISTS opponents TEXT[];
@@ -0,0 +1,2 @@
+-- The match a session belongs to, shared by the sessions of all its players.
+ALTER TABLE game_sessions ADD COLUMN IF NOT EXISTS match_id VARCHAR(255);
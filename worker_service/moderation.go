@@ -0,0 +1,345 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/redis/go-redis/v9"
+	"shared/events"
+	"shared/recent"
+	"shared/seasons"
+)
+
+const (
+	// bannedUsersKey holds the player keys of every banned user.
+	bannedUsersKey = "banned_users"
+	// voidedSessionsKey holds the IDs of voided sessions so that a redelivered
+	// score_voided event is only subtracted once.
+	voidedSessionsKey = "voided_sessions"
+
+	// appliedSessionTTL is how long the steps applied for a session are
+	// remembered, well beyond the retention of game-sessions.
+	appliedSessionTTL = 30 * 24 * time.Hour
+)
+
+// dedupe names the set recording that a change was applied, and the member
+// recording it, so that a change retried or redelivered is applied once.
+// With a ttl the set expires that long after its last change.
+type dedupe struct {
+	key string
+	id  string
+	ttl time.Duration
+}
+
+// voidDedupe records the void of a session permanently under id.
+func voidDedupe(id string) dedupe {
+	return dedupe{key: voidedSessionsKey, id: id}
+}
+
+// appliedSessionKey is the set of the steps applied for a session, such as
+// its all-time, season and recent boards.
+func appliedSessionKey(sessionID string) string {
+	return "session:" + sessionID + ":applied"
+}
+
+// sessionDedupe records that step was applied for sessionID.
+func sessionDedupe(sessionID, step string) dedupe {
+	return dedupe{key: appliedSessionKey(sessionID), id: step, ttl: appliedSessionTTL}
+}
+
+// args returns the ID and ttl arguments of the scripts taking a dedupe.
+func (d dedupe) args() (string, int64) {
+	return d.id, int64(d.ttl.Seconds())
+}
+
+// SessionVoider is implemented by sinks that can void a stored session.
+type SessionVoider interface {
+	VoidSession(ctx context.Context, voided events.ScoreVoided) error
+}
+
+// UserBanner is implemented by sinks that can hide a user's scores while
+// they are banned and restore them afterwards.
+type UserBanner interface {
+	BanUser(ctx context.Context, ban events.UserBan) error
+	UnbanUser(ctx context.Context, ban events.UserBan) error
+}
+
+// heldScoresKey is the hash holding a banned player's scores, keyed by the
+// leaderboard they were removed from.
+func heldScoresKey(playerKey string) string {
+	return "banned:" + playerKey
+}
+
+// addScoreScript adds a score to a leaderboard, or to the player's held
+// scores while they are banned. If a dedupe ID is given the score is only
+// added the first time that ID is added to the dedupe set, which then
+// expires after the ttl unless it is 0. If a time is given the score is
+// weighted for a recent board, see package recent, and the script returns
+// the whole number of half-lives since the epoch. A missing recent config,
+// e.g. after the database was flushed, is re-created from the default
+// half-life and epoch.
+//
+// KEYS: leaderboard, banned users, held scores, dedupe set, recent config
+// ARGV: score, player key, dedupe ID or "", unix time or "", dedupe ttl seconds,
+// default half-life seconds, default epoch
+var addScoreScript = redis.NewScript(`
+local score = tonumber(ARGV[1])
+local halfLives = 0
+if ARGV[4] ~= "" then
+	redis.call("HSETNX", KEYS[5], "half_life", ARGV[6])
+	redis.call("HSETNX", KEYS[5], "epoch", ARGV[7])
+	local halfLife = tonumber(redis.call("HGET", KEYS[5], "half_life"))
+	local epoch = tonumber(redis.call("HGET", KEYS[5], "epoch"))
+	if not halfLife or not epoch then
+		return redis.error_reply("recent leaderboard config is invalid")
+	end
+	halfLives = (tonumber(ARGV[4]) - epoch) / halfLife
+	score = score * math.pow(2, halfLives)
+end
+if ARGV[3] ~= "" then
+	if redis.call("SADD", KEYS[4], ARGV[3]) == 0 then
+		return math.floor(halfLives)
+	end
+	if tonumber(ARGV[5]) > 0 then
+		redis.call("EXPIRE", KEYS[4], ARGV[5])
+	end
+end
+if redis.call("SISMEMBER", KEYS[2], ARGV[2]) == 1 then
+	redis.call("HINCRBYFLOAT", KEYS[3], KEYS[1], score)
+else
+	redis.call("ZINCRBY", KEYS[1], score, ARGV[2])
+end
+return math.floor(halfLives)
+`)
+
+// holdScoreScript moves a player's score from a leaderboard to their held
+// scores.
+//
+// KEYS: leaderboard, held scores
+// ARGV: player key
+var holdScoreScript = redis.NewScript(`
+local score = redis.call("ZSCORE", KEYS[1], ARGV[1])
+if score then
+	redis.call("HINCRBYFLOAT", KEYS[2], KEYS[1], score)
+	redis.call("ZREM", KEYS[1], ARGV[1])
+end
+return 0
+`)
+
+// restoreScoreScript moves one held score back to its leaderboard.
+//
+// KEYS: leaderboard, held scores
+// ARGV: player key
+var restoreScoreScript = redis.NewScript(`
+local score = redis.call("HGET", KEYS[2], KEYS[1])
+if score then
+	redis.call("ZINCRBY", KEYS[1], score, ARGV[1])
+	redis.call("HDEL", KEYS[2], KEYS[1])
+end
+return 0
+`)
+
+// addScore applies a score change to a leaderboard once, respecting bans.
+func (r *RedisWriter) addScore(ctx context.Context, leaderboardKey, playerKey string, score float64, d dedupe) error {
+	id, ttl := d.args()
+	return addScoreScript.Run(ctx, r.client,
+		[]string{leaderboardKey, bannedUsersKey, heldScoresKey(playerKey), d.key, recent.ConfigKey},
+		score, playerKey, id, "", ttl, "", "",
+	).Err()
+}
+
+func (r *RedisWriter) VoidSession(ctx context.Context, voided events.ScoreVoided) error {
+	leaderboardKey := "leaderboard:" + voided.GameMode
+	playerKey := "user:" + voided.UserID
+
+	log.Printf("[Redis] Voiding session %v: Key=%s, Player=%s, Score=%d, Reason=%s",
+		voided.SessionID, leaderboardKey, playerKey, voided.Score, voided.Reason)
+
+	timer := prometheus.NewTimer(storageWriteDuration.WithLabelValues("redis"))
+	defer timer.ObserveDuration()
+
+	// The session also counted towards the season it was played in. That
+	// board is deduplicated under its own ID.
+	season, inSeason, err := r.seasons.current(ctx, voided.GameMode, voided.SessionID.Time())
+	if err != nil {
+		log.Printf("[Redis] Error loading seasons: %v", err)
+		storageWriteErrors.WithLabelValues("redis").Inc()
+		return err
+	}
+
+	var boards []notifiedBoard
+	if r.notifier != nil {
+		seasonID := ""
+		if inSeason {
+			seasonID = season.ID
+		}
+		boards = notifiedBoards(voided.GameMode, seasonID)
+		if err := r.notifier.ranksBefore(ctx, r.client, playerKey, boards); err != nil {
+			log.Printf("[Redis] Error getting rank before void: %v", err)
+			storageWriteErrors.WithLabelValues("redis").Inc()
+			return err
+		}
+	}
+
+	err = r.addScore(ctx, leaderboardKey, playerKey, -float64(voided.Score), voidDedupe(voided.SessionID.String()))
+	if err != nil {
+		log.Printf("[Redis] Error voiding session: %v", err)
+		storageWriteErrors.WithLabelValues("redis").Inc()
+		return err
+	}
+
+	if inSeason {
+		seasonKey := seasons.LeaderboardKey(voided.GameMode, season.ID)
+		dedupeID := voided.SessionID.String() + ":season:" + season.ID
+		if err := r.addScore(ctx, seasonKey, playerKey, -float64(voided.Score), voidDedupe(dedupeID)); err != nil {
+			log.Printf("[Redis] Error voiding session on season leaderboard: %v", err)
+			storageWriteErrors.WithLabelValues("redis").Inc()
+			return err
+		}
+	}
+
+	// Likewise for the recent board, where it is weighted by its time.
+	dedupeID := voided.SessionID.String() + ":recent"
+	if err := r.addRecentScore(ctx, voided.GameMode, playerKey, -float64(voided.Score), voidDedupe(dedupeID), voided.SessionID.Time()); err != nil {
+		log.Printf("[Redis] Error voiding session on recent leaderboard: %v", err)
+		storageWriteErrors.WithLabelValues("redis").Inc()
+		return err
+	}
+
+	if voided.Result != "" {
+		dedupeID := voided.SessionID.String() + ":match"
+		if err := r.recordMatch(ctx, voided.GameMode, voided.UserID, voided.Result, -1, voidDedupe(dedupeID)); err != nil {
+			log.Printf("[Redis] Error voiding match result: %v", err)
+			storageWriteErrors.WithLabelValues("redis").Inc()
+			return err
+		}
+	}
+
+	if r.notifier != nil {
+		r.notifier.afterRemoval(ctx, r.client, voided.UserID, boards)
+	}
+	return nil
+}
+
+// BanUser marks the user as banned and moves their scores off every
+// leaderboard. Sessions arriving while they are banned are held as well.
+// Players moving into a top the user left are notified.
+func (r *RedisWriter) BanUser(ctx context.Context, ban events.UserBan) error {
+	playerKey := "user:" + ban.UserID
+
+	log.Printf("[Redis] Banning %s: Reason=%s", playerKey, ban.Reason)
+
+	if err := r.client.SAdd(ctx, bannedUsersKey, playerKey).Err(); err != nil {
+		storageWriteErrors.WithLabelValues("redis").Inc()
+		return err
+	}
+
+	var boards []notifiedBoard
+	iter := r.client.ScanType(ctx, 0, "leaderboard:*", 100, "zset").Iterator()
+	for iter.Next(ctx) {
+		if board, ok := notifiedBoardOf(iter.Val()); ok && r.notifier != nil {
+			rank, err := r.client.ZRevRank(ctx, board.key, playerKey).Result()
+			if err != nil && err != redis.Nil {
+				storageWriteErrors.WithLabelValues("redis").Inc()
+				return err
+			}
+			if err == nil {
+				board.prev = rank
+				boards = append(boards, board)
+			}
+		}
+
+		err := holdScoreScript.Run(ctx, r.client, []string{iter.Val(), heldScoresKey(playerKey)}, playerKey).Err()
+		if err != nil {
+			storageWriteErrors.WithLabelValues("redis").Inc()
+			return err
+		}
+	}
+	if err := iter.Err(); err != nil {
+		storageWriteErrors.WithLabelValues("redis").Inc()
+		return err
+	}
+
+	if r.notifier != nil {
+		r.notifier.afterRemoval(ctx, r.client, ban.UserID, boards)
+	}
+	return nil
+}
+
+// UnbanUser lifts the ban and adds the held scores back to their
+// leaderboards.
+func (r *RedisWriter) UnbanUser(ctx context.Context, ban events.UserBan) error {
+	playerKey := "user:" + ban.UserID
+
+	log.Printf("[Redis] Unbanning %s: Reason=%s", playerKey, ban.Reason)
+
+	if err := r.client.SRem(ctx, bannedUsersKey, playerKey).Err(); err != nil {
+		storageWriteErrors.WithLabelValues("redis").Inc()
+		return err
+	}
+
+	leaderboardKeys, err := r.client.HKeys(ctx, heldScoresKey(playerKey)).Result()
+	if err != nil {
+		storageWriteErrors.WithLabelValues("redis").Inc()
+		return err
+	}
+
+	for _, leaderboardKey := range leaderboardKeys {
+		err := restoreScoreScript.Run(ctx, r.client, []string{leaderboardKey, heldScoresKey(playerKey)}, playerKey).Err()
+		if err != nil {
+			storageWriteErrors.WithLabelValues("redis").Inc()
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (c *CassandraWriter) VoidSession(ctx context.Context, voided events.ScoreVoided) error {
+	log.Printf("[Cassandra] Voiding session %v for user %s: Reason=%s", voided.SessionID, voided.UserID, voided.Reason)
+
+	timer := prometheus.NewTimer(storageWriteDuration.WithLabelValues("cassandra"))
+	defer timer.ObserveDuration()
+
+	// The session timestamp is the time of its time based ID, which
+	// completes the primary key.
+	err := c.session.Query(
+		`UPDATE game_system.game_sessions SET voided = true WHERE user_id = ? AND timestamp = ? AND session_id = ? IF EXISTS`,
+		voided.UserID,
+		voided.SessionID.Time(),
+		voided.SessionID,
+	).WithContext(ctx).Exec()
+
+	if err != nil {
+		log.Printf("[Cassandra] Error voiding session: %v", err)
+		storageWriteErrors.WithLabelValues("cassandra").Inc()
+		return err
+	}
+
+	return nil
+}
+
+func (p *PostgresWriter) VoidSession(ctx context.Context, voided events.ScoreVoided) error {
+	log.Printf("[Postgres] Voiding session %v for user %s: Reason=%s", voided.SessionID, voided.UserID, voided.Reason)
+
+	timer := prometheus.NewTimer(storageWriteDuration.WithLabelValues("postgres"))
+	defer timer.ObserveDuration()
+
+	// The window around the time of the session ID keeps the lookup to one
+	// partition while allowing for postgres rounding to microseconds.
+	ts := voided.SessionID.Time()
+	_, err := p.db.ExecContext(ctx,
+		`UPDATE game_sessions SET voided = true WHERE session_id = $1 AND timestamp BETWEEN $2 AND $3`,
+		voided.SessionID.String(), ts.Add(-time.Millisecond), ts.Add(time.Millisecond),
+	)
+
+	if err != nil {
+		log.Printf("[Postgres] Error voiding session: %v", err)
+		storageWriteErrors.WithLabelValues("postgres").Inc()
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,570 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/redis/go-redis/v9"
+	"shared/events"
+	"shared/messaging"
+	"shared/seasons"
+)
+
+const (
+	notificationsProducer = "worker_service"
+
+	// maxOvertakenChecked bounds the players checked for friends when a
+	// player jumps far up a board.
+	maxOvertakenChecked = 100
+
+	publishQueueSize = 1000
+	publishBatchSize = 100
+	publishTimeout   = 10 * time.Second
+
+	webhookQueueSize   = 1000
+	webhookWorkers     = 4
+	webhookMaxAttempts = 5
+	webhookTimeout     = 10 * time.Second
+
+	webhookSignatureHeader = "X-Webhook-Signature"
+	webhookTimestampHeader = "X-Webhook-Timestamp"
+)
+
+var (
+	notificationsEmitted = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "worker_notifications_emitted_total",
+		Help: "The total number of rank notifications emitted by type",
+	}, []string{"type"})
+
+	notificationPublishes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "worker_notification_publishes_total",
+		Help: "The total number of notifications sent to the notifications topic by result (published, failed or dropped)",
+	}, []string{"result"})
+
+	webhookDeliveries = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "worker_webhook_deliveries_total",
+		Help: "The total number of webhook deliveries by result (delivered, failed or dropped)",
+	}, []string{"result"})
+)
+
+// friendsKey is the set of user IDs whose overtakes userID is notified of.
+func friendsKey(userID string) string {
+	return "friends:user:" + userID
+}
+
+// personalBestKey is the hash of every player's best session score in a mode.
+func personalBestKey(gameMode string) string {
+	return "personal_best:" + gameMode
+}
+
+// personalBestScript stores a session score if it beats the player's best
+// and returns 1 if it beat a previous best.
+//
+// KEYS: personal bests
+// ARGV: user ID, score
+var personalBestScript = redis.NewScript(`
+local best = redis.call("HGET", KEYS[1], ARGV[1])
+if best and tonumber(best) >= tonumber(ARGV[2]) then
+	return 0
+end
+redis.call("HSET", KEYS[1], ARGV[1], ARGV[2])
+if best then
+	return 1
+end
+return 0
+`)
+
+// WebhookConfig is an outbound webhook. Events lists the notification types
+// it receives, all of them when empty.
+type WebhookConfig struct {
+	URL    string   `json:"url"`
+	Secret string   `json:"secret"`
+	Events []string `json:"events"`
+}
+
+func (c WebhookConfig) wants(eventType string) bool {
+	if len(c.Events) == 0 {
+		return true
+	}
+	for _, e := range c.Events {
+		if e == eventType {
+			return true
+		}
+	}
+	return false
+}
+
+// loadWebhooks reads a JSON array of WebhookConfig.
+func loadWebhooks(path string) ([]WebhookConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var webhooks []WebhookConfig
+	if err := json.Unmarshal(data, &webhooks); err != nil {
+		return nil, err
+	}
+
+	for i, webhook := range webhooks {
+		if webhook.URL == "" || webhook.Secret == "" {
+			return nil, fmt.Errorf("webhook %d needs a url and a secret", i)
+		}
+	}
+	return webhooks, nil
+}
+
+type webhookDelivery struct {
+	webhook WebhookConfig
+	event   events.Envelope
+	body    []byte
+}
+
+// rankNotifier detects rank crossings caused by leaderboard updates of the
+// redis sink and emits them to the notifications topic and the webhooks.
+// Both are queued and sent in the background, so that a slow broker or
+// webhook does not hold back the sink. Notifications are best effort:
+// failures are logged and never fail the leaderboard update, notifications
+// are dropped while a queue is full, and queued ones are lost on shutdown.
+type rankNotifier struct {
+	topN         int64
+	publisher    messaging.Publisher
+	publications chan messaging.Message
+	webhooks     []WebhookConfig
+	deliveries   chan webhookDelivery
+	httpClient   *http.Client
+}
+
+func newRankNotifier(topN int64, publisher messaging.Publisher, webhooks []WebhookConfig) *rankNotifier {
+	return &rankNotifier{
+		topN:         topN,
+		publisher:    publisher,
+		publications: make(chan messaging.Message, publishQueueSize),
+		webhooks:     webhooks,
+		deliveries:   make(chan webhookDelivery, webhookQueueSize),
+		httpClient:   &http.Client{Timeout: webhookTimeout},
+	}
+}
+
+// Run publishes the queued notifications and delivers the queued webhooks
+// until ctx is cancelled.
+func (n *rankNotifier) Run(ctx context.Context) {
+	var wg sync.WaitGroup
+	if n.publisher != nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			n.publishQueued(ctx)
+		}()
+	}
+
+	for i := 0; i < webhookWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case delivery := <-n.deliveries:
+					n.deliver(ctx, delivery)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// notifiedBoard is a board whose top crossings are notified, with a
+// player's 0-based rank on it before an update, or -1 if they were not on
+// it. seasonID is set for season boards.
+type notifiedBoard struct {
+	key      string
+	gameMode string
+	seasonID string
+	prev     int64
+}
+
+// notifiedBoards returns the boards of gameMode whose crossings are
+// notified: the all-time board and the board of seasonID, if any.
+func notifiedBoards(gameMode, seasonID string) []notifiedBoard {
+	boards := []notifiedBoard{{key: "leaderboard:" + gameMode, gameMode: gameMode, prev: -1}}
+	if seasonID != "" {
+		boards = append(boards, notifiedBoard{
+			key: seasons.LeaderboardKey(gameMode, seasonID), gameMode: gameMode, seasonID: seasonID, prev: -1,
+		})
+	}
+	return boards
+}
+
+// notifiedBoardOf returns the notified board stored under leaderboardKey,
+// if it is an all-time or a season board.
+func notifiedBoardOf(leaderboardKey string) (notifiedBoard, bool) {
+	board := strings.TrimPrefix(leaderboardKey, "leaderboard:")
+	if !strings.Contains(board, ":") {
+		return notifiedBoard{key: leaderboardKey, gameMode: board, prev: -1}, true
+	}
+	gameMode, seasonID, ok := strings.Cut(board, ":season:")
+	if !ok || strings.Contains(gameMode, ":") || seasonID == "" {
+		return notifiedBoard{}, false
+	}
+	return notifiedBoard{key: leaderboardKey, gameMode: gameMode, seasonID: seasonID, prev: -1}, true
+}
+
+// ranksBefore sets the rank of playerKey on every board before an update.
+func (n *rankNotifier) ranksBefore(ctx context.Context, client *redis.Client, playerKey string, boards []notifiedBoard) error {
+	pipe := client.Pipeline()
+	ranks := make([]*redis.IntCmd, len(boards))
+	for i, board := range boards {
+		ranks[i] = pipe.ZRevRank(ctx, board.key, playerKey)
+	}
+	if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+		return err
+	}
+
+	for i, rank := range ranks {
+		boards[i].prev = -1
+		if rank.Err() == nil {
+			boards[i].prev = rank.Val()
+		}
+	}
+	return nil
+}
+
+// afterUpdate emits the notifications caused by session: a personal best,
+// and the crossings of the player on each of boards.
+func (n *rankNotifier) afterUpdate(ctx context.Context, client *redis.Client, session events.GameSession, boards []notifiedBoard) {
+	var notifications []events.Envelope
+
+	best, err := personalBestScript.Run(ctx, client, []string{personalBestKey(session.GameMode)}, session.UserID, session.Score).Int()
+	if err != nil {
+		log.Printf("[Notify] Error updating personal best: %v", err)
+	} else if best == 1 {
+		notifications = n.add(notifications, events.TypePersonalBest, events.RankNotification{
+			UserID: session.UserID, GameMode: session.GameMode, Score: float64(session.Score),
+		})
+	}
+
+	for _, board := range boards {
+		notifications = n.crossings(ctx, client, notifications, board, session.UserID)
+	}
+	n.emit(ctx, notifications)
+}
+
+// afterRemoval emits the crossings caused by scores of userID leaving
+// boards, because a session was voided or the user banned. The player may
+// drop out of the top, promoting whoever is now last of it.
+func (n *rankNotifier) afterRemoval(ctx context.Context, client *redis.Client, userID string, boards []notifiedBoard) {
+	var notifications []events.Envelope
+	for _, board := range boards {
+		notifications = n.crossings(ctx, client, notifications, board, userID)
+	}
+	n.emit(ctx, notifications)
+}
+
+// add appends a notification of eventType to notifications.
+func (n *rankNotifier) add(notifications []events.Envelope, eventType string, notification events.RankNotification) []events.Envelope {
+	env, err := events.NewEnvelope(eventType, notificationsProducer, notification)
+	if err != nil {
+		log.Printf("[Notify] Error creating %s: %v", eventType, err)
+		return notifications
+	}
+	return append(notifications, env)
+}
+
+// crossings compares the rank of userID on board to their rank before the
+// update, and appends the resulting notifications: the player entering or
+// leaving the top, whoever that pushed out of or into it, and the friends
+// the player moved past. A player no longer on the board, e.g. banned, is
+// not notified themselves.
+func (n *rankNotifier) crossings(ctx context.Context, client *redis.Client, notifications []events.Envelope, board notifiedBoard, userID string) []events.Envelope {
+	playerKey := "user:" + userID
+	add := func(eventType string, notification events.RankNotification) {
+		notification.GameMode = board.gameMode
+		notification.SeasonID = board.seasonID
+		notifications = n.add(notifications, eventType, notification)
+	}
+
+	rank, err := client.ZRevRank(ctx, board.key, playerKey).Result()
+	if err == redis.Nil {
+		rank = -1
+	} else if err != nil {
+		log.Printf("[Notify] Error getting rank on %s: %v", board.key, err)
+		return notifications
+	}
+
+	var score float64
+	if rank >= 0 {
+		if score, err = client.ZScore(ctx, board.key, playerKey).Result(); err != nil {
+			log.Printf("[Notify] Error getting score on %s: %v", board.key, err)
+			return notifications
+		}
+	}
+
+	prev := board.prev
+	wasTop := prev >= 0 && prev < n.topN
+	isTop := rank >= 0 && rank < n.topN
+	switch {
+	case isTop && !wasTop:
+		add(events.TypeTopNEntered, events.RankNotification{
+			UserID: userID, Rank: rank + 1, PreviousRank: prev + 1, Score: score, TopN: n.topN,
+		})
+		// Whoever is now just below the top was pushed out by the player.
+		if pushed, err := n.memberAt(ctx, client, board.key, n.topN); err != nil {
+			log.Printf("[Notify] Error getting player below the top: %v", err)
+		} else if pushed.Member != nil {
+			add(events.TypeTopNExited, events.RankNotification{
+				UserID: userIDOf(pushed), Rank: n.topN + 1, PreviousRank: n.topN, Score: pushed.Score, TopN: n.topN,
+				OtherUserID: userID,
+			})
+		}
+	case wasTop && !isTop:
+		if rank >= 0 {
+			add(events.TypeTopNExited, events.RankNotification{
+				UserID: userID, Rank: rank + 1, PreviousRank: prev + 1, Score: score, TopN: n.topN,
+			})
+		}
+		if promoted, err := n.memberAt(ctx, client, board.key, n.topN-1); err != nil {
+			log.Printf("[Notify] Error getting last player of the top: %v", err)
+		} else if promoted.Member != nil {
+			add(events.TypeTopNEntered, events.RankNotification{
+				UserID: userIDOf(promoted), Rank: n.topN, PreviousRank: n.topN + 1, Score: promoted.Score, TopN: n.topN,
+			})
+		}
+	}
+
+	if rank < 0 {
+		return notifications
+	}
+
+	// The players the update moved past are now ranked right after the
+	// player, up to their previous rank.
+	last := rank + maxOvertakenChecked
+	if prev >= 0 && prev < last {
+		last = prev
+	}
+	if last > rank {
+		overtaken, err := n.overtakenFriends(ctx, client, board.key, userID, rank+1, last)
+		if err != nil {
+			log.Printf("[Notify] Error checking overtaken friends: %v", err)
+		}
+		for _, notification := range overtaken {
+			add(events.TypeOvertakenByFriend, notification)
+		}
+	}
+	return notifications
+}
+
+// memberAt returns the member at a 0-based rank, with a nil Member if the
+// board is shorter.
+func (n *rankNotifier) memberAt(ctx context.Context, client *redis.Client, leaderboardKey string, rank int64) (redis.Z, error) {
+	result, err := client.ZRevRangeWithScores(ctx, leaderboardKey, rank, rank).Result()
+	if err != nil || len(result) == 0 {
+		return redis.Z{}, err
+	}
+	return result[0], nil
+}
+
+// overtakenFriends returns a notification for every player at a 0-based
+// rank from first to last who has userID among their friends.
+func (n *rankNotifier) overtakenFriends(ctx context.Context, client *redis.Client, leaderboardKey, userID string, first, last int64) ([]events.RankNotification, error) {
+	players, err := client.ZRevRangeWithScores(ctx, leaderboardKey, first, last).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	pipe := client.Pipeline()
+	checks := make([]*redis.BoolCmd, len(players))
+	for i, z := range players {
+		checks[i] = pipe.SIsMember(ctx, friendsKey(userIDOf(z)), userID)
+	}
+	if len(players) > 0 {
+		if _, err := pipe.Exec(ctx); err != nil {
+			return nil, err
+		}
+	}
+
+	var notifications []events.RankNotification
+	for i, check := range checks {
+		if check.Val() {
+			notifications = append(notifications, events.RankNotification{
+				UserID:      userIDOf(players[i]),
+				Rank:        first + int64(i) + 1,
+				Score:       players[i].Score,
+				OtherUserID: userID,
+			})
+		}
+	}
+	return notifications, nil
+}
+
+func seasonSuffix(seasonID string) string {
+	if seasonID == "" {
+		return ""
+	}
+	return " season " + seasonID
+}
+
+func userIDOf(z redis.Z) string {
+	member, _ := z.Member.(string)
+	return strings.TrimPrefix(member, "user:")
+}
+
+// emit publishes notifications to the topic and queues them for the
+// webhooks that want them.
+func (n *rankNotifier) emit(ctx context.Context, notifications []events.Envelope) {
+	for _, env := range notifications {
+		notificationsEmitted.WithLabelValues(env.EventType).Inc()
+
+		body, err := events.Encode(env)
+		if err != nil {
+			log.Printf("[Notify] Error encoding %s: %v", env.EventType, err)
+			continue
+		}
+
+		notification, _ := env.RankNotification()
+		log.Printf("[Notify] %s for user %s in %s%s", env.EventType, notification.UserID, notification.GameMode,
+			seasonSuffix(notification.SeasonID))
+
+		if n.publisher != nil {
+			select {
+			case n.publications <- messaging.Message{
+				Key:     []byte(notification.UserID),
+				Value:   body,
+				Headers: map[string]string{events.ContentTypeHeader: events.ContentTypeJSON},
+			}:
+			default:
+				log.Printf("[Notify] Publish queue full, dropping %s", env.EventID)
+				notificationPublishes.WithLabelValues("dropped").Inc()
+			}
+		}
+
+		for _, webhook := range n.webhooks {
+			if !webhook.wants(env.EventType) {
+				continue
+			}
+			select {
+			case n.deliveries <- webhookDelivery{webhook: webhook, event: env, body: body}:
+			default:
+				log.Printf("[Notify] Webhook queue full, dropping %s for %s", env.EventID, webhook.URL)
+				webhookDeliveries.WithLabelValues("dropped").Inc()
+			}
+		}
+	}
+}
+
+// publishQueued publishes the queued notifications, in batches of those
+// queued while the previous batch was sent.
+func (n *rankNotifier) publishQueued(ctx context.Context) {
+	for {
+		var batch []messaging.Message
+		select {
+		case <-ctx.Done():
+			return
+		case msg := <-n.publications:
+			batch = append(batch, msg)
+		}
+	collect:
+		for len(batch) < publishBatchSize {
+			select {
+			case msg := <-n.publications:
+				batch = append(batch, msg)
+			default:
+				break collect
+			}
+		}
+
+		publishCtx, cancel := context.WithTimeout(ctx, publishTimeout)
+		err := n.publisher.Publish(publishCtx, batch...)
+		cancel()
+		if err != nil {
+			log.Printf("[Notify] Error publishing %d notifications: %v", len(batch), err)
+			notificationPublishes.WithLabelValues("failed").Add(float64(len(batch)))
+			continue
+		}
+		notificationPublishes.WithLabelValues("published").Add(float64(len(batch)))
+	}
+}
+
+// deliver posts a notification to a webhook, retrying with exponential
+// backoff on network errors, 5xx and 429 responses.
+func (n *rankNotifier) deliver(ctx context.Context, delivery webhookDelivery) {
+	backoff := time.Second
+	for attempt := 1; ; attempt++ {
+		retry, err := n.post(ctx, delivery)
+		if err == nil {
+			webhookDeliveries.WithLabelValues("delivered").Inc()
+			return
+		}
+
+		if !retry || attempt == webhookMaxAttempts {
+			log.Printf("[Notify] Giving up on %s for %s after %d attempts: %v",
+				delivery.event.EventID, delivery.webhook.URL, attempt, err)
+			webhookDeliveries.WithLabelValues("failed").Inc()
+			return
+		}
+
+		log.Printf("[Notify] Delivering %s to %s failed, retrying in %s: %v",
+			delivery.event.EventID, delivery.webhook.URL, backoff, err)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+// post makes a single delivery attempt and reports whether a failure is
+// worth retrying.
+func (n *rankNotifier) post(ctx context.Context, delivery webhookDelivery) (bool, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, delivery.webhook.URL, bytes.NewReader(delivery.body))
+	if err != nil {
+		return false, err
+	}
+
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Webhook-Event", delivery.event.EventType)
+	req.Header.Set("X-Webhook-ID", delivery.event.EventID)
+	req.Header.Set(webhookTimestampHeader, timestamp)
+	req.Header.Set(webhookSignatureHeader, signWebhook(delivery.webhook.Secret, timestamp, delivery.body))
+
+	resp, err := n.httpClient.Do(req)
+	if err != nil {
+		return true, err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return false, nil
+	}
+	retry := resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests
+	return retry, fmt.Errorf("webhook returned status %d", resp.StatusCode)
+}
+
+// signWebhook returns the signature header of a delivery: the hex HMAC-SHA256
+// of "<timestamp>.<body>" keyed with the webhook secret. Including the
+// timestamp lets receivers reject replayed deliveries.
+func signWebhook(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gocql/gocql"
+	"shared/events"
+	"shared/messaging"
+)
+
+// TestSessionReachesLocalSink publishes a session on the in-memory
+// transport, as score_service does, and checks the local sink stores it.
+func TestSessionReachesLocalSink(t *testing.T) {
+	t.Setenv("LOCAL_SESSIONS_FILE", filepath.Join(t.TempDir(), "sessions.jsonl"))
+	writer, err := setupLocal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer writer.Close()
+
+	sessionID := gocql.TimeUUID()
+	session := events.GameSession{
+		SessionID: sessionID,
+		UserID:    "42",
+		Score:     120,
+		GameMode:  "ranked",
+		Timestamp: sessionID.Time().UTC(),
+		Result:    events.ResultWin,
+		Opponents: []string{"7"},
+	}
+
+	for _, contentType := range []string{events.ContentTypeJSON, events.ContentTypeProtobuf} {
+		env, err := events.NewGameScoreRecorded("score_service", session)
+		if err != nil {
+			t.Fatal(err)
+		}
+		value, err := events.Marshal(env, contentType)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		transport := messaging.NewMemoryBroker()
+		publisher := transport.Publisher(kafkaTopic)
+		if err := publisher.Publish(context.Background(), messaging.Message{
+			Key:     []byte(session.UserID),
+			Value:   value,
+			Headers: map[string]string{events.ContentTypeHeader: contentType},
+		}); err != nil {
+			t.Fatal(err)
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		sub := transport.Subscriber(kafkaTopic, sinkGroupID("local"))
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			processMessages(ctx, sub, writer, "local")
+		}()
+
+		got := waitForSessions(t, localSessionsFile(), 1)
+		cancel()
+		<-done
+		sub.Close()
+
+		if !got[0].Timestamp.Equal(session.Timestamp) {
+			t.Errorf("%s: timestamp = %v, want %v", contentType, got[0].Timestamp, session.Timestamp)
+		}
+		got[0].Timestamp = session.Timestamp
+		if gotJSON, wantJSON := mustJSON(t, got[0]), mustJSON(t, session); gotJSON != wantJSON {
+			t.Errorf("%s: stored %s, want %s", contentType, gotJSON, wantJSON)
+		}
+
+		// The session was committed, so the group does not see it again
+		fetchCtx, cancelFetch := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		if msg, err := transport.Subscriber(kafkaTopic, sinkGroupID("local")).Fetch(fetchCtx); err == nil {
+			t.Errorf("%s: message at offset %d was not committed", contentType, msg.Offset)
+		}
+		cancelFetch()
+
+		if err := os.Truncate(localSessionsFile(), 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// TestReplayReadsTheTransport replays part of a topic of the in-memory
+// transport into the local sink.
+func TestReplayReadsTheTransport(t *testing.T) {
+	t.Setenv("LOCAL_SESSIONS_FILE", filepath.Join(t.TempDir(), "sessions.jsonl"))
+	writer, err := setupLocal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer writer.Close()
+
+	transport := messaging.NewMemoryBroker()
+	for _, score := range []int{10, 20, 30} {
+		sessionID := gocql.TimeUUID()
+		env, err := events.NewGameScoreRecorded("score_service", events.GameSession{
+			SessionID: sessionID,
+			UserID:    "42",
+			Score:     score,
+			GameMode:  "ranked",
+			Timestamp: sessionID.Time().UTC(),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		value, err := events.Marshal(env, events.ContentTypeJSON)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := transport.Publisher(kafkaTopic).Publish(context.Background(), messaging.Message{Value: value}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	opts := replayOptions{sink: "local", startOffsets: map[int]int64{0: 1}, endOffsets: map[int]int64{}}
+	report, err := replay(context.Background(), transport, writer, nil, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.messages != 2 {
+		t.Errorf("replayed %d messages, want 2", report.messages)
+	}
+
+	got := waitForSessions(t, localSessionsFile(), 2)
+	if len(got) != 2 || got[0].Score != 20 || got[1].Score != 30 {
+		t.Errorf("stored %s, want the sessions from offset 1 on", mustJSON(t, got))
+	}
+}
+
+// waitForSessions reads the sessions stored in path once there are n.
+func waitForSessions(t *testing.T, path string, n int) []events.GameSession {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		var sessions []events.GameSession
+		if f, err := os.Open(path); err == nil {
+			scanner := bufio.NewScanner(f)
+			for scanner.Scan() {
+				var session events.GameSession
+				if err := json.Unmarshal(scanner.Bytes(), &session); err != nil {
+					t.Fatalf("invalid stored session %q: %v", scanner.Text(), err)
+				}
+				sessions = append(sessions, session)
+			}
+			f.Close()
+		}
+		if len(sessions) >= n {
+			return sessions
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d sessions stored, want %d", len(sessions), n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func mustJSON(t *testing.T, v interface{}) string {
+	t.Helper()
+	data, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"shared/events"
+	"shared/ratings"
+)
+
+// matchRatingsTTL is how long the ratings players had before a match are
+// kept for the sessions of its other players.
+const matchRatingsTTL = 7 * 24 * time.Hour
+
+// matchRatingsKey is the hash holding the ratings the players of a match had
+// before it, keyed by user ID.
+func matchRatingsKey(gameMode, matchID string) string {
+	return "match:" + gameMode + ":" + matchID + ":ratings"
+}
+
+// matchRatingsScript records the ratings of the players of a match the first
+// time one of its sessions is seen and returns the recorded ratings, so that
+// every player is rated against the others' ratings from before the match
+// whichever session is processed first.
+//
+// KEYS: match ratings
+// ARGV: ttl seconds, then user ID and encoded rating pairs
+var matchRatingsScript = redis.NewScript(`
+local users = {}
+for i = 2, #ARGV, 2 do
+	redis.call("HSETNX", KEYS[1], ARGV[i], ARGV[i + 1])
+	table.insert(users, ARGV[i])
+end
+redis.call("EXPIRE", KEYS[1], ARGV[1])
+return redis.call("HMGET", KEYS[1], unpack(users))
+`)
+
+// setRatingScript stores a player's rating and puts it on the rating board,
+// or in their held scores while they are banned. The rating is only stored
+// the first time the dedupe ID is added to the dedupe set, which then
+// expires after the ttl.
+//
+// KEYS: rating, rating board, banned users, held scores, dedupe set
+// ARGV: player key, rating, dedupe ID, dedupe ttl seconds, then rating field
+// and value pairs
+var setRatingScript = redis.NewScript(`
+if redis.call("SADD", KEYS[5], ARGV[3]) == 0 then
+	return 0
+end
+redis.call("EXPIRE", KEYS[5], ARGV[4])
+redis.call("HSET", KEYS[1], unpack(ARGV, 5))
+if redis.call("SISMEMBER", KEYS[3], ARGV[1]) == 1 then
+	redis.call("HSET", KEYS[4], KEYS[2], ARGV[2])
+	return 0
+end
+redis.call("ZADD", KEYS[2], ARGV[2], ARGV[1])
+return 1
+`)
+
+// updateRating rates the player of a match session against its opponents,
+// once per session. Each player's rating only changes through their own
+// sessions, which are consumed in order, so the read and write need not be
+// atomic.
+func (r *RedisWriter) updateRating(ctx context.Context, session events.GameSession, d dedupe) error {
+	// A retried session is skipped before its rating is worked out again
+	// from the one it already updated; the script checks again atomically.
+	applied, err := r.client.SIsMember(ctx, d.key, d.id).Result()
+	if err != nil || applied {
+		return err
+	}
+
+	users := append([]string{session.UserID}, session.Opponents...)
+
+	cmds := make([]*redis.MapStringStringCmd, len(users))
+	_, err = r.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for i, userID := range users {
+			cmds[i] = pipe.HGetAll(ctx, ratings.Key(session.GameMode, userID))
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	current := make([]ratings.Rating, len(users))
+	for i, cmd := range cmds {
+		current[i], _ = ratings.Parse(cmd.Val())
+	}
+
+	opponents := current[1:]
+	if session.MatchID != "" {
+		opponents, err = r.matchRatings(ctx, session, users, current)
+		if err != nil {
+			return err
+		}
+	}
+
+	score := ratings.Score(session.Result)
+	outcomes := make([]ratings.Outcome, len(opponents))
+	for i, opponent := range opponents {
+		outcomes[i] = ratings.Outcome{Opponent: opponent.At(session.Timestamp), Score: score}
+	}
+
+	player := ratings.Update(current[0].At(session.Timestamp), outcomes)
+	if session.Timestamp.After(player.UpdatedAt) {
+		player.UpdatedAt = session.Timestamp
+	}
+
+	playerKey := "user:" + session.UserID
+	id, ttl := d.args()
+	args := append([]interface{}{playerKey, player.Rating, id, ttl}, player.Fields()...)
+	return setRatingScript.Run(ctx, r.client,
+		[]string{
+			ratings.Key(session.GameMode, session.UserID),
+			"leaderboard:" + ratings.Board(session.GameMode),
+			bannedUsersKey,
+			heldScoresKey(playerKey),
+			d.key,
+		},
+		args...,
+	).Err()
+}
+
+// matchRatings returns the ratings the opponents had before the match,
+// recording the current ones if this is the first session of it.
+func (r *RedisWriter) matchRatings(ctx context.Context, session events.GameSession, users []string, current []ratings.Rating) ([]ratings.Rating, error) {
+	args := []interface{}{int64(matchRatingsTTL.Seconds())}
+	for i, userID := range users {
+		encoded, err := json.Marshal(current[i])
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, userID, encoded)
+	}
+
+	values, err := matchRatingsScript.Run(ctx, r.client,
+		[]string{matchRatingsKey(session.GameMode, session.MatchID)}, args...,
+	).StringSlice()
+	if err != nil {
+		return nil, err
+	}
+
+	opponents := make([]ratings.Rating, len(users)-1)
+	for i := range opponents {
+		opponents[i] = current[i+1]
+		if err := json.Unmarshal([]byte(values[i+1]), &opponents[i]); err != nil {
+			return nil, err
+		}
+	}
+	return opponents, nil
+}
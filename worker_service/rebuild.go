@@ -0,0 +1,650 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/gocql/gocql"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/redis/go-redis/v9"
+	"shared/events"
+	"shared/matches"
+	"shared/ratings"
+	"shared/recent"
+	"shared/seasons"
+)
+
+const (
+	rebuildStateKey = "rebuild:state"
+	// rebuildModesKey holds the boards being rebuilt: game modes and their
+	// season boards.
+	rebuildModesKey = "rebuild:modes"
+	// rebuildStatsKey holds the match stats keys of the players whose stats
+	// are staged.
+	rebuildStatsKey = "rebuild:stats"
+	// rebuildRatingsKey holds the rating keys of the players whose ratings
+	// are staged.
+	rebuildRatingsKey = "rebuild:ratings"
+	// rebuildMatchesKey holds the game modes whose match sessions are
+	// staged for the rating replay.
+	rebuildMatchesKey = "rebuild:matches"
+)
+
+var (
+	rebuildRangesTotal = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "worker_rebuild_ranges_total",
+		Help: "The number of token ranges the rebuild is split into",
+	})
+
+	rebuildRangesCompleted = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "worker_rebuild_ranges_completed",
+		Help: "The number of token ranges already applied to the staging leaderboards",
+	})
+
+	rebuildRowsScanned = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "worker_rebuild_rows_scanned_total",
+		Help: "The total number of game sessions read from Cassandra by the rebuild",
+	})
+)
+
+// rebuildStagingKey is where a leaderboard is accumulated before it is
+// swapped in. It deliberately does not start with "leaderboard:" so partial
+// boards are never mistaken for live ones.
+func rebuildStagingKey(board string) string {
+	return "rebuild:leaderboard:" + board
+}
+
+// rebuildStagingStatsKey is where the match stats stored under statsKey
+// are accumulated before they are swapped in with the leaderboards.
+func rebuildStagingStatsKey(statsKey string) string {
+	return "rebuild:" + statsKey
+}
+
+// rebuildStagingRatingKey is where the rating stored under ratingKey is
+// staged before it is swapped in with the leaderboards.
+func rebuildStagingRatingKey(ratingKey string) string {
+	return "rebuild:" + ratingKey
+}
+
+// rebuildMatchSessionsKey is the sorted set of the match sessions of
+// gameMode, scored by their timestamp in milliseconds, that the ratings are
+// replayed from.
+func rebuildMatchSessionsKey(gameMode string) string {
+	return rebuildMatchesKey + ":" + gameMode
+}
+
+// tokenRange returns the inclusive bounds of range i when the Murmur3 token
+// ring is split into n equal ranges. The arithmetic relies on int64
+// wrapping around, which covers the upper half of the ring.
+func tokenRange(i, n int) (int64, int64) {
+	step := uint64(math.MaxUint64) / uint64(n)
+	start := int64(i) * int64(step)
+	if i == n-1 {
+		return math.MinInt64 + start, math.MaxInt64
+	}
+	return math.MinInt64 + start, math.MinInt64 + start + int64(step) - 1
+}
+
+// runRebuild implements the "rebuild" subcommand. It scans every game
+// session in Cassandra, sums the scores of sessions that were not voided per
+// mode, season and player into staging sorted sets, along with the recent
+// and match result boards, and finally renames them over the live
+// leaderboards. The match stats of every player are staged and swapped in
+// along with them.
+//
+// Ratings depend on the order of the matches, so the match sessions are
+// staged by timestamp instead and replayed once every range is read, the way
+// the redis sink rates them, into staged ratings and rating boards.
+//
+// Progress is checkpointed in Redis after every token range, together with
+// the scores of that range, so an interrupted rebuild resumes where it
+// stopped. Sessions written while the rebuild runs may be missed, so it is
+// meant to be run with the redis sink stopped.
+func runRebuild(args []string) {
+	fs := flag.NewFlagSet("rebuild", flag.ExitOnError)
+	ranges := fs.Int("ranges", 256, "number of token ranges to split the scan into")
+	pageSize := fs.Int("page-size", 1000, "number of rows fetched from Cassandra per page")
+	fresh := fs.Bool("fresh", false, "discard any previous checkpoint and staging leaderboards")
+	recentHalfLife := fs.Duration("recent-half-life", 0, "change the half-life of the recent leaderboards, requires -fresh")
+	metricsAddr := fs.String("metrics-addr", ":2114", "address to serve the metrics endpoint on")
+	fs.Parse(args)
+
+	if *ranges < 1 {
+		log.Fatal("invalid ranges, must be at least 1")
+	}
+	if *recentHalfLife < 0 || (*recentHalfLife > 0 && !*fresh) {
+		log.Fatal("invalid recent-half-life, must be positive and used with -fresh")
+	}
+
+	go func() {
+		http.Handle("/metrics", promhttp.Handler())
+		log.Printf("metrics endpoint running on %s/metrics", *metricsAddr)
+		log.Fatal(http.ListenAndServe(*metricsAddr, nil))
+	}()
+
+	cassandra, err := setupCassandra()
+	if err != nil {
+		log.Fatalf("failed to setup cassandra: %v", err)
+	}
+	defer cassandra.Close()
+
+	redisWriter, err := setupRedis()
+	if err != nil {
+		log.Fatalf("failed to setup redis: %v", err)
+	}
+	defer redisWriter.Close()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	rb := &rebuilder{
+		session:  cassandra.session,
+		client:   redisWriter.client,
+		ranges:   *ranges,
+		pageSize: *pageSize,
+	}
+
+	if *fresh {
+		if err := rb.reset(ctx); err != nil {
+			log.Fatalf("failed to discard previous rebuild: %v", err)
+		}
+	}
+
+	if *recentHalfLife > 0 {
+		if err := initRecentConfig(ctx, rb.client, *recentHalfLife, true); err != nil {
+			log.Fatalf("failed to change the recent half-life: %v", err)
+		}
+		log.Printf("recent leaderboards now have a half-life of %v", *recentHalfLife)
+	}
+
+	if err := rb.run(ctx); err != nil {
+		log.Fatalf("rebuild failed: %v", err)
+	}
+}
+
+type rebuilder struct {
+	session  *gocql.Session
+	client   *redis.Client
+	ranges   int
+	pageSize int
+
+	// banned holds the player keys of banned users. Their scores are left
+	// out, the scores held for them while banned are kept as they are.
+	banned map[string]bool
+
+	seasons  []seasons.Season
+	recent   recent.Config
+	minGames int64
+}
+
+func (rb *rebuilder) run(ctx context.Context) error {
+	next, err := rb.checkpoint(ctx)
+	if err != nil {
+		return err
+	}
+
+	banned, err := rb.client.SMembers(ctx, bannedUsersKey).Result()
+	if err != nil {
+		return err
+	}
+	rb.banned = make(map[string]bool, len(banned))
+	for _, playerKey := range banned {
+		rb.banned[playerKey] = true
+	}
+
+	// Archived seasons are rebuilt too, their boards stay readable.
+	rb.seasons, err = loadSeasons(ctx, rb.client)
+	if err != nil {
+		return err
+	}
+
+	rb.recent, err = loadRecentConfig(ctx, rb.client)
+	if err != nil {
+		return err
+	}
+
+	minGames, err := rb.client.HGet(ctx, matches.ConfigKey, "min_games").Result()
+	if err != nil && err != redis.Nil {
+		return err
+	}
+	rb.minGames = matches.ParseMinGames(minGames)
+
+	rebuildRangesTotal.Set(float64(rb.ranges))
+	rebuildRangesCompleted.Set(float64(next))
+	if next > 0 {
+		log.Printf("resuming rebuild at token range %d/%d", next, rb.ranges)
+	}
+
+	for i := next; i < rb.ranges; i++ {
+		if err := ctx.Err(); err != nil {
+			return fmt.Errorf("interrupted at token range %d, run again to resume: %w", i, err)
+		}
+
+		if err := rb.rebuildRange(ctx, i); err != nil {
+			return fmt.Errorf("token range %d: %w", i, err)
+		}
+
+		rebuildRangesCompleted.Set(float64(i + 1))
+		log.Printf("rebuilt token range %d/%d", i+1, rb.ranges)
+	}
+
+	if err := rb.rebuildRatings(ctx); err != nil {
+		return fmt.Errorf("ratings: %w", err)
+	}
+
+	return rb.swap(ctx)
+}
+
+// checkpoint returns the first token range that has not been applied yet.
+func (rb *rebuilder) checkpoint(ctx context.Context) (int, error) {
+	state, err := rb.client.HGetAll(ctx, rebuildStateKey).Result()
+	if err != nil {
+		return 0, err
+	}
+
+	if len(state) == 0 {
+		return 0, rb.client.HSet(ctx, rebuildStateKey, "ranges", rb.ranges, "next_range", 0).Err()
+	}
+
+	if state["ranges"] != strconv.Itoa(rb.ranges) {
+		return 0, fmt.Errorf("previous rebuild used %s token ranges, rerun with -ranges %s or -fresh",
+			state["ranges"], state["ranges"])
+	}
+
+	return strconv.Atoi(state["next_range"])
+}
+
+// rebuildRange sums the sessions of one token range and applies them to the
+// staging leaderboards in the same transaction that advances the checkpoint.
+// Its match sessions are staged in the same transaction for rebuildRatings.
+func (rb *rebuilder) rebuildRange(ctx context.Context, i int) error {
+	start, end := tokenRange(i, rb.ranges)
+
+	iter := rb.session.Query(
+		`SELECT session_id, user_id, score, game_mode, timestamp, voided, result, opponents, match_id FROM game_system.game_sessions WHERE token(user_id) >= ? AND token(user_id) <= ?`,
+		start, end,
+	).WithContext(ctx).PageSize(rb.pageSize).Iter()
+
+	totals := make(map[string]map[string]float64)
+	add := func(board, userID string, score float64) {
+		if totals[board] == nil {
+			totals[board] = make(map[string]float64)
+		}
+		totals[board][userID] += score
+	}
+
+	// A player's sessions are all in one token range, so their match stats
+	// are complete once the range is read.
+	stats := make(map[string]map[string]*matches.Stats)
+
+	// Voiding a session or banning its player does not undo its rating
+	// update, so every match session is replayed.
+	matchSessions := make(map[string][]redis.Z)
+
+	var sessionID gocql.UUID
+	var userID, gameMode, result, matchID string
+	var score int
+	var timestamp time.Time
+	var voided bool
+	var opponents []string
+	for iter.Scan(&sessionID, &userID, &score, &gameMode, &timestamp, &voided, &result, &opponents, &matchID) {
+		rebuildRowsScanned.Inc()
+		if result != "" && len(opponents) > 0 {
+			member, err := json.Marshal(events.GameSession{
+				SessionID: sessionID,
+				UserID:    userID,
+				Score:     score,
+				GameMode:  gameMode,
+				Timestamp: timestamp,
+				Result:    result,
+				Opponents: opponents,
+				MatchID:   matchID,
+			})
+			if err != nil {
+				iter.Close()
+				return err
+			}
+			matchSessions[gameMode] = append(matchSessions[gameMode], redis.Z{Score: float64(timestamp.UnixMilli()), Member: member})
+		}
+
+		if voided || rb.banned["user:"+userID] {
+			continue
+		}
+		add(gameMode, userID, float64(score))
+		if season, ok := seasons.Current(rb.seasons, gameMode, timestamp); ok {
+			add(seasons.Board(gameMode, season.ID), userID, float64(score))
+		}
+		add(recent.Board(gameMode), userID, float64(score)*rb.recent.Weight(timestamp))
+
+		if field := matches.CounterField(result); field != "" {
+			if stats[gameMode] == nil {
+				stats[gameMode] = make(map[string]*matches.Stats)
+			}
+			if stats[gameMode][userID] == nil {
+				stats[gameMode][userID] = &matches.Stats{}
+			}
+			player := stats[gameMode][userID]
+			player.Games++
+			switch field {
+			case "wins":
+				player.Wins++
+			case "losses":
+				player.Losses++
+			case "draws":
+				player.Draws++
+			}
+		}
+	}
+	if err := iter.Close(); err != nil {
+		return err
+	}
+
+	for gameMode, players := range stats {
+		for userID, player := range players {
+			if player.Wins > 0 {
+				add(matches.WinsBoard(gameMode), userID, float64(player.Wins))
+			}
+			if player.Games >= rb.minGames {
+				add(matches.WinRateBoard(gameMode), userID, player.WinRate())
+			}
+		}
+	}
+
+	_, err := rb.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		for gameMode, players := range stats {
+			for userID, player := range players {
+				statsKey := matches.StatsKey(gameMode, userID)
+				stagingKey := rebuildStagingStatsKey(statsKey)
+				pipe.SAdd(ctx, rebuildStatsKey, statsKey)
+				pipe.Del(ctx, stagingKey)
+				pipe.HSet(ctx, stagingKey, "games", player.Games, "wins", player.Wins, "losses", player.Losses, "draws", player.Draws)
+			}
+		}
+		for board, scores := range totals {
+			pipe.SAdd(ctx, rebuildModesKey, board)
+			for userID, total := range scores {
+				pipe.ZIncrBy(ctx, rebuildStagingKey(board), total, "user:"+userID)
+			}
+		}
+		for gameMode, sessions := range matchSessions {
+			pipe.SAdd(ctx, rebuildMatchesKey, gameMode)
+			pipe.ZAdd(ctx, rebuildMatchSessionsKey(gameMode), sessions...)
+		}
+		pipe.HSet(ctx, rebuildStateKey, "next_range", i+1)
+		return nil
+	})
+	return err
+}
+
+// matchSnapshot holds the ratings the players of a match had before it,
+// like the match ratings hash of the redis sink, until all of its sessions
+// are replayed.
+type matchSnapshot struct {
+	ratings map[string]ratings.Rating
+	left    int
+}
+
+// rebuildRatings replays the staged match sessions of every mode in
+// timestamp order and stages the resulting ratings and rating boards.
+// Banned players are rated but left off the boards, the ratings held for
+// them are kept as they are. Replaying starts over from the first session,
+// so an interrupted replay is simply run again.
+func (rb *rebuilder) rebuildRatings(ctx context.Context) error {
+	gameModes, err := rb.client.SMembers(ctx, rebuildMatchesKey).Result()
+	if err != nil {
+		return err
+	}
+
+	for _, gameMode := range gameModes {
+		if err := rb.replayMatches(ctx, gameMode); err != nil {
+			return fmt.Errorf("game mode %s: %w", gameMode, err)
+		}
+	}
+	return nil
+}
+
+func (rb *rebuilder) replayMatches(ctx context.Context, gameMode string) error {
+	current := make(map[string]ratings.Rating)
+	snapshots := make(map[string]*matchSnapshot)
+
+	replayed := 0
+	key := rebuildMatchSessionsKey(gameMode)
+	for start := int64(0); ; start += int64(rb.pageSize) {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		members, err := rb.client.ZRange(ctx, key, start, start+int64(rb.pageSize)-1).Result()
+		if err != nil {
+			return err
+		}
+
+		for _, member := range members {
+			var session events.GameSession
+			if err := json.Unmarshal([]byte(member), &session); err != nil {
+				return err
+			}
+			replayed++
+
+			users := append([]string{session.UserID}, session.Opponents...)
+			opponents := make([]ratings.Rating, len(session.Opponents))
+			for i, userID := range session.Opponents {
+				opponents[i] = rating(current, userID)
+			}
+
+			if session.MatchID != "" {
+				snapshot := snapshots[session.MatchID]
+				if snapshot == nil {
+					snapshot = &matchSnapshot{ratings: make(map[string]ratings.Rating), left: len(users)}
+					snapshots[session.MatchID] = snapshot
+				}
+				for _, userID := range users {
+					if _, ok := snapshot.ratings[userID]; !ok {
+						snapshot.ratings[userID] = rating(current, userID)
+					}
+				}
+				for i, userID := range session.Opponents {
+					opponents[i] = snapshot.ratings[userID]
+				}
+				if snapshot.left--; snapshot.left <= 0 {
+					delete(snapshots, session.MatchID)
+				}
+			}
+
+			score := ratings.Score(session.Result)
+			outcomes := make([]ratings.Outcome, len(opponents))
+			for i, opponent := range opponents {
+				outcomes[i] = ratings.Outcome{Opponent: opponent.At(session.Timestamp), Score: score}
+			}
+
+			player := ratings.Update(rating(current, session.UserID).At(session.Timestamp), outcomes)
+			if session.Timestamp.After(player.UpdatedAt) {
+				player.UpdatedAt = session.Timestamp
+			}
+			// The redis sink stores the update time in seconds
+			player.UpdatedAt = time.Unix(player.UpdatedAt.Unix(), 0).UTC()
+			current[session.UserID] = player
+		}
+
+		if int64(len(members)) < int64(rb.pageSize) {
+			break
+		}
+	}
+
+	board := ratings.Board(gameMode)
+	pipe := rb.client.Pipeline()
+	for userID, player := range current {
+		ratingKey := ratings.Key(gameMode, userID)
+		stagingKey := rebuildStagingRatingKey(ratingKey)
+		pipe.SAdd(ctx, rebuildRatingsKey, ratingKey)
+		pipe.Del(ctx, stagingKey)
+		pipe.HSet(ctx, stagingKey, player.Fields()...)
+		if !rb.banned["user:"+userID] {
+			pipe.SAdd(ctx, rebuildModesKey, board)
+			pipe.ZAdd(ctx, rebuildStagingKey(board), redis.Z{Score: player.Rating, Member: "user:" + userID})
+		}
+		if pipe.Len() >= rb.pageSize {
+			if _, err := pipe.Exec(ctx); err != nil {
+				return err
+			}
+		}
+	}
+	if pipe.Len() > 0 {
+		if _, err := pipe.Exec(ctx); err != nil {
+			return err
+		}
+	}
+
+	log.Printf("replayed %d match sessions of %s, rating %d players", replayed, gameMode, len(current))
+	return nil
+}
+
+// rating returns the rating of userID in current, the default one if they
+// have not played yet.
+func rating(current map[string]ratings.Rating, userID string) ratings.Rating {
+	if player, ok := current[userID]; ok {
+		return player
+	}
+	return ratings.New()
+}
+
+// swap atomically replaces the live leaderboards, match stats and ratings
+// with the staging ones. Live boards, stats and ratings the rebuild did not
+// produce, e.g. of players or modes whose sessions are all voided, are
+// deleted with them, except the stats of banned players.
+func (rb *rebuilder) swap(ctx context.Context) error {
+	boards, err := rb.client.SMembers(ctx, rebuildModesKey).Result()
+	if err != nil {
+		return err
+	}
+	statsKeys, err := rb.client.SMembers(ctx, rebuildStatsKey).Result()
+	if err != nil {
+		return err
+	}
+	ratingKeys, err := rb.client.SMembers(ctx, rebuildRatingsKey).Result()
+	if err != nil {
+		return err
+	}
+	gameModes, err := rb.client.SMembers(ctx, rebuildMatchesKey).Result()
+	if err != nil {
+		return err
+	}
+
+	rebuilt := make(map[string]bool, len(boards)+len(statsKeys)+len(ratingKeys))
+	for _, board := range boards {
+		rebuilt["leaderboard:"+board] = true
+	}
+	for _, key := range append(statsKeys, ratingKeys...) {
+		rebuilt[key] = true
+	}
+	staleBoards, err := rb.staleKeys(ctx, "leaderboard:*", rebuilt, nil)
+	if err != nil {
+		return err
+	}
+	// Banned players' sessions are left out, so their stats are kept as
+	// they are like the scores held for them.
+	staleStats, err := rb.staleKeys(ctx, "stats:*", rebuilt, func(key string) bool {
+		i := strings.LastIndex(key, ":user:")
+		return i >= 0 && rb.banned[key[i+1:]]
+	})
+	if err != nil {
+		return err
+	}
+	staleRatings, err := rb.staleKeys(ctx, "rating:*", rebuilt, nil)
+	if err != nil {
+		return err
+	}
+
+	_, err = rb.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, keys := range [][]string{staleBoards, staleStats, staleRatings} {
+			for _, key := range keys {
+				pipe.Del(ctx, key)
+			}
+		}
+		for _, board := range boards {
+			pipe.Rename(ctx, rebuildStagingKey(board), "leaderboard:"+board)
+		}
+		for _, statsKey := range statsKeys {
+			pipe.Rename(ctx, rebuildStagingStatsKey(statsKey), statsKey)
+		}
+		for _, ratingKey := range ratingKeys {
+			pipe.Rename(ctx, rebuildStagingRatingKey(ratingKey), ratingKey)
+		}
+		for _, gameMode := range gameModes {
+			pipe.Del(ctx, rebuildMatchSessionsKey(gameMode))
+		}
+		pipe.Del(ctx, rebuildModesKey, rebuildStatsKey, rebuildRatingsKey, rebuildMatchesKey, rebuildStateKey)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	log.Printf("rebuild complete, swapped in %d leaderboards and the match stats of %d players and %d ratings, deleted %d stale leaderboards, %d stale match stats and %d stale ratings",
+		len(boards), len(statsKeys), len(ratingKeys), len(staleBoards), len(staleStats), len(staleRatings))
+	return nil
+}
+
+// staleKeys returns the live keys matching pattern that are not in rebuilt,
+// except those keep reports true for.
+func (rb *rebuilder) staleKeys(ctx context.Context, pattern string, rebuilt map[string]bool, keep func(key string) bool) ([]string, error) {
+	var stale []string
+	iter := rb.client.Scan(ctx, 0, pattern, 1000).Iterator()
+	for iter.Next(ctx) {
+		key := iter.Val()
+		if !rebuilt[key] && (keep == nil || !keep(key)) {
+			stale = append(stale, key)
+		}
+	}
+	return stale, iter.Err()
+}
+
+// reset discards the checkpoint and any partially built staging leaderboards,
+// match stats, ratings and match sessions.
+func (rb *rebuilder) reset(ctx context.Context) error {
+	boards, err := rb.client.SMembers(ctx, rebuildModesKey).Result()
+	if err != nil {
+		return err
+	}
+	statsKeys, err := rb.client.SMembers(ctx, rebuildStatsKey).Result()
+	if err != nil {
+		return err
+	}
+	ratingKeys, err := rb.client.SMembers(ctx, rebuildRatingsKey).Result()
+	if err != nil {
+		return err
+	}
+	gameModes, err := rb.client.SMembers(ctx, rebuildMatchesKey).Result()
+	if err != nil {
+		return err
+	}
+
+	keys := []string{rebuildModesKey, rebuildStatsKey, rebuildRatingsKey, rebuildMatchesKey, rebuildStateKey}
+	for _, board := range boards {
+		keys = append(keys, rebuildStagingKey(board))
+	}
+	for _, statsKey := range statsKeys {
+		keys = append(keys, rebuildStagingStatsKey(statsKey))
+	}
+	for _, ratingKey := range ratingKeys {
+		keys = append(keys, rebuildStagingRatingKey(ratingKey))
+	}
+	for _, gameMode := range gameModes {
+		keys = append(keys, rebuildMatchSessionsKey(gameMode))
+	}
+
+	return rb.client.Del(ctx, keys...).Err()
+}
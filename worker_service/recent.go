@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"shared/recent"
+)
+
+const (
+	defaultRecentHalfLife = 7 * 24 * time.Hour
+
+	// recentRebaseHalfLives is how many half-lives after the epoch the recent
+	// boards are rescaled. The weight is then 2^256, far from overflowing a
+	// float64 even multiplied by large scores.
+	recentRebaseHalfLives = 256
+)
+
+// rebaseRecentScript moves the epoch of the recent boards forward and
+// divides their values, and the values held for banned players, by the
+// weight of the new epoch. The held scores are found through the banned
+// users set rather than passed as keys.
+//
+// KEYS: recent config, banned users, recent boards...
+// ARGV: new epoch
+var rebaseRecentScript = redis.NewScript(`
+local halfLife = tonumber(redis.call("HGET", KEYS[1], "half_life"))
+local epoch = tonumber(redis.call("HGET", KEYS[1], "epoch"))
+local newEpoch = tonumber(ARGV[1])
+if not halfLife or not epoch or newEpoch <= epoch then
+	return 0
+end
+local factor = math.pow(2, (epoch - newEpoch) / halfLife)
+for i = 3, #KEYS do
+	if redis.call("EXISTS", KEYS[i]) == 1 then
+		redis.call("ZUNIONSTORE", KEYS[i], 1, KEYS[i], "WEIGHTS", factor)
+	end
+	for _, player in ipairs(redis.call("SMEMBERS", KEYS[2])) do
+		local held = redis.call("HGET", "banned:" .. player, KEYS[i])
+		if held then
+			redis.call("HSET", "banned:" .. player, KEYS[i], tonumber(held) * factor)
+		end
+	end
+end
+redis.call("HSET", KEYS[1], "epoch", ARGV[1])
+return 1
+`)
+
+// initRecentConfig stores the recent board config unless there is one.
+// With force it replaces it, starting a new epoch now, which requires
+// rebuilding the recent boards.
+func initRecentConfig(ctx context.Context, client *redis.Client, halfLife time.Duration, force bool) error {
+	halfLifeSeconds := strconv.FormatFloat(halfLife.Seconds(), 'f', -1, 64)
+	epoch := strconv.FormatInt(time.Now().Unix(), 10)
+
+	if force {
+		return client.HSet(ctx, recent.ConfigKey, "half_life", halfLifeSeconds, "epoch", epoch).Err()
+	}
+
+	_, err := client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HSetNX(ctx, recent.ConfigKey, "half_life", halfLifeSeconds)
+		pipe.HSetNX(ctx, recent.ConfigKey, "epoch", epoch)
+		return nil
+	})
+	return err
+}
+
+func loadRecentConfig(ctx context.Context, client *redis.Client) (recent.Config, error) {
+	fields, err := client.HGetAll(ctx, recent.ConfigKey).Result()
+	if err != nil {
+		return recent.Config{}, err
+	}
+	return recent.Parse(fields)
+}
+
+// addRecentScore adds a session played at t to the recent board of
+// gameMode, rescaling the recent boards once the weights grow too large.
+func (r *RedisWriter) addRecentScore(ctx context.Context, gameMode, playerKey string, score float64, d dedupe, t time.Time) error {
+	unix := strconv.FormatFloat(float64(t.UnixNano())/float64(time.Second), 'f', -1, 64)
+
+	// Should the config be gone, the recent boards are gone with it, so the
+	// script starts a new epoch now.
+	halfLife := strconv.FormatFloat(defaultRecentHalfLife.Seconds(), 'f', -1, 64)
+	epoch := strconv.FormatInt(time.Now().Unix(), 10)
+
+	id, ttl := d.args()
+	halfLives, err := addScoreScript.Run(ctx, r.client,
+		[]string{recent.LeaderboardKey(gameMode), bannedUsersKey, heldScoresKey(playerKey), d.key, recent.ConfigKey},
+		score, playerKey, id, unix, ttl, halfLife, epoch,
+	).Int64()
+	if err != nil {
+		return err
+	}
+
+	if halfLives >= recentRebaseHalfLives {
+		return r.rebaseRecent(ctx, t)
+	}
+	return nil
+}
+
+// rebaseRecent moves the epoch of the recent boards to t.
+func (r *RedisWriter) rebaseRecent(ctx context.Context, t time.Time) error {
+	keys := []string{recent.ConfigKey, bannedUsersKey}
+
+	iter := r.client.ScanType(ctx, 0, "leaderboard:*:recent", 100, "zset").Iterator()
+	for iter.Next(ctx) {
+		keys = append(keys, iter.Val())
+	}
+	if err := iter.Err(); err != nil {
+		return err
+	}
+
+	rebased, err := rebaseRecentScript.Run(ctx, r.client, keys, t.Unix()).Int()
+	if err != nil {
+		return err
+	}
+
+	if rebased == 1 {
+		log.Printf("[Redis] Rebased %d recent leaderboards to epoch %s", len(keys)-2, t.UTC().Format(time.RFC3339))
+	}
+	return nil
+}
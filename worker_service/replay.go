@@ -0,0 +1,407 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"shared/events"
+	"shared/messaging"
+)
+
+const replayBatchSize = 500
+
+// replayDedupeWindow is how old sessions replayed into redis with -dedupe
+// can be. The steps applied for older sessions may have been forgotten, see
+// appliedSessionTTL, so they are skipped; the margin covers consumer lag.
+const replayDedupeWindow = appliedSessionTTL - 24*time.Hour
+
+// replayOptions describes the slice of the game-sessions topic to replay.
+// Start and end offsets take precedence over the timestamps for the
+// partitions they name; end offsets are exclusive.
+type replayOptions struct {
+	sink         string
+	from         time.Time
+	to           time.Time
+	startOffsets map[int]int64
+	endOffsets   map[int]int64
+	dryRun       bool
+	dedupe       bool
+}
+
+// appliedEvents tells which events redis already applied, so that a dry run
+// with -dedupe only reports what the replay would change. A session counts
+// as applied once its all-time score is.
+type appliedEvents struct {
+	client *redis.Client
+}
+
+func (a appliedEvents) applied(ctx context.Context, ev event) (bool, error) {
+	switch ev.Type {
+	case events.TypeGameScoreRecorded:
+		return a.client.SIsMember(ctx, appliedSessionKey(ev.Session.SessionID.String()), "all").Result()
+	case events.TypeScoreVoided:
+		return a.client.SIsMember(ctx, voidedSessionsKey, ev.Voided.SessionID.String()).Result()
+	default:
+		return false, nil
+	}
+}
+
+// replayReport accumulates what a replay wrote, or would have written.
+type replayReport struct {
+	messages int
+	skipped  int
+	// applied counts the events a dry run found redis already applied.
+	applied int
+	// expired counts the sessions skipped for being older than
+	// replayDedupeWindow.
+	expired    int
+	partitions map[int]int
+	scores     map[string]map[string]int64
+	sessions   map[string]map[string]int
+	// moderation counts the void and ban events by type.
+	moderation map[string]int
+}
+
+func newReplayReport() *replayReport {
+	return &replayReport{
+		partitions: make(map[int]int),
+		scores:     make(map[string]map[string]int64),
+		sessions:   make(map[string]map[string]int),
+		moderation: make(map[string]int),
+	}
+}
+
+func (rp *replayReport) add(partition int, ev event) {
+	rp.messages++
+	rp.partitions[partition]++
+	if ev.Type != events.TypeGameScoreRecorded {
+		rp.moderation[ev.Type]++
+		return
+	}
+
+	session := ev.Session
+	if rp.scores[session.GameMode] == nil {
+		rp.scores[session.GameMode] = make(map[string]int64)
+		rp.sessions[session.GameMode] = make(map[string]int)
+	}
+	rp.scores[session.GameMode][session.UserID] += int64(session.Score)
+	rp.sessions[session.GameMode][session.UserID]++
+}
+
+// runReplay implements the "replay" subcommand. It reads game-sessions
+// directly by partition, without a consumer group, so the offsets of the
+// live consumer groups are never touched.
+//
+// Replaying into redis would add the scores of sessions the leaderboards
+// already contain again, so it requires -dedupe, which skips the sessions
+// redis already applied and those too old to tell. A dry run does not
+// write to the sink, and only connects to it to check what redis applied.
+func runReplay(args []string) {
+	fs := flag.NewFlagSet("replay", flag.ExitOnError)
+	sink := fs.String("sink", "", "storage sink to replay into (redis, cassandra, postgres or local)")
+	from := fs.String("from", "", "replay messages produced at or after this RFC3339 timestamp")
+	to := fs.String("to", "", "replay messages produced before this RFC3339 timestamp")
+	startOffsets := fs.String("offsets", "", "start offset per partition, e.g. 0:1200,1:980")
+	endOffsets := fs.String("end-offsets", "", "exclusive end offset per partition, e.g. 0:1500,1:1000")
+	dryRun := fs.Bool("dry-run", false, "only report what would change without writing to the sink")
+	dedupe := fs.Bool("dedupe", false, "skip the sessions the redis sink already applied, and those older than "+replayDedupeWindow.String())
+	fs.Parse(args)
+
+	opts := replayOptions{sink: *sink, dryRun: *dryRun, dedupe: *dedupe}
+
+	if _, ok := sinkFactories[opts.sink]; !ok {
+		log.Fatalf("invalid sink %q", opts.sink)
+	}
+	if opts.sink == "redis" && !opts.dedupe {
+		log.Fatal("replaying into redis adds the scores again, pass -dedupe to skip the sessions it already applied, " +
+			"or rebuild the leaderboards from cassandra with the rebuild subcommand")
+	}
+	if opts.dedupe && opts.sink != "redis" {
+		log.Fatal("-dedupe is only supported by the redis sink")
+	}
+
+	var err error
+	if opts.from, err = parseReplayTime(*from); err != nil {
+		log.Fatalf("invalid -from: %v", err)
+	}
+	if opts.to, err = parseReplayTime(*to); err != nil {
+		log.Fatalf("invalid -to: %v", err)
+	}
+	if opts.startOffsets, err = parsePartitionOffsets(*startOffsets); err != nil {
+		log.Fatalf("invalid -offsets: %v", err)
+	}
+	if opts.endOffsets, err = parsePartitionOffsets(*endOffsets); err != nil {
+		log.Fatalf("invalid -end-offsets: %v", err)
+	}
+
+	transport, err := messaging.FromEnv([]string{kafkaServer})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var writer StorageWriter
+	var checker *appliedEvents
+	if !opts.dryRun {
+		if writer, err = sinkFactories[opts.sink](); err != nil {
+			log.Fatalf("failed to setup %s: %v", opts.sink, err)
+		}
+		defer writer.Close()
+	} else if opts.dedupe {
+		client := redis.NewClient(&redis.Options{Addr: redisServer})
+		defer client.Close()
+		if err := client.Ping(context.Background()).Err(); err != nil {
+			log.Fatalf("failed to connect to redis: %v", err)
+		}
+		checker = &appliedEvents{client: client}
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	report, err := replay(ctx, transport, writer, checker, opts)
+	if err != nil {
+		log.Fatalf("replay failed: %v", err)
+	}
+
+	printReplayReport(report, opts)
+}
+
+// replay applies the selected messages of every partition to writer. The
+// checker, if any, skips what redis already applied in dry runs.
+func replay(ctx context.Context, transport messaging.Transport, writer StorageWriter, checker *appliedEvents, opts replayOptions) (*replayReport, error) {
+	partitions, err := transport.Partitions(ctx, kafkaTopic)
+	if err != nil {
+		return nil, err
+	}
+
+	report := newReplayReport()
+	for _, partition := range partitions {
+		if err := replayPartition(ctx, transport, writer, checker, opts, partition, report); err != nil {
+			return report, fmt.Errorf("partition %d: %w", partition, err)
+		}
+	}
+
+	return report, nil
+}
+
+// partitionRange resolves the offsets of partition to replay, from start
+// up to the exclusive end, against the offsets the broker still has.
+func partitionRange(ctx context.Context, transport messaging.Transport, opts replayOptions, partition int) (start, end int64, err error) {
+	first, last, err := transport.Offsets(ctx, kafkaTopic, partition)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	// Without an explicit end, stop at the high watermark observed now so
+	// the replay terminates even while new sessions keep arriving.
+	end, ok := opts.endOffsets[partition]
+	if !ok || end > last {
+		end = last
+	}
+
+	start, ok = opts.startOffsets[partition]
+	if !ok && !opts.from.IsZero() {
+		start, err = transport.OffsetAt(ctx, kafkaTopic, partition, opts.from)
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+	if start < first {
+		start = first
+	}
+
+	return start, end, nil
+}
+
+func replayPartition(ctx context.Context, transport messaging.Transport, writer StorageWriter, checker *appliedEvents, opts replayOptions, partition int, report *replayReport) error {
+	start, end, err := partitionRange(ctx, transport, opts, partition)
+	if err != nil {
+		return err
+	}
+	if start >= end {
+		log.Printf("nothing to replay in partition %d", partition)
+		return nil
+	}
+
+	r, err := transport.ReadPartition(kafkaTopic, partition, start)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	log.Printf("replaying partition %d from offset %d up to offset %d", partition, start, end)
+
+	// Sinks that support it are written in batches.
+	batchWriter, _ := writer.(BatchWriter)
+	var batch []events.GameSession
+	flush := func() error {
+		if len(batch) == 0 || opts.dryRun {
+			return nil
+		}
+		err := writeBatchWithRetry(ctx, batchWriter, opts.sink, batch)
+		batch = batch[:0]
+		return err
+	}
+
+	for next := start; next < end; {
+		msg, err := r.Fetch(ctx)
+		if err != nil {
+			return err
+		}
+		next = msg.Offset + 1
+		if msg.Offset >= end {
+			break
+		}
+		if !opts.to.IsZero() && !msg.Time.Before(opts.to) {
+			return flush()
+		}
+
+		ev, err := decodeEvent(msg.Value, msg.Headers[events.ContentTypeHeader])
+		if err != nil {
+			log.Printf("skipping partition %d offset %d: %v", partition, msg.Offset, err)
+			report.skipped++
+			continue
+		}
+
+		if opts.dedupe && ev.Type == events.TypeGameScoreRecorded && time.Since(ev.Session.Timestamp) > replayDedupeWindow {
+			report.expired++
+			continue
+		}
+
+		if checker != nil {
+			applied, err := checker.applied(ctx, ev)
+			if err != nil {
+				return err
+			}
+			if applied {
+				report.applied++
+				continue
+			}
+		}
+
+		if !opts.dryRun {
+			if batchWriter != nil && ev.Type == events.TypeGameScoreRecorded {
+				batch = append(batch, ev.Session)
+				if len(batch) >= replayBatchSize {
+					if err := flush(); err != nil {
+						return err
+					}
+				}
+			} else {
+				// Keep events in order: pending sessions must be stored
+				// before e.g. a void refers to them.
+				if err := flush(); err != nil {
+					return err
+				}
+				if err := applyWithRetry(ctx, writer, opts.sink, ev); err != nil {
+					return err
+				}
+			}
+		}
+		report.add(partition, ev)
+	}
+	return flush()
+}
+
+// writeBatchWithRetry is the batch counterpart of applyWithRetry.
+func writeBatchWithRetry(ctx context.Context, writer BatchWriter, sink string, sessions []events.GameSession) error {
+	backoff := time.Second
+	for {
+		err := writer.WriteBatch(ctx, sessions)
+		if err == nil {
+			return nil
+		}
+
+		log.Printf("[%s] error writing %d sessions, retrying in %s: %v", sink, len(sessions), backoff, err)
+		messageProcessingErrors.WithLabelValues(sink).Inc()
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+
+		backoff *= 2
+		if backoff > maxRetryBackoff {
+			backoff = maxRetryBackoff
+		}
+	}
+}
+
+func printReplayReport(report *replayReport, opts replayOptions) {
+	verb := "replayed"
+	if opts.dryRun {
+		verb = "would replay"
+	}
+	log.Printf("%s %d messages into %s (%d skipped)", verb, report.messages, opts.sink, report.skipped)
+	if opts.dedupe {
+		log.Printf("  %d sessions older than %s skipped, their scores may already be applied", report.expired, replayDedupeWindow)
+	}
+	if opts.dryRun && opts.dedupe {
+		log.Printf("  %d events already applied by redis", report.applied)
+	}
+
+	partitions := make([]int, 0, len(report.partitions))
+	for p := range report.partitions {
+		partitions = append(partitions, p)
+	}
+	sort.Ints(partitions)
+	for _, p := range partitions {
+		log.Printf("  partition %d: %d messages", p, report.partitions[p])
+	}
+	for eventType, count := range report.moderation {
+		log.Printf("  %s: %d events", eventType, count)
+	}
+
+	for gameMode, scores := range report.scores {
+		log.Printf("  mode %s:", gameMode)
+		for userID, delta := range scores {
+			log.Printf("    user %s: %d sessions, score %+d", userID, report.sessions[gameMode][userID], delta)
+		}
+	}
+}
+
+func parseReplayTime(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
+
+// parsePartitionOffsets parses a list of partition:offset pairs.
+func parsePartitionOffsets(value string) (map[int]int64, error) {
+	offsets := make(map[int]int64)
+	if value == "" {
+		return offsets, nil
+	}
+
+	for _, pair := range strings.Split(value, ",") {
+		partition, offset, ok := strings.Cut(strings.TrimSpace(pair), ":")
+		if !ok {
+			return nil, errors.New("expected partition:offset pairs")
+		}
+
+		p, err := strconv.Atoi(partition)
+		if err != nil {
+			return nil, fmt.Errorf("invalid partition %q", partition)
+		}
+		o, err := strconv.ParseInt(offset, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid offset %q", offset)
+		}
+		offsets[p] = o
+	}
+
+	return offsets, nil
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/gocql/gocql"
+	"github.com/redis/go-redis/v9"
+	"shared/seasons"
+)
+
+const (
+	// seasonRefreshInterval bounds how long a season change takes to reach
+	// a running redis sink, so seasons should be created ahead of their start.
+	seasonRefreshInterval = 30 * time.Second
+
+	cassandraArchiveBatchSize = 100
+)
+
+// Standing is a player's final position on a season board.
+type Standing struct {
+	Rank   int64
+	UserID string
+	Score  float64
+}
+
+// SeasonArchiver is implemented by sinks that keep the final standings of
+// ended seasons.
+type SeasonArchiver interface {
+	ArchiveSeason(ctx context.Context, season seasons.Season, gameMode string, standings []Standing) error
+}
+
+// seasonCache keeps the seasons read from redis for seasonRefreshInterval.
+type seasonCache struct {
+	client *redis.Client
+
+	mu     sync.Mutex
+	list   []seasons.Season
+	loaded time.Time
+}
+
+// current returns the season of gameMode running at t. Archived seasons are
+// closed and never returned.
+func (c *seasonCache) current(ctx context.Context, gameMode string, t time.Time) (seasons.Season, bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if time.Since(c.loaded) > seasonRefreshInterval {
+		list, err := loadSeasons(ctx, c.client)
+		if err != nil {
+			return seasons.Season{}, false, err
+		}
+		c.list = list
+		c.loaded = time.Now()
+	}
+
+	season, ok := seasons.Current(c.list, gameMode, t)
+	if !ok || season.ArchivedAt != nil {
+		return seasons.Season{}, false, nil
+	}
+	return season, true, nil
+}
+
+func loadSeasons(ctx context.Context, client *redis.Client) ([]seasons.Season, error) {
+	fields, err := client.HGetAll(ctx, seasons.Key).Result()
+	if err != nil {
+		return nil, err
+	}
+	return seasons.Parse(fields)
+}
+
+// runArchive implements the "archive" subcommand. It stores the final
+// standings of every season that ended more than -grace ago and has not
+// been archived yet in the given sinks, then marks it archived in redis.
+// The grace period leaves time for late sessions still queued in Kafka.
+func runArchive(args []string) {
+	fs := flag.NewFlagSet("archive", flag.ExitOnError)
+	sinksFlag := fs.String("sinks", "cassandra", "comma separated sinks to archive the standings to (cassandra,postgres)")
+	grace := fs.Duration("grace", 10*time.Minute, "how long after its end a season is archived")
+	interval := fs.Duration("interval", 0, "keep running and check for ended seasons at this interval, 0 to run once")
+	seasonID := fs.String("season", "", "archive only this season, even if it was archived before")
+	fs.Parse(args)
+
+	sinks, err := parseSinks(*sinksFlag)
+	if err != nil {
+		log.Fatalf("invalid sinks: %v", err)
+	}
+
+	var archivers []SeasonArchiver
+	for _, sink := range sinks {
+		writer, err := sinkFactories[sink]()
+		if err != nil {
+			log.Fatalf("failed to setup %s: %v", sink, err)
+		}
+		defer writer.Close()
+
+		archiver, ok := writer.(SeasonArchiver)
+		if !ok {
+			log.Fatalf("sink %s cannot archive seasons", sink)
+		}
+		archivers = append(archivers, archiver)
+	}
+
+	redisWriter, err := setupRedis()
+	if err != nil {
+		log.Fatalf("failed to setup redis: %v", err)
+	}
+	defer redisWriter.Close()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	for {
+		if err := archiveSeasons(ctx, redisWriter.client, archivers, *grace, *seasonID); err != nil {
+			if *interval == 0 {
+				log.Fatalf("archive failed: %v", err)
+			}
+			log.Printf("archive failed, retrying in %v: %v", *interval, err)
+		}
+
+		if *interval == 0 {
+			return
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(*interval):
+		}
+	}
+}
+
+func archiveSeasons(ctx context.Context, client *redis.Client, archivers []SeasonArchiver, grace time.Duration, seasonID string) error {
+	list, err := loadSeasons(ctx, client)
+	if err != nil {
+		return err
+	}
+
+	found := false
+	for _, season := range list {
+		if seasonID != "" {
+			if season.ID != seasonID {
+				continue
+			}
+			found = true
+		} else if season.ArchivedAt != nil || time.Since(season.End) < grace {
+			continue
+		}
+
+		if err := archiveSeason(ctx, client, archivers, season); err != nil {
+			return fmt.Errorf("season %s: %w", season.ID, err)
+		}
+	}
+
+	if seasonID != "" && !found {
+		return fmt.Errorf("season %s does not exist", seasonID)
+	}
+	return nil
+}
+
+func archiveSeason(ctx context.Context, client *redis.Client, archivers []SeasonArchiver, season seasons.Season) error {
+	for _, gameMode := range season.Modes {
+		result, err := client.ZRevRangeWithScores(ctx, seasons.LeaderboardKey(gameMode, season.ID), 0, -1).Result()
+		if err != nil {
+			return err
+		}
+
+		standings := make([]Standing, len(result))
+		for i, z := range result {
+			standings[i] = Standing{
+				Rank:   int64(i + 1),
+				UserID: strings.TrimPrefix(z.Member.(string), "user:"),
+				Score:  z.Score,
+			}
+		}
+
+		for _, archiver := range archivers {
+			if err := archiver.ArchiveSeason(ctx, season, gameMode, standings); err != nil {
+				return err
+			}
+		}
+
+		log.Printf("archived %d standings of season %s for mode %s", len(standings), season.ID, gameMode)
+	}
+
+	now := time.Now().UTC()
+	season.ArchivedAt = &now
+	data, err := json.Marshal(season)
+	if err != nil {
+		return err
+	}
+	return client.HSet(ctx, seasons.Key, season.ID, data).Err()
+}
+
+// ArchiveSeason replaces the standings of the season and mode, which form a
+// single partition.
+func (c *CassandraWriter) ArchiveSeason(ctx context.Context, season seasons.Season, gameMode string, standings []Standing) error {
+	archivedAt := time.Now()
+
+	err := c.session.Query(
+		`DELETE FROM game_system.season_standings WHERE season_id = ? AND game_mode = ?`,
+		season.ID, gameMode,
+	).WithContext(ctx).Exec()
+	if err != nil {
+		log.Printf("[Cassandra] Error clearing standings of season %s: %v", season.ID, err)
+		storageWriteErrors.WithLabelValues("cassandra").Inc()
+		return err
+	}
+
+	for start := 0; start < len(standings); start += cassandraArchiveBatchSize {
+		end := start + cassandraArchiveBatchSize
+		if end > len(standings) {
+			end = len(standings)
+		}
+
+		// Every row is in the same partition, so an unlogged batch is
+		// applied as a single write.
+		batch := c.session.NewBatch(gocql.UnloggedBatch).WithContext(ctx)
+		for _, standing := range standings[start:end] {
+			batch.Query(
+				`INSERT INTO game_system.season_standings (season_id, game_mode, rank, user_id, score, archived_at) VALUES (?, ?, ?, ?, ?, ?)`,
+				season.ID, gameMode, standing.Rank, standing.UserID, standing.Score, archivedAt,
+			)
+		}
+
+		if err := c.session.ExecuteBatch(batch); err != nil {
+			log.Printf("[Cassandra] Error archiving season %s: %v", season.ID, err)
+			storageWriteErrors.WithLabelValues("cassandra").Inc()
+			return err
+		}
+	}
+
+	return nil
+}
+
+// ArchiveSeason replaces the standings of the season and mode in a single
+// transaction.
+func (p *PostgresWriter) ArchiveSeason(ctx context.Context, season seasons.Season, gameMode string, standings []Standing) error {
+	tx, err := p.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, `DELETE FROM season_standings WHERE season_id = $1 AND game_mode = $2`, season.ID, gameMode)
+	if err != nil {
+		storageWriteErrors.WithLabelValues("postgres").Inc()
+		return err
+	}
+
+	for start := 0; start < len(standings); start += postgresMaxBatchRows {
+		end := start + postgresMaxBatchRows
+		if end > len(standings) {
+			end = len(standings)
+		}
+
+		var query strings.Builder
+		query.WriteString("INSERT INTO season_standings (season_id, game_mode, rank, user_id, score) VALUES ")
+
+		args := make([]interface{}, 0, (end-start)*5)
+		for i, standing := range standings[start:end] {
+			if i > 0 {
+				query.WriteString(", ")
+			}
+			n := len(args)
+			fmt.Fprintf(&query, "($%d, $%d, $%d, $%d, $%d)", n+1, n+2, n+3, n+4, n+5)
+			args = append(args, season.ID, gameMode, standing.Rank, standing.UserID, standing.Score)
+		}
+
+		if _, err := tx.ExecContext(ctx, query.String(), args...); err != nil {
+			log.Printf("[Postgres] Error archiving season %s: %v", season.ID, err)
+			storageWriteErrors.WithLabelValues("postgres").Inc()
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/redis/go-redis/v9"
+	"shared/rankhistory"
+	"shared/seasons"
+)
+
+var (
+	snapshotPointsRecorded = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "worker_snapshot_points_recorded_total",
+		Help: "The total number of rank history points recorded by the snapshotter",
+	}, []string{"board"})
+
+	snapshotDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "worker_snapshot_duration_seconds",
+		Help:    "The duration of a board snapshot in seconds",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"board"})
+)
+
+// snapshotter records the rank history of every player, see package
+// rankhistory.
+type snapshotter struct {
+	client    *redis.Client
+	modes     []string
+	top       int64
+	pageSize  int64
+	retention time.Duration
+}
+
+// runSnapshotter implements the "snapshotter" subcommand. Every -interval it
+// records a rank history point for the top -top players of each board and
+// for every other player whose rank or score changed. Boards are the
+// all-time board of each mode and the season currently running for it.
+func runSnapshotter(args []string) {
+	fs := flag.NewFlagSet("snapshotter", flag.ExitOnError)
+	interval := fs.Duration("interval", time.Hour, "time between snapshots")
+	top := fs.Int64("top", 100, "number of players recorded on every snapshot, whether their rank changed or not")
+	modes := fs.String("modes", "", "comma separated game modes to snapshot, all modes with a leaderboard if empty")
+	pageSize := fs.Int64("page-size", 1000, "number of players read from redis at a time")
+	retention := fs.Duration("retention", 90*24*time.Hour, "how long points are kept, 0 to keep them forever")
+	once := fs.Bool("once", false, "take a single snapshot and exit")
+	metricsAddr := fs.String("metrics-addr", ":2115", "address to serve the metrics endpoint on")
+	fs.Parse(args)
+
+	if *interval <= 0 || *top < 0 || *pageSize < 1 {
+		log.Fatal("invalid flags, -interval and -page-size must be positive and -top not negative")
+	}
+
+	go func() {
+		http.Handle("/metrics", promhttp.Handler())
+		log.Printf("metrics endpoint running on %s/metrics", *metricsAddr)
+		log.Fatal(http.ListenAndServe(*metricsAddr, nil))
+	}()
+
+	redisWriter, err := setupRedis()
+	if err != nil {
+		log.Fatalf("failed to setup redis: %v", err)
+	}
+	defer redisWriter.Close()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	s := &snapshotter{
+		client:    redisWriter.client,
+		top:       *top,
+		pageSize:  *pageSize,
+		retention: *retention,
+	}
+	if *modes != "" {
+		s.modes = strings.Split(*modes, ",")
+	}
+
+	for {
+		// Points are aligned to the interval so the series of all players
+		// share their timestamps.
+		now := time.Now().Truncate(*interval)
+		if *once {
+			now = time.Now()
+		}
+
+		if err := s.snapshot(ctx, now.UTC()); err != nil {
+			if *once {
+				log.Fatalf("snapshot failed: %v", err)
+			}
+			log.Printf("snapshot failed: %v", err)
+		}
+
+		if *once {
+			return
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Until(now.Add(*interval))):
+		}
+	}
+}
+
+func (s *snapshotter) snapshot(ctx context.Context, now time.Time) error {
+	boards, err := s.boards(ctx, now)
+	if err != nil {
+		return err
+	}
+
+	for _, board := range boards {
+		if err := s.snapshotBoard(ctx, board, now); err != nil {
+			return fmt.Errorf("board %s: %w", board, err)
+		}
+	}
+
+	log.Printf("snapshot of %d boards at %s complete", len(boards), now.Format(time.RFC3339))
+	return nil
+}
+
+// boards returns the boards to snapshot at now.
+func (s *snapshotter) boards(ctx context.Context, now time.Time) ([]string, error) {
+	modes := s.modes
+	if modes == nil {
+		iter := s.client.ScanType(ctx, 0, "leaderboard:*", 100, "zset").Iterator()
+		for iter.Next(ctx) {
+			board := strings.TrimPrefix(iter.Val(), "leaderboard:")
+			// Derived boards, e.g. season boards, have a suffix.
+			if !strings.Contains(board, ":") {
+				modes = append(modes, board)
+			}
+		}
+		if err := iter.Err(); err != nil {
+			return nil, err
+		}
+		sort.Strings(modes)
+	}
+
+	list, err := loadSeasons(ctx, s.client)
+	if err != nil {
+		return nil, err
+	}
+
+	var boards []string
+	for _, gameMode := range modes {
+		boards = append(boards, gameMode)
+		if season, ok := seasons.Current(list, gameMode, now); ok && season.ArchivedAt == nil {
+			boards = append(boards, seasons.Board(gameMode, season.ID))
+		}
+	}
+	return boards, nil
+}
+
+// snapshotBoard records the points of one board. The board is copied first
+// so that ranks are consistent while it is read page by page.
+func (s *snapshotter) snapshotBoard(ctx context.Context, board string, now time.Time) error {
+	timer := prometheus.NewTimer(snapshotDuration.WithLabelValues(board))
+	defer timer.ObserveDuration()
+
+	copyKey := "rankhistory:" + board + ":copy"
+	err := s.client.ZUnionStore(ctx, copyKey, &redis.ZStore{Keys: []string{"leaderboard:" + board}}).Err()
+	if err != nil {
+		return err
+	}
+	defer s.client.Del(context.Background(), copyKey)
+
+	lastKey := rankhistory.LastKey(board)
+	last, err := s.client.HGetAll(ctx, lastKey).Result()
+	if err != nil {
+		return err
+	}
+
+	// seen holds the players on the board, whose last state is kept
+	seen := make(map[string]bool, len(last))
+	recorded := 0
+	for start := int64(0); ; start += s.pageSize {
+		result, err := s.client.ZRevRangeWithScores(ctx, copyKey, start, start+s.pageSize-1).Result()
+		if err != nil {
+			return err
+		}
+
+		pipe := s.client.Pipeline()
+		for i, z := range result {
+			playerKey := z.Member.(string)
+			rank := start + int64(i) + 1
+			seen[playerKey] = true
+
+			state := fmt.Sprintf("%d:%g", rank, z.Score)
+			if rank > s.top && last[playerKey] == state {
+				continue
+			}
+
+			member, err := rankhistory.Encode(rankhistory.Point{Time: now, Rank: rank, Score: z.Score})
+			if err != nil {
+				return err
+			}
+
+			historyKey := rankhistory.Key(board, strings.TrimPrefix(playerKey, "user:"))
+			pipe.ZAdd(ctx, historyKey, redis.Z{Score: float64(now.Unix()), Member: member})
+			pipe.HSet(ctx, lastKey, playerKey, state)
+			recorded++
+		}
+
+		if pipe.Len() > 0 {
+			if _, err := pipe.Exec(ctx); err != nil {
+				return err
+			}
+		}
+
+		if int64(len(result)) < s.pageSize {
+			break
+		}
+	}
+
+	// Players who left the board, e.g. removed or banned ones, get a new
+	// point if they come back
+	var gone []string
+	for playerKey := range last {
+		if !seen[playerKey] {
+			gone = append(gone, playerKey)
+		}
+	}
+	for len(gone) > 0 {
+		n := min(len(gone), int(s.pageSize))
+		if err := s.client.HDel(ctx, lastKey, gone[:n]...).Err(); err != nil {
+			return err
+		}
+		gone = gone[n:]
+	}
+
+	if s.retention > 0 {
+		if err := s.trim(ctx, board, now.Add(-s.retention)); err != nil {
+			return err
+		}
+	}
+
+	snapshotPointsRecorded.WithLabelValues(board).Add(float64(recorded))
+	log.Printf("recorded %d rank history points for board %s", recorded, board)
+	return nil
+}
+
+// trim removes the points of board older than cutoff from the history of
+// every player, including those who are no longer on the board and so get
+// no new points. Redis deletes the histories left empty.
+func (s *snapshotter) trim(ctx context.Context, board string, cutoff time.Time) error {
+	before := fmt.Sprintf("(%d", cutoff.Unix())
+	iter := s.client.ScanType(ctx, 0, rankhistory.Key(board, "*"), s.pageSize, "zset").Iterator()
+
+	pipe := s.client.Pipeline()
+	for iter.Next(ctx) {
+		pipe.ZRemRangeByScore(ctx, iter.Val(), "-inf", before)
+		if int64(pipe.Len()) >= s.pageSize {
+			if _, err := pipe.Exec(ctx); err != nil {
+				return err
+			}
+		}
+	}
+	if err := iter.Err(); err != nil {
+		return err
+	}
+	if pipe.Len() > 0 {
+		_, err := pipe.Exec(ctx)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"crypto/hmac"
+	"flag"
+	"io"
+	"log"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+
+	"shared/events"
+)
+
+// webhookMaxAge is how old a delivery's timestamp may be before the webhook
+// sink treats it as a replay.
+const webhookMaxAge = 5 * time.Minute
+
+// runWebhookSink implements the "webhook-sink" subcommand, a local stand-in
+// for a webhook receiver. It verifies the signature of every delivery and
+// logs the notification. -fail-rate makes it answer some deliveries with a
+// 503 to exercise the retries.
+func runWebhookSink(args []string) {
+	fs := flag.NewFlagSet("webhook-sink", flag.ExitOnError)
+	addr := fs.String("addr", ":8090", "address to listen on")
+	secret := fs.String("secret", "", "webhook secret the signatures are checked against")
+	failRate := fs.Float64("fail-rate", 0, "fraction of deliveries to fail with a 503")
+	fs.Parse(args)
+
+	if *secret == "" {
+		log.Fatal("-secret is required")
+	}
+
+	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, "failed to read body", http.StatusBadRequest)
+			return
+		}
+
+		timestamp := r.Header.Get(webhookTimestampHeader)
+		sent, err := strconv.ParseInt(timestamp, 10, 64)
+		if err != nil || time.Since(time.Unix(sent, 0)) > webhookMaxAge {
+			log.Printf("rejected delivery with invalid or stale timestamp %q", timestamp)
+			http.Error(w, "invalid timestamp", http.StatusUnauthorized)
+			return
+		}
+
+		expected := signWebhook(*secret, timestamp, body)
+		if !hmac.Equal([]byte(r.Header.Get(webhookSignatureHeader)), []byte(expected)) {
+			log.Printf("rejected delivery with invalid signature")
+			http.Error(w, "invalid signature", http.StatusUnauthorized)
+			return
+		}
+
+		if rand.Float64() < *failRate {
+			log.Printf("failing delivery %s on purpose", r.Header.Get("X-Webhook-ID"))
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+
+		env, err := events.Decode(body)
+		if err != nil {
+			http.Error(w, "invalid event", http.StatusBadRequest)
+			return
+		}
+
+		notification, err := env.RankNotification()
+		if err != nil {
+			http.Error(w, "invalid notification", http.StatusBadRequest)
+			return
+		}
+
+		log.Printf("received %s: %+v", env.EventType, notification)
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	log.Printf("webhook sink listening on %s", *addr)
+	log.Fatal(http.ListenAndServe(*addr, nil))
+}